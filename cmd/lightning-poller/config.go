@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/go-playground/validator/v10"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/viper"
+)
+
+// queryConfig declares a single query in the config file
+type queryConfig struct {
+	PersistenceKey         string        `mapstructure:"persistence_key" validate:"required"`
+	Org                    string        `mapstructure:"org"`
+	SOQL                   string        `mapstructure:"soql" validate:"required"`
+	DependsOn              []string      `mapstructure:"depends_on"`
+	Interval               time.Duration `mapstructure:"interval"`
+	MaxConsecutiveFailures int           `mapstructure:"max_consecutive_failures"`
+	MaxLag                 time.Duration `mapstructure:"max_lag"`
+	StallThreshold         time.Duration `mapstructure:"stall_threshold"`
+	LagAlertThreshold      time.Duration `mapstructure:"lag_alert_threshold"`
+	WatchFields            []string      `mapstructure:"watch_fields"`
+	Sink                   sinkConfig    `mapstructure:"sink"`
+}
+
+// loadConfig reads the config file and LP_ prefixed environment variables into
+// viper. The poller is given the same file with lp.WithConfigFile
+func loadConfig() error {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return errorx.Decorate(err, "error finding home directory")
+		}
+		viper.AddConfigPath(home)
+		viper.SetConfigType("yaml")
+		viper.SetConfigName(".salesforce-lightning-poller")
+	}
+	viper.SetEnvPrefix("LP")
+	viper.AutomaticEnv()
+	err := viper.ReadInConfig()
+	if _, notFound := err.(viper.ConfigFileNotFoundError); notFound {
+		// the default config file is optional, everything can be set with
+		// environment variables
+		return nil
+	}
+	if err != nil {
+		return errorx.Decorate(err, "error reading config file")
+	}
+	return nil
+}
+
+// queriesFromConfig builds the poller's queries from the queries declared in
+// the config file, wiring each one to its sink
+func queriesFromConfig() ([]lp.QueryWithCallback, error) {
+	configs := []queryConfig{}
+	err := viper.UnmarshalKey("queries", &configs)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error parsing queries")
+	}
+	if len(configs) == 0 {
+		return nil, errorx.IllegalArgument.New("invalid configuration: at least one query is required")
+	}
+	theValidator := validator.New()
+	queries := make([]lp.QueryWithCallback, 0, len(configs))
+	for i, config := range configs {
+		err = theValidator.Struct(config)
+		if err != nil {
+			return nil, errorx.Decorate(err, fmt.Sprintf("invalid configuration for query %d", i))
+		}
+		key := lp.OrgKey(config.Org, config.PersistenceKey)
+		callback, err := newSink(key, config.Sink)
+		if err != nil {
+			return nil, errorx.Decorate(err, fmt.Sprintf("error creating sink for %s", key))
+		}
+		soql := config.SOQL
+		queries = append(queries, lp.QueryWithCallback{
+			Query:                  func() string { return soql },
+			PersistenceKey:         config.PersistenceKey,
+			Org:                    config.Org,
+			Callback:               callback,
+			DependsOn:              config.DependsOn,
+			Interval:               config.Interval,
+			MaxConsecutiveFailures: config.MaxConsecutiveFailures,
+			MaxLag:                 config.MaxLag,
+			StallThreshold:         config.StallThreshold,
+			LagAlertThreshold:      config.LagAlertThreshold,
+			WatchFields:            config.WatchFields,
+		})
+	}
+	return queries, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var cfgFile string
+
+var rootCmd = &cobra.Command{
+	Use:   "lightning-poller",
+	Short: "Poll salesforce for changed records and deliver them to sinks",
+	Long: `lightning-poller runs the salesforce lightning poller using queries and sinks
+declared in a yaml config file, so that the poller can be used without writing go.
+Settings that aren't in the config file are read from LP_ prefixed environment variables.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.salesforce-lightning-poller.yaml)")
+}
+
+func main() {
+	cobra.CheckErr(rootCmd.Execute())
+}
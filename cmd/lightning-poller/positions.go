@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/joomcode/errorx"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var positionsPath string
+
+var positionsCmd = &cobra.Command{
+	Use:   "positions",
+	Short: "Manage persisted positions. The poller must be stopped",
+	Long: `Manage the positions the poller has persisted for each persistence key.
+The position store is locked while the poller is running, so stop the poller first.
+Changes apply the next time the poller starts, and unlike LP_STARTUP_POSITION_OVERRIDES
+they only apply once.`,
+}
+
+var positionsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List every persisted position",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withPositionStore(func(store lp.PositionStore) error {
+			positions, err := store.List()
+			if err != nil {
+				return err
+			}
+			writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "PERSISTENCE KEY\tLAST MODIFIED DATE\tNEXT URL\tPREVIOUS RECORD IDS")
+			for _, key := range sortedKeys(positions) {
+				position := positions[key]
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%d\n", key, formatLastModifiedDate(position), position.NextURL, len(position.PreviousRecordIDs))
+			}
+			return writer.Flush()
+		})
+	},
+}
+
+var positionsShowCmd = &cobra.Command{
+	Use:   "show KEY",
+	Short: "Show the persisted position for a key as json",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withPositionStore(func(store lp.PositionStore) error {
+			position, err := getPersistedPosition(store, args[0])
+			if err != nil {
+				return err
+			}
+			return writeJSON(cmd.OutOrStdout(), position)
+		})
+	},
+}
+
+var positionsSetCmd = &cobra.Command{
+	Use:   "set KEY TIMESTAMP",
+	Short: "Set a key to start polling from an RFC3339 timestamp",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timestamp, err := time.Parse(time.RFC3339, args[1])
+		if err != nil {
+			return errorx.Decorate(err, "invalid timestamp")
+		}
+		return withPositionStore(func(store lp.PositionStore) error {
+			return store.Set(args[0], lp.NewPositionAt(timestamp))
+		})
+	},
+}
+
+var positionsRewindCmd = &cobra.Command{
+	Use:   "rewind KEY DURATION",
+	Short: "Rewind a key's position by a duration such as 2h",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		duration, err := time.ParseDuration(args[1])
+		if err != nil {
+			return errorx.Decorate(err, "invalid duration")
+		}
+		return withPositionStore(func(store lp.PositionStore) error {
+			position, err := getPersistedPosition(store, args[0])
+			if err != nil {
+				return err
+			}
+			return store.Set(args[0], position.Rewind(duration))
+		})
+	},
+}
+
+var positionsResetCmd = &cobra.Command{
+	Use:   "reset KEY",
+	Short: "Delete a key's position so that it polls from the beginning",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withPositionStore(func(store lp.PositionStore) error {
+			return store.Delete(args[0])
+		})
+	},
+}
+
+var positionsExportCmd = &cobra.Command{
+	Use:   "export [FILE]",
+	Short: "Export every position as json to a file, or stdout",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withPositionStore(func(store lp.PositionStore) error {
+			positions, err := store.List()
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				return writeJSON(cmd.OutOrStdout(), positions)
+			}
+			file, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			err = writeJSON(file, positions)
+			if err != nil {
+				return err
+			}
+			return file.Close()
+		})
+	},
+}
+
+var positionsImportCmd = &cobra.Command{
+	Use:   "import [FILE]",
+	Short: "Import positions from a json export in a file, or stdin",
+	Long: `Import positions from a json export in a file, or stdin. Every key in the
+export is overwritten, keys that aren't in the export are left alone.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var reader io.Reader = cmd.InOrStdin()
+		if len(args) == 1 {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			reader = file
+		}
+		positions := map[string]*lp.Position{}
+		err := json.NewDecoder(reader).Decode(&positions)
+		if err != nil {
+			return errorx.Decorate(err, "error parsing positions")
+		}
+		return withPositionStore(func(store lp.PositionStore) error {
+			for _, key := range sortedKeys(positions) {
+				if positions[key] == nil {
+					return errorx.IllegalArgument.New("position for %s is empty", key)
+				}
+				err := store.Set(key, *positions[key])
+				if err != nil {
+					return errorx.Decorate(err, fmt.Sprintf("error importing position for %s", key))
+				}
+			}
+			return nil
+		})
+	},
+}
+
+// withPositionStore opens the poller's position store, calls fn with it, and
+// closes it
+func withPositionStore(fn func(store lp.PositionStore) error) (err error) {
+	err = loadConfig()
+	if err != nil {
+		return
+	}
+	path := positionsPath
+	if path == "" {
+		path = viper.GetString("persistence_path")
+	}
+	if path == "" {
+		path = "."
+	}
+	store, err := lp.OpenBadgerPositionStore(path)
+	if err != nil {
+		return errorx.Decorate(err, "error opening position store, make sure the poller is stopped")
+	}
+	defer func() {
+		closeErr := store.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	return fn(store)
+}
+
+// getPersistedPosition returns the position persisted for a key. Unlike
+// PositionStore.Get, which returns an empty position for keys that aren't
+// persisted, it fails for them, so that a mistyped key isn't shown as empty or
+// rewound into a new position
+func getPersistedPosition(store lp.PositionStore, key string) (*lp.Position, error) {
+	positions, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	position, ok := positions[key]
+	if !ok {
+		return nil, errorx.IllegalArgument.New("no position is persisted for %s, see positions list", key)
+	}
+	return position, nil
+}
+
+func writeJSON(writer io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func formatLastModifiedDate(position *lp.Position) string {
+	if position.LastModifiedDate == nil {
+		return ""
+	}
+	return position.LastModifiedDate.UTC().Format(time.RFC3339)
+}
+
+func sortedKeys(positions map[string]*lp.Position) []string {
+	keys := make([]string, 0, len(positions))
+	for key := range positions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func init() {
+	positionsCmd.PersistentFlags().StringVar(&positionsPath, "path", "", "path to the position store, defaults to persistence_path from the config")
+	positionsCmd.AddCommand(positionsListCmd, positionsShowCmd, positionsSetCmd, positionsRewindCmd, positionsResetCmd, positionsExportCmd, positionsImportCmd)
+	rootCmd.AddCommand(positionsCmd)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+)
+
+// runPositions runs a positions subcommand against the position store in path
+func runPositions(t *testing.T, path string, args ...string) (string, error) {
+	t.Helper()
+	// the default config file is looked up in the home directory
+	t.Setenv("HOME", t.TempDir())
+	out := &bytes.Buffer{}
+	rootCmd.SetOut(out)
+	rootCmd.SetErr(&bytes.Buffer{})
+	rootCmd.SetArgs(append([]string{"positions", "--path", path}, args...))
+	err := rootCmd.Execute()
+	return out.String(), err
+}
+
+func TestPositionsShowAndRewindRejectUnknownKeys(t *testing.T) {
+	path := t.TempDir()
+	_, err := runPositions(t, path, "set", "Accounts", "2024-01-02T03:04:05Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"show", "Acounts"}, {"rewind", "Acounts", "1h"}} {
+		_, err = runPositions(t, path, args...)
+		if err == nil || !strings.Contains(err.Error(), "no position is persisted for Acounts") {
+			t.Fatalf("expected %s to reject the unknown key, got %v", args[0], err)
+		}
+	}
+	out, err := runPositions(t, path, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := map[string]*lp.Position{}
+	err = json.Unmarshal([]byte(out), &positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := positions["Acounts"]; ok || len(positions) != 1 {
+		t.Fatalf("expected the rewind not to persist the unknown key, got %v", positions)
+	}
+}
+
+func TestPositionsRewindMovesAPersistedPosition(t *testing.T) {
+	path := t.TempDir()
+	_, err := runPositions(t, path, "set", "Accounts", "2024-01-02T03:04:05Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runPositions(t, path, "rewind", "Accounts", "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runPositions(t, path, "show", "Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := lp.Position{}
+	err = json.Unmarshal([]byte(out), &position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC)
+	if position.LastModifiedDate == nil || !position.LastModifiedDate.Equal(expected) {
+		t.Fatalf("expected the position at %s, got %v", expected, position.LastModifiedDate)
+	}
+}
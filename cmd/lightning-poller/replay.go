@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	replayDir       string
+	replayFrom      string
+	replayTo        string
+	replayBatchSize int
+	replaySink      string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay KEY",
+	Short: "Replay a query's archived records into its sink",
+	Long: `Replay the records a file sink archived for a persistence key into the query's sink,
+without querying salesforce. Positions aren't changed. Use --sink to replay into a
+different sink type, such as stdout, instead. --sink is required when the query's
+sink is the file sink that archives into --dir.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := loadConfig()
+		if err != nil {
+			return err
+		}
+		config := lp.ReplayConfig{Dir: replayDir, PersistenceKey: args[0], BatchSize: replayBatchSize}
+		config.From, err = parseOptionalTime(replayFrom)
+		if err != nil {
+			return errorx.Decorate(err, "invalid --from")
+		}
+		config.To, err = parseOptionalTime(replayTo)
+		if err != nil {
+			return errorx.Decorate(err, "invalid --to")
+		}
+		queries, err := queriesFromConfig()
+		defer closeSinks()
+		if err != nil {
+			return err
+		}
+		query, ok := lp.QueryWithCallback{}, false
+		for _, candidate := range queries {
+			if lp.OrgKey(candidate.Org, candidate.PersistenceKey) == args[0] {
+				query, ok = candidate, true
+			}
+		}
+		if !ok {
+			return errorx.IllegalArgument.New("no query in the config file has persistence key %s", args[0])
+		}
+		if replaySink != "" {
+			query.Callback, err = newSink(args[0], sinkConfig{Type: replaySink})
+			if err != nil {
+				return err
+			}
+		} else {
+			err = checkSinkIsNotArchive(args[0], replayDir)
+			if err != nil {
+				return err
+			}
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		summary, err := lp.Replay(ctx, config, query)
+		fields := logrus.Fields{"records": summary.Records, "batches": summary.Batches, "duplicates": summary.Duplicates}
+		if summary.LastModifiedDate != nil {
+			fields["last_modified_date"] = summary.LastModifiedDate.Format(time.RFC3339)
+		}
+		logging.Log.WithFields(fields).Info("replay summary")
+		return err
+	},
+}
+
+// checkSinkIsNotArchive refuses to replay into the query's own sink when it's
+// the file sink that archived the records, which would append the replayed
+// records to the archive being read
+func checkSinkIsNotArchive(key, dir string) error {
+	configs := []queryConfig{}
+	err := viper.UnmarshalKey("queries", &configs)
+	if err != nil {
+		return errorx.Decorate(err, "error parsing queries")
+	}
+	for _, config := range configs {
+		if lp.OrgKey(config.Org, config.PersistenceKey) != key || config.Sink.Type != "file" {
+			continue
+		}
+		sinkDir, ok := config.Sink.Options["dir"].(string)
+		if ok && samePath(sinkDir, dir) {
+			return errorx.IllegalArgument.New("the sink of %s archives into %s, use --sink to replay into another sink", key, dir)
+		}
+	}
+	return nil
+}
+
+func samePath(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
+
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func init() {
+	replayCmd.Flags().StringVar(&replayDir, "dir", "", "the file sink directory the records were archived in")
+	replayCmd.Flags().StringVar(&replayFrom, "from", "", "only replay records last modified at or after this RFC3339 timestamp")
+	replayCmd.Flags().StringVar(&replayTo, "to", "", "only replay records last modified before this RFC3339 timestamp")
+	replayCmd.Flags().IntVar(&replayBatchSize, "batch-size", 2000, "the most records passed to the sink at a time")
+	replayCmd.Flags().StringVar(&replaySink, "sink", "", "replay into a sink of this type instead of the query's sink")
+	replayCmd.MarkFlagRequired("dir")
+	rootCmd.AddCommand(replayCmd)
+}
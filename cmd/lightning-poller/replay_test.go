@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayRefusesToReplayIntoTheArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	configFile := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(configFile, []byte(fmt.Sprintf(`queries:
+  - persistence_key: Accounts
+    soql: SELECT Id, LastModifiedDate FROM Account
+    sink:
+      type: file
+      dir: %s
+`, archive)), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cfgFile, replaySink = "", ""
+	})
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetErr(&bytes.Buffer{})
+	rootCmd.SetArgs([]string{"replay", "Accounts", "--config", configFile, "--dir", archive})
+	err = rootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "use --sink") {
+		t.Fatalf("expected the replay into the archive to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/stream"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var runOnce bool
+
+var runCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the poller with the queries in the config file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		err := loadConfig()
+		if err != nil {
+			return err
+		}
+		queries, err := queriesFromConfig()
+		defer closeSinks()
+		if err != nil {
+			return err
+		}
+		poller, err := lp.New(lp.WithConfigFile(cfgFile), lp.WithEnvConfig(), lp.WithQueries(queries...))
+		if err != nil {
+			return err
+		}
+		if !runOnce {
+			streamAddress, streamGRPCAddress := viper.GetString("stream_address"), viper.GetString("stream_grpc_address")
+			if changeLog != nil && (streamAddress != "" || streamGRPCAddress != "") {
+				go serveStreams(streamAddress, streamGRPCAddress)
+			}
+			poller.Run()
+			return nil
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		summary, err := poller.RunOnce(ctx)
+		for key, stats := range summary.Queries {
+			logging.Log.WithFields(logrus.Fields{
+				"persistence_key":   key,
+				"records_delivered": stats.RecordsDelivered,
+				"pages":             stats.Pages,
+				"errors":            stats.Errors,
+			}).Info("query summary")
+		}
+		return err
+	},
+}
+
+// serveStreams serves the change log of the stream sinks over http on address
+// and gRPC on grpcAddress, until the server stops
+func serveStreams(address, grpcAddress string) {
+	err := stream.NewServer(changeLog).ListenAndServe(address, grpcAddress)
+	logging.Log.WithError(err).Error("stream server stopped")
+}
+
+func init() {
+	runCmd.Flags().BoolVar(&runOnce, "once", false, "poll until every query is caught up, then exit")
+	rootCmd.AddCommand(runCmd)
+}
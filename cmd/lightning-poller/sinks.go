@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/sinks/broker"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/sinks/columnar"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/stream"
+	"github.com/joomcode/errorx"
+	"github.com/mitchellh/mapstructure"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// sinkConfig selects a built-in sink for a query. Options holds any sink
+// specific settings
+type sinkConfig struct {
+	Type    string                 `mapstructure:"type"`
+	Options map[string]interface{} `mapstructure:",remain"`
+}
+
+type callback = func(result []byte, err error) bool
+
+type sinkFactory func(persistenceKey string, options map[string]interface{}) (callback, error)
+
+var sinkFactories = map[string]sinkFactory{
+	"stdout":    newStdoutSink,
+	"log":       newLogSink,
+	"webhook":   newWebhookSink,
+	"file":      newFileSink,
+	"columnar":  newColumnarSink,
+	"jetstream": newJetStreamSink,
+	"kafka":     newKafkaSink,
+	"stream":    newStreamSink,
+}
+
+// sinkClosers are the sinks that need to be closed when the poller stops
+var sinkClosers = []io.Closer{}
+
+// closerFunc closes a sink whose close method doesn't return an error
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+// closeSinks closes every sink that needs it, logging errors
+func closeSinks() {
+	for _, closer := range sinkClosers {
+		err := closer.Close()
+		if err != nil {
+			logging.Log.WithError(err).Error("error closing sink")
+		}
+	}
+}
+
+// defaultSinkType is used for queries that don't configure a sink
+const defaultSinkType = "stdout"
+
+func newSink(persistenceKey string, config sinkConfig) (callback, error) {
+	sinkType := config.Type
+	if sinkType == "" {
+		sinkType = defaultSinkType
+	}
+	factory, ok := sinkFactories[sinkType]
+	if !ok {
+		return nil, errorx.IllegalArgument.New("unknown sink type %s, supported types are %s", sinkType, strings.Join(sinkTypes(), ","))
+	}
+	return factory(persistenceKey, config.Options)
+}
+
+func sinkTypes() []string {
+	types := make([]string, 0, len(sinkFactories))
+	for sinkType := range sinkFactories {
+		types = append(types, sinkType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// stdout is shared by every stdout sink so that records from concurrent
+// queries aren't interleaved
+var stdout = &lockedWriter{writer: bufio.NewWriter(os.Stdout)}
+
+type lockedWriter struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+// newStdoutSink writes each record to stdout as newline delimited json
+func newStdoutSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	return func(result []byte, err error) bool {
+		writeErr := stdout.writeRecords(result)
+		if writeErr != nil {
+			logging.Log.WithFields(logrus.Fields{"persistence_key": persistenceKey}).WithError(writeErr).Error("error writing records to stdout")
+			return false
+		}
+		return true
+	}, nil
+}
+
+func (w *lockedWriter) writeRecords(result []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var err error
+	gjson.ParseBytes(result).ForEach(func(_, record gjson.Result) bool {
+		_, err = io.WriteString(w.writer, record.Raw+"\n")
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// newLogSink logs each batch of records
+func newLogSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	return func(result []byte, err error) bool {
+		logging.Log.WithFields(logrus.Fields{
+			"persistence_key": persistenceKey,
+			"record_count":    gjson.GetBytes(result, "#").Int(),
+			"result":          string(result),
+		}).Info("query callback")
+		return true
+	}, nil
+}
+
+// webhookSinkConfig is the options of a webhook sink
+type webhookSinkConfig struct {
+	URL         string            `mapstructure:"url"`
+	Headers     map[string]string `mapstructure:"headers"`
+	Secret      string            `mapstructure:"secret"`
+	PerRecord   bool              `mapstructure:"per_record"`
+	Timeout     time.Duration     `mapstructure:"timeout"`
+	MaxAttempts int               `mapstructure:"max_attempts"`
+	Backoff     time.Duration     `mapstructure:"backoff"`
+	MaxBackoff  time.Duration     `mapstructure:"max_backoff"`
+}
+
+// newWebhookSink posts records to a url, see lp.WebhookSink
+func newWebhookSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	config := webhookSinkConfig{}
+	err := decodeSinkOptions(options, &config)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid webhook sink options")
+	}
+	if config.URL == "" {
+		return nil, errorx.IllegalArgument.New("invalid configuration: webhook sinks require a url")
+	}
+	sink := &lp.WebhookSink{
+		URL:         config.URL,
+		Headers:     config.Headers,
+		Secret:      config.Secret,
+		PerRecord:   config.PerRecord,
+		Timeout:     config.Timeout,
+		MaxAttempts: config.MaxAttempts,
+		Backoff:     config.Backoff,
+		MaxBackoff:  config.MaxBackoff,
+	}
+	return sink.Callback(persistenceKey), nil
+}
+
+// fileSinkConfig is the options of a file sink
+type fileSinkConfig struct {
+	Dir         string        `mapstructure:"dir"`
+	MaxSize     int64         `mapstructure:"max_size"`
+	MaxAge      time.Duration `mapstructure:"max_age"`
+	Compression string        `mapstructure:"compression"`
+}
+
+// newFileSink archives records in rotating newline delimited json files, see
+// lp.FileSink
+func newFileSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	config := fileSinkConfig{}
+	err := decodeSinkOptions(options, &config)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid file sink options")
+	}
+	if config.Dir == "" {
+		return nil, errorx.IllegalArgument.New("invalid configuration: file sinks require a dir")
+	}
+	compression, err := lp.ParseCompression(config.Compression)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := lp.NewFileSink(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	sink.MaxSize = config.MaxSize
+	sink.MaxAge = config.MaxAge
+	sink.Compression = compression
+	sinkClosers = append(sinkClosers, sink)
+	return sink.Callback(persistenceKey), nil
+}
+
+// columnarSinkConfig is the options of a columnar sink. Files are written to
+// dir, or to an S3 compatible bucket when s3_bucket is set
+type columnarSinkConfig struct {
+	Dir            string   `mapstructure:"dir"`
+	Formats        []string `mapstructure:"formats"`
+	PartitionField string   `mapstructure:"partition_field"`
+	S3Endpoint     string   `mapstructure:"s3_endpoint"`
+	S3Region       string   `mapstructure:"s3_region"`
+	S3Bucket       string   `mapstructure:"s3_bucket"`
+	S3Prefix       string   `mapstructure:"s3_prefix"`
+}
+
+// newColumnarSink exports records to date partitioned parquet or csv files,
+// see columnar.Sink. S3 credentials are read from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func newColumnarSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	config := columnarSinkConfig{}
+	err := decodeSinkOptions(options, &config)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid columnar sink options")
+	}
+	var store columnar.ObjectStore
+	switch {
+	case config.S3Bucket != "":
+		if config.S3Endpoint == "" {
+			return nil, errorx.IllegalArgument.New("invalid configuration: columnar sinks with an s3_bucket require an s3_endpoint")
+		}
+		store = &columnar.S3Store{
+			Endpoint:        config.S3Endpoint,
+			Region:          config.S3Region,
+			Bucket:          config.S3Bucket,
+			Prefix:          config.S3Prefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	case config.Dir != "":
+		store, err = columnar.NewDirStore(config.Dir)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errorx.IllegalArgument.New("invalid configuration: columnar sinks require a dir or an s3_bucket")
+	}
+	sink := columnar.NewSink(store)
+	sink.PartitionField = config.PartitionField
+	for _, name := range config.Formats {
+		format, err := columnar.ParseFormat(name)
+		if err != nil {
+			return nil, err
+		}
+		sink.Formats = append(sink.Formats, format)
+	}
+	return sink.Callback(persistenceKey), nil
+}
+
+// jetStreamSinkConfig is the options of a jetstream sink
+type jetStreamSinkConfig struct {
+	URL     string `mapstructure:"url"`
+	Subject string `mapstructure:"subject"`
+	// Credentials is the path of a nats credentials file
+	Credentials string `mapstructure:"credentials"`
+}
+
+// newJetStreamSink publishes records to a NATS JetStream stream, see
+// broker.JetStreamPublisher
+func newJetStreamSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	config := jetStreamSinkConfig{}
+	err := decodeSinkOptions(options, &config)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid jetstream sink options")
+	}
+	if config.Subject == "" {
+		return nil, errorx.IllegalArgument.New("invalid configuration: jetstream sinks require a subject")
+	}
+	if config.URL == "" {
+		config.URL = nats.DefaultURL
+	}
+	natsOptions := []nats.Option{nats.Name("lightning-poller")}
+	if config.Credentials != "" {
+		natsOptions = append(natsOptions, nats.UserCredentials(config.Credentials))
+	}
+	conn, err := nats.Connect(config.URL, natsOptions...)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error connecting to nats")
+	}
+	jetStream, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, errorx.Decorate(err, "error connecting to jetstream")
+	}
+	sinkClosers = append(sinkClosers, closerFunc(conn.Close))
+	return broker.NewSink(broker.NewJetStreamPublisher(jetStream, config.Subject)).Callback(persistenceKey), nil
+}
+
+// kafkaSinkConfig is the options of a kafka sink
+type kafkaSinkConfig struct {
+	Brokers []string `mapstructure:"brokers"`
+	Topic   string   `mapstructure:"topic"`
+}
+
+// newKafkaSink writes records to a kafka topic, see broker.KafkaPublisher
+func newKafkaSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	config := kafkaSinkConfig{}
+	err := decodeSinkOptions(options, &config)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid kafka sink options")
+	}
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, errorx.IllegalArgument.New("invalid configuration: kafka sinks require brokers and a topic")
+	}
+	publisher, writer := broker.NewKafkaPublisher(config.Brokers, config.Topic)
+	sinkClosers = append(sinkClosers, writer)
+	return broker.NewSink(publisher).Callback(persistenceKey), nil
+}
+
+// defaultStreamRetention is how long the change log keeps records when
+// LP_STREAM_RETENTION isn't set
+const defaultStreamRetention = 7 * 24 * time.Hour
+
+// changeLog retains the records of queries with stream sinks, it's opened by
+// the first stream sink
+var changeLog *stream.ChangeLog
+
+// newStreamSink retains records in the change log at LP_STREAM_LOG_PATH, for
+// the stream server to stream to consumers, see stream.ChangeLog
+func newStreamSink(persistenceKey string, options map[string]interface{}) (callback, error) {
+	err := decodeSinkOptions(options, &struct{}{})
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid stream sink options")
+	}
+	if changeLog == nil {
+		path := viper.GetString("stream_log_path")
+		if path == "" {
+			return nil, errorx.IllegalArgument.New("invalid configuration: stream sinks require LP_STREAM_LOG_PATH")
+		}
+		retention := defaultStreamRetention
+		if viper.IsSet("stream_retention") {
+			retention = viper.GetDuration("stream_retention")
+		}
+		changeLog, err = stream.OpenChangeLog(path, retention)
+		if err != nil {
+			return nil, err
+		}
+		sinkClosers = append(sinkClosers, changeLog)
+	}
+	return changeLog.Callback(persistenceKey), nil
+}
+
+// decodeSinkOptions decodes a sink's options into config, rejecting unknown
+// options
+func decodeSinkOptions(options map[string]interface{}, config interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused: true,
+		Result:      config,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(options)
+}
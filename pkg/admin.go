@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rewindRequest is the body of a rewind request. Exactly one of Duration, to
+// rewind the current position, or Timestamp, to set the position, is required
+type rewindRequest struct {
+	Duration  string     `json:"duration"`
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// AdminHandler returns an http handler for inspecting and controlling queries
+// at runtime. It serves:
+//
+//	GET  /queries               state of every query
+//	GET  /queries/{key}         state of a single query
+//	POST /queries/{key}/pause   stop polling a query
+//	POST /queries/{key}/resume  resume polling a paused query
+//	POST /queries/{key}/poll    poll a query immediately
+//	POST /queries/{key}/rewind  rewind a query, with a body of {"duration": "2h"} or {"timestamp": "2024-01-01T00:00:00Z"}
+//
+// Set LP_ADMIN_ADDRESS to serve it from Run(), or mount it on your own server
+func (p *LightningPoller) AdminHandler() http.Handler {
+	return http.HandlerFunc(p.serveAdminHTTP)
+}
+
+// serveAdmin serves the admin handler on address, along with the health
+// handlers and prometheus metrics on /metrics if they're enabled
+func (p *LightningPoller) serveAdmin(address string) {
+	p.logger.WithFields(logrus.Fields{"address": address}).Info("serving admin api")
+	mux := http.NewServeMux()
+	mux.Handle("/", p.AdminHandler())
+	p.registerHealthHandlers(mux)
+	if p.config.MetricsEnabled {
+		mux.Handle("/metrics", p.MetricsHandler())
+	}
+	err := http.ListenAndServe(address, mux)
+	p.logger.WithFields(logrus.Fields{"address": address}).WithError(err).Error("admin api stopped")
+}
+
+func (p *LightningPoller) serveAdminHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "queries" || len(parts) > 3 {
+		p.writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch len(parts) {
+	case 1:
+		if !p.requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		p.writeAdminJSON(w, http.StatusOK, p.QueryStates())
+	case 2:
+		if !p.requireMethod(w, r, http.MethodGet) {
+			return
+		}
+		state, err := p.QueryState(parts[1])
+		if err != nil {
+			p.writeAdminControlError(w, err)
+			return
+		}
+		p.writeAdminJSON(w, http.StatusOK, state)
+	case 3:
+		if !p.requireMethod(w, r, http.MethodPost) {
+			return
+		}
+		p.serveAdminAction(w, r, parts[1], parts[2])
+	}
+}
+
+func (p *LightningPoller) serveAdminAction(w http.ResponseWriter, r *http.Request, key, action string) {
+	var err error
+	switch action {
+	case "pause":
+		err = p.Pause(key)
+	case "resume":
+		err = p.Resume(key)
+	case "poll":
+		err = p.PollNow(key)
+	case "rewind":
+		err = p.rewindFromRequest(r, key)
+	default:
+		p.writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if err != nil {
+		p.writeAdminControlError(w, err)
+		return
+	}
+	p.queryLogger(key).WithFields(logrus.Fields{"action": action}).Info("admin action")
+	state, err := p.QueryState(key)
+	if err != nil {
+		p.writeAdminControlError(w, err)
+		return
+	}
+	p.writeAdminJSON(w, http.StatusOK, state)
+}
+
+func (p *LightningPoller) rewindFromRequest(r *http.Request, key string) error {
+	request := rewindRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return errBadRequest{err: err}
+	}
+	if (request.Duration == "") == (request.Timestamp == nil) {
+		return errBadRequest{err: errors.New("exactly one of duration or timestamp is required")}
+	}
+	if request.Timestamp != nil {
+		return p.SetPosition(key, NewPositionAt(*request.Timestamp))
+	}
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil {
+		return errBadRequest{err: err}
+	}
+	return p.RewindPosition(key, duration)
+}
+
+type errBadRequest struct {
+	err error
+}
+
+func (e errBadRequest) Error() string {
+	return e.err.Error()
+}
+
+func (p *LightningPoller) requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		p.writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return false
+	}
+	return true
+}
+
+// writeAdminControlError maps errors from controlling queries to status codes
+func (p *LightningPoller) writeAdminControlError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrUnknownPersistenceKey):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrQueryInProgress), errors.Is(err, ErrPositionsNotLoaded), errors.Is(err, ErrQueryNotAssigned):
+		status = http.StatusConflict
+	case errors.As(err, &errBadRequest{}):
+		status = http.StatusBadRequest
+	}
+	p.writeAdminError(w, status, err)
+}
+
+func (p *LightningPoller) writeAdminError(w http.ResponseWriter, status int, err error) {
+	p.writeAdminJSON(w, status, adminError{Error: err.Error()})
+}
+
+func (p *LightningPoller) writeAdminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		p.logger.WithError(err).Debug("error writing admin response")
+	}
+}
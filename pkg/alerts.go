@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+// AlertKind is the condition that an alert is about
+type AlertKind string
+
+const (
+	// AlertKindStalled fires when a query's position hasn't advanced, and the
+	// query hasn't caught up, for longer than its stall threshold
+	AlertKindStalled AlertKind = "stalled"
+	// AlertKindLagging fires when a query is further behind salesforce than
+	// its lag threshold
+	AlertKindLagging AlertKind = "lagging"
+)
+
+// Alert is fired by the watchdog when a threshold is crossed, and again with
+// Recovered set when the query recovers
+type Alert struct {
+	PersistenceKey string    `json:"persistence_key"`
+	Kind           AlertKind `json:"kind"`
+	Recovered      bool      `json:"recovered"`
+	Message        string    `json:"message"`
+	// SinceProgress is how long it's been since the query's position advanced
+	// or it caught up
+	SinceProgress    time.Duration `json:"since_progress"`
+	Lag              time.Duration `json:"lag"`
+	Threshold        time.Duration `json:"threshold"`
+	LastModifiedDate *time.Time    `json:"last_modified_date,omitempty"`
+	LastError        string        `json:"last_error,omitempty"`
+	Time             time.Time     `json:"time"`
+}
+
+// AlertHandler is notified by the watchdog when a query stalls or lags, and
+// when it recovers
+type AlertHandler interface {
+	HandleAlert(ctx context.Context, alert Alert) error
+}
+
+// AlertHandlerFunc adapts a function to an AlertHandler
+type AlertHandlerFunc func(ctx context.Context, alert Alert) error
+
+func (f AlertHandlerFunc) HandleAlert(ctx context.Context, alert Alert) error {
+	return f(ctx, alert)
+}
+
+// LogAlertHandler logs alerts, at the warn level when they fire and the info
+// level when they recover. It's the default alert handler
+type LogAlertHandler struct {
+	// Logger defaults to the app-utils-go logrus logger
+	Logger Logger
+}
+
+func (h LogAlertHandler) HandleAlert(ctx context.Context, alert Alert) error {
+	logger := h.Logger
+	if logger == nil {
+		logger = defaultLogger()
+	}
+	entry := logger.WithFields(logrus.Fields{
+		"persistence_key": alert.PersistenceKey,
+		"kind":            alert.Kind,
+		"since_progress":  alert.SinceProgress,
+		"lag":             alert.Lag,
+		"threshold":       alert.Threshold,
+	})
+	if alert.Recovered {
+		entry.Info(alert.Message)
+	} else {
+		entry.Warn(alert.Message)
+	}
+	return nil
+}
+
+// WebhookAlertHandler posts alerts as json to a url
+type WebhookAlertHandler struct {
+	URL string
+	// Headers are added to every request, for example for authorization
+	Headers map[string]string
+	// Client defaults to a client with a 10 second timeout
+	Client *http.Client
+}
+
+var defaultWebhookAlertClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h *WebhookAlertHandler) HandleAlert(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range h.Headers {
+		request.Header.Set(name, value)
+	}
+	client := h.Client
+	if client == nil {
+		client = defaultWebhookAlertClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errorx.ExternalError.New("alert webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// MultiAlertHandler sends alerts to every handler, returning the errors of
+// any that fail
+type MultiAlertHandler []AlertHandler
+
+func (m MultiAlertHandler) HandleAlert(ctx context.Context, alert Alert) error {
+	errs := []error{}
+	for _, handler := range m {
+		err := handler.HandleAlert(ctx, alert)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errorx.DecorateMany(fmt.Sprintf("error handling %s alert for %s", alert.Kind, alert.PersistenceKey), errs...)
+	}
+	return nil
+}
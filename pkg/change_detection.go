@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// changesPath is where records of queries with watched fields carry the
+// changes of their watched fields. It's under attributes, so sinks that skip
+// attributes don't store it as a field
+const changesPath = "attributes.changes"
+
+// FieldChange is the value of a watched field before and after a record
+// changed, found in the record's attributes.changes by field. Before is null
+// the first time a record is delivered
+type FieldChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// detectChanges removes the records whose watched fields haven't changed since
+// they were last delivered, and sets attributes.changes of the rest to the
+// watched fields that changed. It returns the snapshots to save once the
+// records have been delivered
+func (p *LightningPoller) detectChanges(queryWithCallback QueryWithCallback, recordsJSON []byte) (changedJSON []byte, snapshots map[string]Snapshot, err error) {
+	key := queryWithCallback.PersistenceKey
+	records := gjson.ParseBytes(recordsJSON).Array()
+	ids := make([]string, 0, len(records))
+	for _, record := range records {
+		ids = append(ids, record.Get("Id").String())
+	}
+	store, err := p.snapshotStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	previous, err := store.Get(key, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshots = map[string]Snapshot{}
+	changed := [][]byte{}
+	for _, record := range records {
+		id := record.Get("Id").String()
+		snapshot := snapshotOf(record, queryWithCallback.WatchFields)
+		// a record can be in a page more than once, compare with its latest
+		// state
+		before, seen := snapshots[id]
+		if !seen {
+			before, seen = previous[id]
+		}
+		if seen && before.Hash == snapshot.Hash {
+			continue
+		}
+		changes := map[string]FieldChange{}
+		for _, field := range queryWithCallback.WatchFields {
+			if !seen || !bytes.Equal(before.Fields[field], snapshot.Fields[field]) {
+				changes[field] = FieldChange{Before: before.Fields[field], After: snapshot.Fields[field]}
+			}
+		}
+		changesJSON, err := json.Marshal(changes)
+		if err != nil {
+			return nil, nil, err
+		}
+		recordJSON, err := sjson.SetRawBytes([]byte(record.Raw), changesPath, changesJSON)
+		if err != nil {
+			return nil, nil, errorx.Decorate(err, "error setting changes of record %s", id)
+		}
+		changed = append(changed, recordJSON)
+		if id != "" {
+			snapshots[id] = snapshot
+		}
+	}
+	suppressed := len(records) - len(changed)
+	p.metrics.recordsSuppressed.WithLabelValues(key, queryWithCallback.Org).Add(float64(suppressed))
+	p.queryLogger(key).WithFields(logrus.Fields{
+		"new_records_total":        len(records),
+		"suppressed_records_total": suppressed,
+	}).Debug("removed records with unchanged watched fields")
+	changedJSON = append([]byte("["), bytes.Join(changed, []byte(","))...)
+	return append(changedJSON, ']'), snapshots, nil
+}
+
+// saveSnapshots saves the snapshots of delivered records
+func (p *LightningPoller) saveSnapshots(key string, snapshots map[string]Snapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	store, err := p.snapshotStore()
+	if err != nil {
+		return err
+	}
+	err = store.Set(key, snapshots)
+	if err != nil {
+		return errorx.Decorate(err, "error saving snapshots")
+	}
+	return nil
+}
+
+// snapshotOf returns the snapshot of a record's watched fields, missing fields
+// are null. Deleted records hash differently, so deleting or undeleting a
+// record is delivered even when its watched fields didn't change. IsDeleted
+// is only hashed when it's true, so snapshots of records that aren't deleted
+// keep their hash
+func snapshotOf(record gjson.Result, watchFields []string) Snapshot {
+	snapshot := Snapshot{Fields: map[string]json.RawMessage{}}
+	hash := sha256.New()
+	for _, field := range watchFields {
+		value := json.RawMessage("null")
+		if result := record.Get(field); result.Exists() {
+			value = json.RawMessage(result.Raw)
+		}
+		snapshot.Fields[field] = value
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+		hash.Write(value)
+		hash.Write([]byte{0})
+	}
+	if record.Get("IsDeleted").Bool() {
+		hash.Write([]byte("IsDeleted\x00true\x00"))
+	}
+	snapshot.Hash = hex.EncodeToString(hash.Sum(nil))
+	return snapshot
+}
+
+// snapshotStore returns the snapshot store, opening the badger store at
+// SnapshotPath the first time it's needed, so pollers without WatchFields
+// never create or lock it
+func (p *LightningPoller) snapshotStore() (SnapshotStore, error) {
+	p.snapshotsMu.Lock()
+	defer p.snapshotsMu.Unlock()
+	if p.snapshots != nil {
+		return p.snapshots, nil
+	}
+	if p.config.SnapshotPath == "" {
+		return nil, errorx.IllegalState.New("no snapshot store is configured")
+	}
+	store, err := OpenBadgerSnapshotStore(p.config.SnapshotPath)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error opening snapshot store")
+	}
+	p.snapshots = store
+	return store, nil
+}
+
+func (p *LightningPoller) closeSnapshotStore() {
+	p.snapshotsMu.Lock()
+	defer p.snapshotsMu.Unlock()
+	if p.snapshots == nil || !p.ownsSnapshots {
+		return
+	}
+	err := p.snapshots.Close()
+	p.logOnErr("error closing snapshot store", err)
+	p.snapshots = nil
+}
@@ -0,0 +1,96 @@
+package pkg_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/tidwall/gjson"
+)
+
+func TestWatchFieldsDeliverDeletesAndUndeletes(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account",
+		pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme", "IsDeleted": false},
+		pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate, "Name": "Beta", "IsDeleted": false})
+	snapshots, err := lp.OpenBadgerSnapshotStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshots.Close()
+	delivered := []string{}
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, IsDeleted, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			for _, record := range gjson.ParseBytes(result).Array() {
+				delivered = append(delivered, record.Get("Id").String()+":"+record.Get("IsDeleted").String())
+			}
+			return true
+		},
+		WatchFields: []string{"Name"},
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithSnapshotStore(snapshots), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(want ...string) {
+		t.Helper()
+		delivered = []string{}
+		_, err := poller.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(delivered) != len(want) {
+			t.Fatalf("expected %v delivered, got %v", want, delivered)
+		}
+		for i := range want {
+			if delivered[i] != want[i] {
+				t.Fatalf("expected %v delivered, got %v", want, delivered)
+			}
+		}
+	}
+	run("001A:false", "001B:false")
+	// deleting a record doesn't change its watched fields
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate.Add(time.Minute), "Name": "Acme", "IsDeleted": true})
+	run("001A:true")
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate.Add(2 * time.Minute), "Name": "Acme", "IsDeleted": false})
+	run("001A:false")
+}
+
+func TestSnapshotStoreIsOnlyOpenedByQueriesWithWatchFields(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond), "Name": "Acme"})
+	t.Setenv("HOME", t.TempDir())
+	for _, watchFields := range [][]string{nil, {"Name"}} {
+		path := filepath.Join(t.TempDir(), "snapshots")
+		t.Setenv("LP_SNAPSHOT_PATH", path)
+		query := lp.QueryWithCallback{
+			PersistenceKey: "Accounts",
+			Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+			Callback:       func(result []byte, err error) bool { return true },
+			WatchFields:    watchFields,
+		}
+		poller, err := lp.New(lp.WithEnvConfig(), lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithLastModifiedDateCorrection(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err = poller.RunOnce(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(path)
+		if created := err == nil; created != (len(watchFields) > 0) {
+			t.Fatalf("expected the snapshot store to be created only for watched fields, watching %v created it: %v", watchFields, created)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+	"github.com/go-playground/validator/v10"
+	"github.com/joomcode/errorx"
+	"github.com/samber/lo"
+	"github.com/spf13/viper"
+)
+
+// DefaultRunConfig returns the settings that New starts from
+func DefaultRunConfig() *RunConfig {
+	return &RunConfig{
+		StartupPositionOverrides:           map[string]time.Time{},
+		PollInterval:                       10 * time.Second,
+		PersistencePath:                    ".",
+		LastModifiedDateCorrectionDuration: 5 * time.Minute,
+		HealthMaxConsecutiveFailures:       5,
+		WatchdogInterval:                   time.Minute,
+		WatchConfig:                        true,
+		ReauthMaxAttempts:                  3,
+		ReauthBackoff:                      time.Second,
+	}
+}
+
+// WithConfigFile makes WithEnvConfig read path instead of
+// ~/.salesforce-lightning-poller.yaml, so it must come before WithEnvConfig.
+// The file must exist. An empty path keeps the default
+func WithConfigFile(path string) Option {
+	return func(p *LightningPoller) error {
+		p.configFile = path
+		return nil
+	}
+}
+
+// WithEnvConfig configures the poller from LP_ prefixed environment variables
+// and the config file given with WithConfigFile, or
+// ~/.salesforce-lightning-poller.yaml if it exists. Settings that aren't set
+// keep their defaults. The salesforce config is read from the same settings,
+// query overrides from the query_overrides section of the file, and named orgs
+// from the orgs section. Setting LP_LEASE_DIR enables leader election with a
+// FileLeaser. It uses its own viper instance, so it doesn't change the global
+// one
+func WithEnvConfig() Option {
+	return func(p *LightningPoller) error {
+		v, err := newEnvViper(p.config, p.configFile)
+		if err != nil {
+			return err
+		}
+		p.configFileUsed = v.ConfigFileUsed()
+		startupPositionOverrides, err := stringToTimeMap(v.GetString("startup_position_overrides"))
+		if err != nil {
+			return errorx.Decorate(err, "error initializing config, unable to parse startup_position_override")
+		}
+		p.config.StartupPositionOverrides = startupPositionOverrides
+		p.config.PollInterval = v.GetDuration("poll_interval")
+		p.config.PersistenceEnabled = v.GetBool("persistence_enabled")
+		p.config.PersistencePath = v.GetString("persistence_path")
+		p.config.LastModifiedDateCorrectionDuration = v.GetDuration("last_modified_date_correction_duration")
+		p.config.SkipDependencyCheck = v.GetBool("skip_dependency_check")
+		p.config.AdminAddress = v.GetString("admin_address")
+		p.config.MetricsEnabled = v.GetBool("metrics_enabled")
+		p.config.HealthAddress = v.GetString("health_address")
+		p.config.HealthMaxConsecutiveFailures = v.GetInt("health_max_consecutive_failures")
+		p.config.HealthMaxLag = v.GetDuration("health_max_lag")
+		p.config.StallThreshold = v.GetDuration("stall_threshold")
+		p.config.LagAlertThreshold = v.GetDuration("lag_alert_threshold")
+		p.config.WatchdogInterval = v.GetDuration("watchdog_interval")
+		p.config.AlertWebhookURL = v.GetString("alert_webhook_url")
+		p.config.WatchConfig = v.GetBool("watch_config")
+		p.config.ReauthMaxAttempts = v.GetInt("reauth_max_attempts")
+		p.config.ReauthBackoff = v.GetDuration("reauth_backoff")
+		p.config.SnapshotPath = v.GetString("snapshot_path")
+		p.queryOverrides, err = queryOverridesFromViper(v)
+		if err != nil {
+			return err
+		}
+		orgs, err := orgsFromViper(v)
+		if err != nil {
+			return err
+		}
+		for _, org := range orgs {
+			authConfig, err := authConfigFromSettings(org.salesforceConfig(), org.PrivateKeyFile, org.JWTAudience, org.TokenLifetime, org.TokenRefreshBefore)
+			if err != nil {
+				return errorx.Decorate(err, "invalid configuration for org %s", org.Name)
+			}
+			if authConfig != nil {
+				err = WithOrgAuthConfig(org.Name, *authConfig)(p)
+			} else {
+				err = WithOrg(org.Name, org.salesforceConfig())(p)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if leaseDir := v.GetString("lease_dir"); leaseDir != "" {
+			leaser, err := NewFileLeaser(leaseDir)
+			if err != nil {
+				return err
+			}
+			err = WithLeases(LeaseConfig{
+				Leaser: leaser,
+				Scope:  LeaseScope(v.GetString("lease_scope")),
+				Name:   v.GetString("lease_name"),
+				Holder: v.GetString("lease_holder"),
+				TTL:    v.GetDuration("lease_ttl"),
+			})(p)
+			if err != nil {
+				return err
+			}
+		}
+		p.sfConfig = &pkg.Config{
+			Domain:       v.GetString("domain"),
+			ClientId:     v.GetString("client_id"),
+			ClientSecret: v.GetString("client_secret"),
+			Username:     v.GetString("username"),
+			Password:     v.GetString("password"),
+			GrantType:    v.GetString("grant_type"),
+			ApiVersion:   v.GetString("api_version"),
+		}
+		p.authConfig, err = authConfigFromSettings(*p.sfConfig, v.GetString("private_key_file"), v.GetString("jwt_audience"), v.GetDuration("token_lifetime"), v.GetDuration("token_refresh_before"))
+		return err
+	}
+}
+
+// newEnvViper reads the config file and environment variables into a new
+// viper instance, with defaults from the poller's current config. The default
+// config file is searched for when configFile is empty
+func newEnvViper(defaults *RunConfig, configFile string) (*viper.Viper, error) {
+	v := viper.New()
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		// search config in home directory with name ".salesforce-lightning-poller" (without extension).
+		v.AddConfigPath(home)
+		v.SetConfigType("yaml")
+		v.SetConfigName(".salesforce-lightning-poller")
+	}
+	err := v.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if err != nil && !(configFile == "" && errors.As(err, &notFound)) {
+		return nil, errorx.Decorate(err, "error reading config file")
+	}
+	v.SetEnvPrefix("LP")
+	v.AutomaticEnv() // read in environment variables that match
+	v.SetDefault("grant_type", "password")
+	v.SetDefault("api_version", "54.0")
+	v.SetDefault("poll_interval", defaults.PollInterval)
+	v.SetDefault("last_modified_date_correction_duration", defaults.LastModifiedDateCorrectionDuration)
+	v.SetDefault("persistence_enabled", defaults.PersistenceEnabled)
+	v.SetDefault("skip_dependency_check", defaults.SkipDependencyCheck)
+	v.SetDefault("persistence_path", defaults.PersistencePath)
+	v.SetDefault("startup_position_overrides", "")
+	v.SetDefault("admin_address", defaults.AdminAddress)
+	v.SetDefault("metrics_enabled", defaults.MetricsEnabled)
+	v.SetDefault("health_address", defaults.HealthAddress)
+	v.SetDefault("health_max_consecutive_failures", defaults.HealthMaxConsecutiveFailures)
+	v.SetDefault("health_max_lag", defaults.HealthMaxLag)
+	v.SetDefault("stall_threshold", defaults.StallThreshold)
+	v.SetDefault("lag_alert_threshold", defaults.LagAlertThreshold)
+	v.SetDefault("watchdog_interval", defaults.WatchdogInterval)
+	v.SetDefault("alert_webhook_url", defaults.AlertWebhookURL)
+	v.SetDefault("watch_config", defaults.WatchConfig)
+	v.SetDefault("reauth_max_attempts", defaults.ReauthMaxAttempts)
+	v.SetDefault("reauth_backoff", defaults.ReauthBackoff)
+	v.SetDefault("snapshot_path", defaults.SnapshotPath)
+	return v, nil
+}
+
+// validateRunConfig checks that the config has everything it needs
+func validateRunConfig(config *RunConfig) error {
+	errs := []error{}
+	theValidator := validator.New()
+	err := theValidator.Struct(config)
+	if err != nil {
+		for _, err := range err.(validator.ValidationErrors) {
+			errs = append(errs, errorx.IllegalArgument.New("invalid configuration: %s is a required configuration", err.Field()))
+		}
+	}
+	if config.Ticker == nil && config.PollInterval <= 0 {
+		errs = append(errs, errorx.IllegalArgument.New("invalid configuration: PollInterval must be positive"))
+	}
+	if config.ReauthMaxAttempts < 1 || config.ReauthBackoff < 0 {
+		errs = append(errs, errorx.IllegalArgument.New("invalid configuration: ReauthMaxAttempts must be at least 1 and ReauthBackoff can't be negative"))
+	}
+	if len(errs) > 0 {
+		return errorx.DecorateMany("error initializing config", errs...)
+	}
+	return nil
+}
+
+func getStartupPositionOverridesFromTimeIgnoringHistory(queries []QueryWithCallback, startFrom time.Time, exclusions []string) map[string]time.Time {
+	overrides := make(map[string]time.Time)
+	for _, query := range queries {
+		key := query.PersistenceKey
+		if lo.Contains(exclusions, key) {
+			// skip any persistence keys that are excluded
+			continue
+		}
+		overrides[query.PersistenceKey] = startFrom
+	}
+	return overrides
+}
+
+func stringToTimeMap(i string) (o map[string]time.Time, err error) {
+	o = map[string]time.Time{}
+	if i != "" {
+		stringArray := strings.Split(i, ",")
+		for _, s := range stringArray {
+			kvp := strings.Split(s, "=")
+			if len(kvp) != 2 {
+				return nil, errorx.IllegalArgument.New("string map invalid format")
+			}
+			o[kvp[0]], err = time.Parse(time.RFC3339, kvp[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return o, nil
+}
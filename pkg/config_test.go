@@ -0,0 +1,36 @@
+package pkg_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+func TestWithConfigFileReadsTheGivenFile(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "poller.yaml")
+	err := os.WriteFile(path, []byte("query_overrides:\n  - persistence_key: Accounts\n    paused: true\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	poller, err := lp.New(lp.WithConfigFile(path), lp.WithEnvConfig(), lp.WithSalesforceClient(server.Client()), lp.WithQueries(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !poller.QueryOverrides()["Accounts"].Paused {
+		t.Fatalf("expected the overrides from %s, got %v", path, poller.QueryOverrides())
+	}
+	_, err = lp.New(lp.WithConfigFile(filepath.Join(t.TempDir(), "missing.yaml")), lp.WithEnvConfig(), lp.WithSalesforceClient(server.Client()), lp.WithQueries(query))
+	if err == nil {
+		t.Fatal("expected a config file that doesn't exist to fail")
+	}
+}
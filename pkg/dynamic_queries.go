@@ -0,0 +1,258 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrDuplicatePersistenceKey is returned when a query is added with a
+	// persistence key that's already in use
+	ErrDuplicatePersistenceKey = errors.New("persistence key already exists")
+	// ErrQueryHasDependents is returned when a query is removed while other
+	// queries depend on it
+	ErrQueryHasDependents = errors.New("other queries depend on this query")
+)
+
+// queries returns a snapshot of the configured queries, which is safe to
+// iterate while queries are added and removed
+func (p *LightningPoller) queries() []QueryWithCallback {
+	p.queriesMu.Lock()
+	defer p.queriesMu.Unlock()
+	queries := make([]QueryWithCallback, len(p.config.Queries))
+	copy(queries, p.config.Queries)
+	return queries
+}
+
+// AddQuery adds a query while the poller is running, or before it's started.
+// If positions are already loaded, the query's position is loaded from the
+// position store, or starts from the beginning. It's polled from the next
+// tick
+func (p *LightningPoller) AddQuery(query QueryWithCallback) error {
+	query = namespaceQuery(query)
+	err := p.validateQuery(query)
+	if err != nil {
+		return err
+	}
+	key := query.PersistenceKey
+	p.queriesMu.Lock()
+	for _, existing := range p.config.Queries {
+		if existing.PersistenceKey == key {
+			p.queriesMu.Unlock()
+			return ErrDuplicatePersistenceKey
+		}
+	}
+	err = p.validateDependencies(query)
+	if err != nil {
+		p.queriesMu.Unlock()
+		return err
+	}
+	p.config.Queries = append(p.config.Queries, query)
+	p.queriesMu.Unlock()
+	// add the key as in progress until its position is loaded, so that it
+	// can't be polled before then
+	p.inProgressQueriesMu.Lock()
+	p.inProgressQueries[key] = true
+	p.inProgressQueriesMu.Unlock()
+	p.upToDateQueriesMu.Lock()
+	p.upToDateQueries[key] = false
+	p.upToDateQueriesMu.Unlock()
+	p.queryStatsMu.Lock()
+	p.queryStats[key] = &QueryStats{}
+	p.queryStatsMu.Unlock()
+	// positions that haven't been loaded yet are loaded with the other
+	// queries when the poller starts
+	p.positionsMu.Lock()
+	positionsLoaded := p.positions != nil
+	p.positionsMu.Unlock()
+	if positionsLoaded {
+		err = p.loadPosition(query)
+		if err != nil {
+			p.removeQuery(key)
+			return errorx.Decorate(err, "error loading position for %s", key)
+		}
+	}
+	if override := p.getQueryOverride(key); override.Paused {
+		p.pausedQueriesMu.Lock()
+		p.pausedQueries[key] = true
+		p.pausedQueriesMu.Unlock()
+	}
+	p.unlockInProgressQuery(query)
+	p.queryLogger(key).Info("added query")
+	return nil
+}
+
+// RemoveQuery stops polling the query with the given persistence key and
+// forgets its state. If purgePosition is true its persisted position is
+// deleted, otherwise it's kept so that the query resumes from it if it's
+// added again. It returns ErrQueryInProgress if the query is currently
+// polling, pause it first to avoid that. If purging fails the query is still
+// removed, with whatever wasn't purged kept as if purgePosition was false
+func (p *LightningPoller) RemoveQuery(key string, purgePosition bool) error {
+	query, ok := p.getQuery(key)
+	if !ok {
+		return ErrUnknownPersistenceKey
+	}
+	if purgePosition && p.config.PersistenceEnabled && p.store == nil {
+		return errorx.IllegalState.New("can't purge the position of %s, the position store isn't open", key)
+	}
+	if p.checkInProgressAndLock(query) {
+		return ErrQueryInProgress
+	}
+	// dependents are checked under the same lock that removes the query, so
+	// that a dependent can't be added in between
+	p.queriesMu.Lock()
+	if !p.config.SkipDependencyCheck {
+		dependents := p.dependents(key)
+		if len(dependents) > 0 {
+			p.queriesMu.Unlock()
+			p.unlockInProgressQuery(query)
+			return fmt.Errorf("%w: %v", ErrQueryHasDependents, dependents)
+		}
+	}
+	p.deleteQuery(key)
+	p.queriesMu.Unlock()
+	// the query stays locked as in progress until it's removed from the
+	// tracking maps, after which polls treat it as in progress
+	defer p.removeQuery(key)
+	if purgePosition && p.config.PersistenceEnabled {
+		err := p.store.Delete(key)
+		if err != nil {
+			return fmt.Errorf("removed %s, but failed deleting its position: %w", key, err)
+		}
+	}
+	if purgePosition && len(query.WatchFields) > 0 {
+		snapshots, err := p.snapshotStore()
+		if err == nil {
+			err = snapshots.Delete(key)
+		}
+		if err != nil {
+			return fmt.Errorf("removed %s, but failed deleting its snapshots: %w", key, err)
+		}
+	}
+	p.queryLogger(key).WithFields(logrus.Fields{"purged_position": purgePosition}).Info("removed query")
+	return nil
+}
+
+// ReplaceQuery replaces the query that has the same persistence key, keeping
+// its position and state. A poll that's in progress finishes with the old
+// query, the next poll uses the new one
+func (p *LightningPoller) ReplaceQuery(query QueryWithCallback) error {
+	query = namespaceQuery(query)
+	err := p.validateQuery(query)
+	if err != nil {
+		return err
+	}
+	p.queriesMu.Lock()
+	defer p.queriesMu.Unlock()
+	for i, existing := range p.config.Queries {
+		if existing.PersistenceKey == query.PersistenceKey {
+			err = p.validateDependencies(query)
+			if err != nil {
+				return err
+			}
+			p.config.Queries[i] = query
+			return nil
+		}
+	}
+	return ErrUnknownPersistenceKey
+}
+
+// validateQuery checks that a query added at runtime has a query, a callback
+// and an org that's configured
+func (p *LightningPoller) validateQuery(query QueryWithCallback) error {
+	if query.Query == nil {
+		return errorx.IllegalArgument.New("invalid configuration: query %s requires a Query", query.PersistenceKey)
+	}
+	err := p.validateCallbacks([]QueryWithCallback{query})
+	if err != nil {
+		return err
+	}
+	return p.validateOrg(query)
+}
+
+// validateDependencies checks that the dependencies of a query added at
+// runtime exist, and that it doesn't depend on itself through the queries it
+// replaces or joins. The caller holds queriesMu, so that the queries can't
+// change between the check and adding the query
+func (p *LightningPoller) validateDependencies(query QueryWithCallback) error {
+	if p.config.SkipDependencyCheck {
+		return nil
+	}
+	queries, replaced := make([]QueryWithCallback, len(p.config.Queries)), false
+	copy(queries, p.config.Queries)
+	for i, existing := range queries {
+		if existing.PersistenceKey == query.PersistenceKey {
+			queries[i], replaced = query, true
+		}
+	}
+	if !replaced {
+		queries = append(queries, query)
+	}
+	keys := map[string]bool{}
+	for _, existing := range queries {
+		keys[existing.PersistenceKey] = true
+	}
+	for _, dependency := range query.DependsOn {
+		if !keys[dependency] {
+			return errorx.IllegalArgument.New("invalid configuration: query %s depends on %s, which doesn't exist", query.PersistenceKey, dependency)
+		}
+	}
+	return validateDependencyCycles(queries)
+}
+
+// dependents returns the persistence keys of the queries that depend on key.
+// The caller holds queriesMu
+func (p *LightningPoller) dependents(key string) []string {
+	dependents := []string{}
+	for _, query := range p.config.Queries {
+		for _, dependency := range query.DependsOn {
+			if dependency == key {
+				dependents = append(dependents, query.PersistenceKey)
+			}
+		}
+	}
+	return dependents
+}
+
+// removeQuery removes a query and everything tracked for its persistence key
+func (p *LightningPoller) removeQuery(key string) {
+	p.queriesMu.Lock()
+	p.deleteQuery(key)
+	p.queriesMu.Unlock()
+	p.inProgressQueriesMu.Lock()
+	delete(p.inProgressQueries, key)
+	delete(p.pendingReloads, key)
+	p.inProgressQueriesMu.Unlock()
+	p.upToDateQueriesMu.Lock()
+	delete(p.upToDateQueries, key)
+	p.upToDateQueriesMu.Unlock()
+	p.queryStatsMu.Lock()
+	delete(p.queryStats, key)
+	delete(p.queryStatuses, key)
+	p.queryStatsMu.Unlock()
+	p.lastPolledMu.Lock()
+	delete(p.lastPolled, key)
+	p.lastPolledMu.Unlock()
+	p.pausedQueriesMu.Lock()
+	delete(p.pausedQueries, key)
+	p.pausedQueriesMu.Unlock()
+	p.positionsMu.Lock()
+	delete(p.positions, key)
+	p.positionsMu.Unlock()
+	p.metrics.deleteKey(key)
+}
+
+// deleteQuery deletes a query from the configured queries. The caller holds
+// queriesMu
+func (p *LightningPoller) deleteQuery(key string) {
+	for i, query := range p.config.Queries {
+		if query.PersistenceKey == key {
+			p.config.Queries = append(p.config.Queries[:i:i], p.config.Queries[i+1:]...)
+			return
+		}
+	}
+}
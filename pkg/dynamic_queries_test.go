@@ -0,0 +1,199 @@
+package pkg_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/tidwall/gjson"
+)
+
+func dependentQuery(key string, dependsOn ...string) lp.QueryWithCallback {
+	return lp.QueryWithCallback{
+		PersistenceKey: key,
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+		DependsOn:      dependsOn,
+	}
+}
+
+func TestQueriesCantDependOnThemselves(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	_, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(dependentQuery("Accounts", "Contacts"), dependentQuery("Contacts", "Accounts")))
+	if err == nil {
+		t.Fatal("expected New to reject a cycle")
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(dependentQuery("Accounts")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = poller.AddQuery(dependentQuery("Contacts", "Contacts"))
+	if err == nil {
+		t.Fatal("expected AddQuery to reject a query that depends on itself")
+	}
+	err = poller.AddQuery(dependentQuery("Contacts", "Accounts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = poller.AddQuery(dependentQuery("Opportunities", "Contacts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opportunities depends on Accounts through Contacts
+	err = poller.ReplaceQuery(dependentQuery("Accounts", "Opportunities"))
+	if err == nil {
+		t.Fatal("expected ReplaceQuery to reject a cycle through its dependents")
+	}
+	err = poller.ReplaceQuery(dependentQuery("Accounts", "Accounts"))
+	if err == nil {
+		t.Fatal("expected ReplaceQuery to reject a query that depends on itself")
+	}
+	// nothing depends on Opportunities unless the replace went through
+	err = poller.RemoveQuery("Opportunities", false)
+	if err != nil {
+		t.Fatalf("expected the rejected replacement to keep Accounts, got %v", err)
+	}
+	// without the dependency check, dependencies aren't waited on
+	_, err = lp.New(lp.WithSalesforceClient(server.Client()), lp.WithSkipDependencyCheck(), lp.WithQueries(dependentQuery("Accounts", "Accounts")))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// collectingQuery returns a query of sobject that appends the ids it delivers
+// to ids
+func collectingQuery(key, sobject string, ids *[]string) lp.QueryWithCallback {
+	return lp.QueryWithCallback{
+		PersistenceKey: key,
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM " + sobject },
+		Callback: func(result []byte, err error) bool {
+			for _, record := range gjson.ParseBytes(result).Array() {
+				*ids = append(*ids, record.Get("Id").String())
+			}
+			return true
+		},
+	}
+}
+
+// newDynamicPoller returns a poller of Accounts with a persistent position
+// store, and a function that runs it once and returns the ids delivered
+func newDynamicPoller(t *testing.T, server *pollertest.Server, ids *[]string) (*lp.LightningPoller, lp.PositionStore, func() []string) {
+	t.Helper()
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(collectingQuery("Accounts", "Account", ids)), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOnce := func() []string {
+		t.Helper()
+		*ids = nil
+		_, err := poller.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *ids
+	}
+	return poller, store, runOnce
+}
+
+func TestAddedQueriesArePolled(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate})
+	server.Put("Contact", pollertest.Record{"Id": "003A", "LastModifiedDate": lastModifiedDate})
+	ids := []string{}
+	poller, _, runOnce := newDynamicPoller(t, server, &ids)
+	if delivered := runOnce(); len(delivered) != 1 || delivered[0] != "001A" {
+		t.Fatalf("expected the account, got %v", delivered)
+	}
+	err := poller.AddQuery(collectingQuery("Contacts", "Contact", &ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered := runOnce(); len(delivered) != 1 || delivered[0] != "003A" {
+		t.Fatalf("expected the added query to deliver the contact, got %v", delivered)
+	}
+}
+
+func TestRemovedQueriesStopPollingAndPurgeTheirPosition(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate})
+	server.Put("Contact", pollertest.Record{"Id": "003A", "LastModifiedDate": lastModifiedDate})
+	ids := []string{}
+	poller, store, runOnce := newDynamicPoller(t, server, &ids)
+	err := poller.AddQuery(collectingQuery("Contacts", "Contact", &ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOnce()
+	err = poller.RemoveQuery("Contacts", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Put("Contact", pollertest.Record{"Id": "003B", "LastModifiedDate": lastModifiedDate.Add(time.Minute)})
+	if delivered := runOnce(); len(delivered) != 0 {
+		t.Fatalf("expected the removed query not to be polled, got %v", delivered)
+	}
+	// the kept position resumes the query where it was removed
+	err = poller.AddQuery(collectingQuery("Contacts", "Contact", &ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered := runOnce(); len(delivered) != 1 || delivered[0] != "003B" {
+		t.Fatalf("expected the query to resume from its kept position, got %v", delivered)
+	}
+	err = poller.RemoveQuery("Contacts", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position, err := store.Get("Contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position.LastModifiedDate != nil && !position.LastModifiedDate.IsZero() {
+		t.Fatalf("expected the position to be purged, got %v", position.LastModifiedDate)
+	}
+	err = poller.AddQuery(collectingQuery("Contacts", "Contact", &ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered := runOnce(); len(delivered) != 2 {
+		t.Fatalf("expected the query to start from the beginning after its position was purged, got %v", delivered)
+	}
+}
+
+func TestReplacedQueriesKeepTheirPosition(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate})
+	ids := []string{}
+	poller, _, runOnce := newDynamicPoller(t, server, &ids)
+	runOnce()
+	server.Put("Account", pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate.Add(time.Minute)})
+	replaced := []string{}
+	err := poller.ReplaceQuery(collectingQuery("Accounts", "Account", &replaced))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered := runOnce(); len(delivered) != 0 {
+		t.Fatalf("expected the old callback not to be called, got %v", delivered)
+	}
+	if len(replaced) != 1 || replaced[0] != "001B" {
+		t.Fatalf("expected the replacement to continue from the position, got %v", replaced)
+	}
+	err = poller.ReplaceQuery(collectingQuery("Contacts", "Contact", &replaced))
+	if err != lp.ErrUnknownPersistenceKey {
+		t.Fatalf("expected replacing an unknown key to fail, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package pkg_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/tidwall/gjson"
+)
+
+// runFaultedPoll runs a poll of Account, calling fault after the first page,
+// and returns the ids of every delivered record in delivery order
+func runFaultedPoll(t *testing.T, server *pollertest.Server, fault func(), options ...lp.Option) []string {
+	t.Helper()
+	delivered := []string{}
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			for _, record := range gjson.ParseBytes(result).Array() {
+				delivered = append(delivered, record.Get("Id").String())
+			}
+			if len(delivered) > 0 && fault != nil {
+				fault()
+				fault = nil
+			}
+			return true
+		},
+	}
+	poller, err := lp.New(append([]lp.Option{lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithLastModifiedDateCorrection(0)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivered
+}
+
+func expectDelivered(t *testing.T, delivered []string, want ...string) {
+	t.Helper()
+	sorted := append([]string{}, delivered...)
+	sort.Strings(sorted)
+	if strings.Join(sorted, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v delivered once each, got %v", want, delivered)
+	}
+}
+
+func putAccounts(server *pollertest.Server, lastModifiedDates ...time.Time) {
+	for i, lastModifiedDate := range lastModifiedDates {
+		server.Put("Account", pollertest.Record{"Id": string(rune('A'+i)) + "001", "LastModifiedDate": lastModifiedDate})
+	}
+}
+
+func TestPollRecoversFromAnExpiredSession(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.SetPageSize(1)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	putAccounts(server, start, start.Add(time.Minute), start.Add(2*time.Minute))
+	delivered := runFaultedPoll(t, server, server.ExpireSession)
+	expectDelivered(t, delivered, "A001", "B001", "C001")
+	if server.RequestCount("token") < 2 {
+		t.Fatalf("expected the poller to reauthenticate, got %d token requests", server.RequestCount("token"))
+	}
+}
+
+func TestPollRecoversFromInvalidQueryLocators(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.SetPageSize(1)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	putAccounts(server, start, start.Add(time.Minute), start.Add(2*time.Minute))
+	delivered := runFaultedPoll(t, server, server.InvalidateQueryLocators)
+	expectDelivered(t, delivered, "A001", "B001", "C001")
+}
+
+func TestPollRetriesUnavailablePages(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.SetPageSize(1)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	putAccounts(server, start, start.Add(time.Minute))
+	retry := map[string]lp.QueryOverride{"Accounts": {Retry: &lp.RetryPolicy{MaxAttempts: 3}}}
+	delivered := runFaultedPoll(t, server, func() { server.FailNext(503, 503) }, lp.WithQueryOverrides(retry))
+	expectDelivered(t, delivered, "A001", "B001")
+}
+
+func TestPollDeliversTiesOnceWhenSalesforceReordersThem(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.SetPageSize(2)
+	start := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	putAccounts(server, start, start, start, start)
+	delivered := runFaultedPoll(t, server, func() {
+		// the rest of the query is read again in the other order
+		server.ReorderTies(true)
+		server.InvalidateQueryLocators()
+	})
+	expectDelivered(t, delivered, "A001", "B001", "C001", "D001")
+}
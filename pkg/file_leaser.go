@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// staleLockAge is how old a lock file must be before it's assumed to belong to
+// a process that died while holding it
+const staleLockAge = 30 * time.Second
+
+// FileLeaser is a Leaser that keeps leases in files in a directory, for
+// replicas on one host or sharing a filesystem that supports exclusive file
+// creation
+type FileLeaser struct {
+	Dir string
+}
+
+// NewFileLeaser creates a FileLeaser, creating dir if it doesn't exist
+func NewFileLeaser(dir string) (*FileLeaser, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error creating lease directory")
+	}
+	return &FileLeaser{Dir: dir}, nil
+}
+
+func (l *FileLeaser) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (Lease, error) {
+	var lease Lease
+	err := l.withLock(ctx, name, func() error {
+		current, err := l.read(name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if current.Holder != "" && current.Holder != holder && now.Before(current.ExpiresAt) {
+			lease = current
+			return ErrLeaseHeld
+		}
+		lease = Lease{Name: name, Holder: holder, Token: current.Token, ExpiresAt: now.Add(ttl)}
+		if current.Holder != holder || current.Token == 0 {
+			lease.Token++
+		}
+		return l.write(lease)
+	})
+	return lease, err
+}
+
+func (l *FileLeaser) Release(ctx context.Context, name, holder string) error {
+	return l.withLock(ctx, name, func() error {
+		current, err := l.read(name)
+		if err != nil || current.Holder != holder {
+			return err
+		}
+		// keep the token, so the next holder's is higher
+		current.ExpiresAt = time.Time{}
+		return l.write(current)
+	})
+}
+
+// withLock runs fn while holding the lock file for name, waiting for other
+// processes to release it
+func (l *FileLeaser) withLock(ctx context.Context, name string, fn func() error) error {
+	lockPath := l.path(name) + ".lock"
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			file.Close()
+			defer os.Remove(lockPath)
+			return fn()
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return errorx.Decorate(err, "error locking lease %s", name)
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// read returns the lease on name, which is empty if it has never been
+// acquired
+func (l *FileLeaser) read(name string) (Lease, error) {
+	lease := Lease{}
+	data, err := os.ReadFile(l.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, errorx.Decorate(err, "error reading lease %s", name)
+	}
+	err = json.Unmarshal(data, &lease)
+	if err != nil {
+		return lease, errorx.Decorate(err, "error parsing lease %s", name)
+	}
+	return lease, nil
+}
+
+func (l *FileLeaser) write(lease Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(l.path(lease.Name), data)
+	if err != nil {
+		return errorx.Decorate(err, "error writing lease %s", lease.Name)
+	}
+	return nil
+}
+
+func (l *FileLeaser) path(name string) string {
+	return filepath.Join(l.Dir, url.QueryEscape(name)+".json")
+}
+
+// writeFileAtomic replaces a file by renaming a temporary file over it, so a
+// crash never leaves a partial file behind
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
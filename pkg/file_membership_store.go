@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// FileMembershipStore is a MembershipStore that keeps a file per member in a
+// directory per fleet, for replicas on one host or sharing a filesystem
+type FileMembershipStore struct {
+	Dir string
+}
+
+// membershipFile is the content of a member's file
+type membershipFile struct {
+	Member    string    `json:"member"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewFileMembershipStore creates a FileMembershipStore, creating dir if it
+// doesn't exist
+func NewFileMembershipStore(dir string) (*FileMembershipStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error creating membership directory")
+	}
+	return &FileMembershipStore{Dir: dir}, nil
+}
+
+func (s *FileMembershipStore) Heartbeat(ctx context.Context, fleet, member string, ttl time.Duration) error {
+	err := os.MkdirAll(s.fleetDir(fleet), 0o755)
+	if err != nil {
+		return errorx.Decorate(err, "error creating fleet directory")
+	}
+	data, err := json.Marshal(membershipFile{Member: member, ExpiresAt: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(s.path(fleet, member), data)
+	if err != nil {
+		return errorx.Decorate(err, "error heartbeating")
+	}
+	return nil
+}
+
+func (s *FileMembershipStore) Members(ctx context.Context, fleet string) ([]string, error) {
+	entries, err := os.ReadDir(s.fleetDir(fleet))
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "error listing members")
+	}
+	now := time.Now()
+	members := []string{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.fleetDir(fleet), entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			// the member left while listing
+			continue
+		}
+		if err != nil {
+			return nil, errorx.Decorate(err, "error reading member")
+		}
+		membership := membershipFile{}
+		err = json.Unmarshal(data, &membership)
+		if err != nil {
+			return nil, errorx.Decorate(err, "error parsing member %s", entry.Name())
+		}
+		if now.Before(membership.ExpiresAt) {
+			members = append(members, membership.Member)
+		}
+	}
+	return members, nil
+}
+
+func (s *FileMembershipStore) Leave(ctx context.Context, fleet, member string) error {
+	err := os.Remove(s.path(fleet, member))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errorx.Decorate(err, "error leaving fleet")
+	}
+	return nil
+}
+
+func (s *FileMembershipStore) fleetDir(fleet string) string {
+	return filepath.Join(s.Dir, url.QueryEscape(fleet))
+}
+
+func (s *FileMembershipStore) path(fleet, member string) string {
+	return filepath.Join(s.fleetDir(fleet), url.QueryEscape(member)+".json")
+}
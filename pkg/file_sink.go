@@ -0,0 +1,312 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// Compression is how a FileSink compresses its files
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// FileSink is a ready made callback that archives records as newline
+// delimited json, in a directory per persistence key. Files rotate by size
+// and age, and are synced to disk before the callback returns, so a saved
+// position always means the records it covers are on disk
+type FileSink struct {
+	Dir string
+	// MaxSize rotates a file once this many bytes of json have been written
+	// to it, defaults to 100MB
+	MaxSize int64
+	// MaxAge rotates a file once it has been open this long, defaults to 1h.
+	// Files are only rotated when records are written
+	MaxAge time.Duration
+	// Compression compresses files with gzip or zstd. A compressed file that
+	// was open during a crash is readable up to the last synced page, but is
+	// missing its trailer
+	Compression Compression
+	// Clock names files and tells their age, defaults to the system clock
+	Clock Clock
+	// Logger defaults to the app-utils-go logrus logger
+	Logger Logger
+
+	mu    sync.Mutex
+	files map[string]*sinkFile
+}
+
+// sinkFile is the file a FileSink is currently writing for a persistence key
+type sinkFile struct {
+	mu         sync.Mutex
+	file       *os.File
+	compressor io.WriteCloser
+	flush      func() error
+	size       int64
+	openedAt   time.Time
+}
+
+// NewFileSink creates a FileSink with the default settings, creating dir if
+// it doesn't exist
+func NewFileSink(dir string) (*FileSink, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error creating file sink directory")
+	}
+	return &FileSink{Dir: dir}, nil
+}
+
+// ParseCompression parses none, gzip or zstd
+func ParseCompression(compression string) (Compression, error) {
+	switch Compression(compression) {
+	case CompressionNone, "none":
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return Compression(compression), nil
+	}
+	return CompressionNone, errorx.IllegalArgument.New("unknown compression %s, supported compressions are none, gzip and zstd", compression)
+}
+
+// ContextCallback returns a callback for QueryWithCallback.ContextCallback that
+// archives the records of the query with the given persistence key
+func (s *FileSink) ContextCallback(persistenceKey string) func(ctx context.Context, result []byte, err error) bool {
+	return func(ctx context.Context, result []byte, err error) bool {
+		err = s.Write(persistenceKey, result)
+		if err != nil {
+			s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey, "dir": s.Dir}).WithError(err).Error("error archiving records")
+			return false
+		}
+		return true
+	}
+}
+
+// Callback returns a callback for QueryWithCallback.Callback, see
+// ContextCallback
+func (s *FileSink) Callback(persistenceKey string) func(result []byte, err error) bool {
+	callback := s.ContextCallback(persistenceKey)
+	return func(result []byte, err error) bool {
+		return callback(context.Background(), result, err)
+	}
+}
+
+// Write appends a page of records to the persistence key's current file, one
+// per line, and syncs it to disk. If that fails the file is left as it is and
+// the next write starts a new file, so a retried page isn't written after part
+// of itself
+func (s *FileSink) Write(persistenceKey string, result []byte) error {
+	file := s.file(persistenceKey)
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.file == nil || file.size >= s.maxSize() || s.clock().Now().Sub(file.openedAt) >= s.maxAge() {
+		err := s.rotate(persistenceKey, file)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	gjson.ParseBytes(result).ForEach(func(_, record gjson.Result) bool {
+		var n int
+		n, err = io.WriteString(file.compressor, record.Raw+"\n")
+		file.size += int64(n)
+		return err == nil
+	})
+	if err != nil {
+		file.discard()
+		return errorx.Decorate(err, "error writing records")
+	}
+	err = file.flush()
+	if err != nil {
+		file.discard()
+		return errorx.Decorate(err, "error flushing records")
+	}
+	err = file.file.Sync()
+	if err != nil {
+		file.discard()
+		return errorx.Decorate(err, "error syncing records")
+	}
+	return nil
+}
+
+// Close finishes every open file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errs := []error{}
+	for _, file := range s.files {
+		file.mu.Lock()
+		err := file.close()
+		file.mu.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.files = nil
+	if len(errs) > 0 {
+		return errorx.DecorateMany("error closing file sink", errs...)
+	}
+	return nil
+}
+
+func (s *FileSink) file(persistenceKey string) *sinkFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = map[string]*sinkFile{}
+	}
+	file, ok := s.files[persistenceKey]
+	if !ok {
+		file = &sinkFile{}
+		s.files[persistenceKey] = file
+	}
+	return file
+}
+
+// rotate finishes the current file, if there is one, and opens a new one
+// named after the time it was opened
+func (s *FileSink) rotate(persistenceKey string, file *sinkFile) error {
+	err := file.close()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.Dir, url.QueryEscape(persistenceKey))
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return errorx.Decorate(err, "error creating directory for %s", persistenceKey)
+	}
+	now := s.clock().Now().UTC()
+	name := now.Format("20060102T150405.000000000Z") + ".ndjson" + s.extension()
+	newFile, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errorx.Decorate(err, "error creating file for %s", persistenceKey)
+	}
+	// sync the directory, so the new file survives a crash
+	err = syncDir(dir)
+	if err != nil {
+		newFile.Close()
+		return err
+	}
+	file.file = newFile
+	file.size = 0
+	file.openedAt = now
+	switch s.Compression {
+	case CompressionGzip:
+		writer := gzip.NewWriter(newFile)
+		file.compressor, file.flush = writer, writer.Flush
+	case CompressionZstd:
+		writer, err := zstd.NewWriter(newFile)
+		if err != nil {
+			newFile.Close()
+			return err
+		}
+		file.compressor, file.flush = writer, writer.Flush
+	default:
+		file.compressor, file.flush = nopWriteCloser{newFile}, func() error { return nil }
+	}
+	s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey, "file": name}).Info("opened archive file")
+	return nil
+}
+
+func (f *sinkFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.compressor.Close()
+	if err == nil {
+		err = f.file.Sync()
+	}
+	closeErr := f.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	if err != nil {
+		return errorx.Decorate(err, "error closing archive file")
+	}
+	return nil
+}
+
+// discard closes a file that failed part way through a page without finishing
+// its compressor, whose state is unknown. Replays read a compressed file like
+// this one up to where it ends, like a file that was open during a crash
+func (f *sinkFile) discard() {
+	if f.file == nil {
+		return
+	}
+	f.file.Close()
+	f.file, f.compressor, f.flush = nil, nil, nil
+}
+
+func (s *FileSink) extension() string {
+	switch s.Compression {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+func (s *FileSink) maxSize() int64 {
+	if s.MaxSize <= 0 {
+		return 100 * 1024 * 1024
+	}
+	return s.MaxSize
+}
+
+func (s *FileSink) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return time.Hour
+	}
+	return s.MaxAge
+}
+
+func (s *FileSink) clock() Clock {
+	if s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+func (s *FileSink) logger() Logger {
+	if s.Logger == nil {
+		return defaultLogger()
+	}
+	return s.Logger
+}
+
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	err = handle.Sync()
+	if err != nil {
+		return errorx.Decorate(err, "error syncing %s", dir)
+	}
+	return nil
+}
+
+// nopWriteCloser writes to a file without closing it, the sink closes the
+// file itself
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// newClockedFileSink returns a FileSink in a temporary directory that tells
+// the time with a fake clock
+func newClockedFileSink(t *testing.T) (*FileSink, *fakeClock) {
+	t.Helper()
+	sink, err := NewFileSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	sink.Clock = clock
+	t.Cleanup(func() { sink.Close() })
+	return sink, clock
+}
+
+func TestFileSinkRotatesFilesBySize(t *testing.T) {
+	sink, clock := newClockedFileSink(t)
+	// each record is 14 bytes with its newline
+	sink.MaxSize = 28
+	for _, id := range []string{"001A", "001B", "001C"} {
+		err := sink.Write("Accounts", []byte(`[{"Id":"`+id+`"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Second)
+	}
+	files, err := archiveFiles(sink.Dir, "Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected a new file once 28 bytes were written, got %v", files)
+	}
+	if name := filepath.Base(files[0]); name != "20240102T030405.000000000Z.ndjson" {
+		t.Fatalf("expected the file to be named after the clock's time, got %s", name)
+	}
+}
+
+func TestFileSinkRotatesFilesByAge(t *testing.T) {
+	sink, clock := newClockedFileSink(t)
+	write := func(id string) {
+		t.Helper()
+		err := sink.Write("Accounts", []byte(`[{"Id":"`+id+`"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("001A")
+	clock.advance(59 * time.Minute)
+	write("001B")
+	files, err := archiveFiles(sink.Dir, "Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected the file to stay open for an hour, got %v", files)
+	}
+	clock.advance(time.Minute)
+	write("001C")
+	files, err = archiveFiles(sink.Dir, "Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected a new file once the clock passed an hour, got %v", files)
+	}
+}
+
+func TestFileSinkCompressesFiles(t *testing.T) {
+	decompressors := map[Compression]func(io.Reader) (io.Reader, error){
+		CompressionGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		CompressionZstd: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for compression, decompress := range decompressors {
+		t.Run(string(compression), func(t *testing.T) {
+			sink, _ := newClockedFileSink(t)
+			sink.Compression = compression
+			err := sink.Write("Accounts", []byte(`[{"Id":"001A"},{"Id":"001B"}]`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := archiveFiles(sink.Dir, "Accounts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || !strings.HasSuffix(files[0], ".ndjson"+sink.extension()) {
+				t.Fatalf("expected one %s file, got %v", compression, files)
+			}
+			file, err := os.Open(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			reader, err := decompress(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "{\"Id\":\"001A\"}\n{\"Id\":\"001B\"}\n" {
+				t.Fatalf("expected the records as newline delimited json, got %q", body)
+			}
+		})
+	}
+}
+
+func TestFileSinkStartsANewFileAfterAFailedWrite(t *testing.T) {
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			sink, err := NewFileSink(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Compression = compression
+			defer sink.Close()
+			err = sink.Write("Accounts", []byte(`[{"Id":"001A"}]`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the disk goes away under the open file
+			sink.file("Accounts").file.Close()
+			page := []byte(`[{"Id":"001B"},{"Id":"001C"}]`)
+			err = sink.Write("Accounts", page)
+			if err == nil {
+				t.Fatal("expected the write to the closed file to fail")
+			}
+			err = sink.Write("Accounts", page)
+			if err != nil {
+				t.Fatalf("expected the retried page to be written to a new file, got %v", err)
+			}
+			err = sink.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files, err := archiveFiles(sink.Dir, "Accounts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 2 {
+				t.Fatalf("expected 2 files, got %v", files)
+			}
+			records := []string{}
+			err = readArchiveFile(files[1], func(record []byte) error {
+				records = append(records, string(record))
+				return nil
+			}, defaultLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 2 || records[0] != `{"Id":"001B"}` || records[1] != `{"Id":"001C"}` {
+				t.Fatalf("expected the retried page in the new file, got %v", records)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// health statuses reported by the health handlers
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusDead     = "dead"
+	HealthStatusNotReady = "not_ready"
+	HealthStatusDegraded = "degraded"
+)
+
+// missedTicksBeforeDead is how many poll intervals can pass without a tick
+// before the ticker loop is considered dead
+const missedTicksBeforeDead = 3
+
+// HealthReport is the body returned by the health handlers
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck describes a single failed check. PersistenceKey is empty for
+// checks that apply to the whole poller
+type HealthCheck struct {
+	PersistenceKey string `json:"persistence_key,omitempty"`
+	Reason         string `json:"reason"`
+}
+
+// lifecycle tracks whether the poller's ticker loop is running and whether
+// positions have been loaded
+type lifecycle struct {
+	mu              sync.Mutex
+	running         bool
+	lastTick        time.Time
+	positionsLoaded bool
+}
+
+func (l *lifecycle) start(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = true
+	l.lastTick = now
+}
+
+func (l *lifecycle) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = false
+}
+
+func (l *lifecycle) tick(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastTick = now
+}
+
+func (l *lifecycle) setPositionsLoaded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.positionsLoaded = true
+}
+
+func (l *lifecycle) snapshot() (running bool, lastTick time.Time, positionsLoaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running, l.lastTick, l.positionsLoaded
+}
+
+// Liveness reports whether the poller's ticker loop is running and its
+// position store is usable
+func (p *LightningPoller) Liveness() HealthReport {
+	checks := []HealthCheck{}
+	running, lastTick, _ := p.lifecycle.snapshot()
+	if !running {
+		checks = append(checks, HealthCheck{Reason: "ticker loop is not running"})
+	} else if p.config.PollInterval > 0 && p.clock.Now().Sub(lastTick) > missedTicksBeforeDead*p.config.PollInterval {
+		checks = append(checks, HealthCheck{Reason: fmt.Sprintf("ticker loop has not ticked since %s", lastTick.UTC().Format(time.RFC3339))})
+	}
+	if store, ok := p.store.(pinger); ok {
+		if err := store.Ping(); err != nil {
+			checks = append(checks, HealthCheck{Reason: err.Error()})
+		}
+	}
+	if len(checks) > 0 {
+		return HealthReport{Status: HealthStatusDead, Checks: checks}
+	}
+	return HealthReport{Status: HealthStatusOK}
+}
+
+// Readiness reports not ready until positions are loaded, and degraded when
+// any query has failed too many polls in a row or is lagging too far behind
+// salesforce. Thresholds default to LP_HEALTH_MAX_CONSECUTIVE_FAILURES and
+// LP_HEALTH_MAX_LAG, and can be overridden per query
+func (p *LightningPoller) Readiness() HealthReport {
+	_, _, positionsLoaded := p.lifecycle.snapshot()
+	if !positionsLoaded {
+		return HealthReport{Status: HealthStatusNotReady, Checks: []HealthCheck{{Reason: "positions are not loaded"}}}
+	}
+	checks := []HealthCheck{}
+	now := p.clock.Now()
+	for _, query := range p.queries() {
+		key := query.PersistenceKey
+		if !p.assigned(key) {
+			// another replica polls it
+			continue
+		}
+		maxFailures := p.config.HealthMaxConsecutiveFailures
+		if query.MaxConsecutiveFailures > 0 {
+			maxFailures = query.MaxConsecutiveFailures
+		}
+		_, status := p.copyQueryStatus(key)
+		if maxFailures > 0 && status.consecutiveFailures >= maxFailures {
+			checks = append(checks, HealthCheck{PersistenceKey: key, Reason: fmt.Sprintf("%d consecutive polls failed, last error: %v", status.consecutiveFailures, status.lastError)})
+		}
+		maxLag := p.config.HealthMaxLag
+		if query.MaxLag > 0 {
+			maxLag = query.MaxLag
+		}
+		if lag := p.lag(key, now); maxLag > 0 && lag > maxLag {
+			checks = append(checks, HealthCheck{PersistenceKey: key, Reason: fmt.Sprintf("lag of %s exceeds %s", lag.Round(time.Second), maxLag)})
+		}
+	}
+	if len(checks) > 0 {
+		return HealthReport{Status: HealthStatusDegraded, Checks: checks}
+	}
+	return HealthReport{Status: HealthStatusOK}
+}
+
+// lag returns how far a query is behind salesforce. Queries that are caught
+// up have no lag, because their position only advances when records change
+func (p *LightningPoller) lag(key string, now time.Time) time.Duration {
+	p.upToDateQueriesMu.Lock()
+	upToDate := p.upToDateQueries[key]
+	p.upToDateQueriesMu.Unlock()
+	if upToDate {
+		return 0
+	}
+	position := p.getCurrentPosition(key)
+	if position == nil || position.LastModifiedDate == nil || position.LastModifiedDate.IsZero() {
+		return 0
+	}
+	return now.Sub(*position.LastModifiedDate)
+}
+
+// HealthzHandler serves the liveness report, responding with 503 when the
+// poller is dead
+func (p *LightningPoller) HealthzHandler() http.Handler {
+	return p.healthHandler(p.Liveness)
+}
+
+// ReadyzHandler serves the readiness report, responding with 503 when the
+// poller is not ready or degraded
+func (p *LightningPoller) ReadyzHandler() http.Handler {
+	return p.healthHandler(p.Readiness)
+}
+
+func (p *LightningPoller) healthHandler(report func() HealthReport) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthReport := report()
+		status := http.StatusOK
+		if healthReport.Status != HealthStatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		p.writeAdminJSON(w, status, healthReport)
+	})
+}
+
+// registerHealthHandlers adds the health handlers to mux
+func (p *LightningPoller) registerHealthHandlers(mux *http.ServeMux) {
+	mux.Handle("/healthz", p.HealthzHandler())
+	mux.Handle("/readyz", p.ReadyzHandler())
+}
+
+// serveHealth serves the health handlers on address
+func (p *LightningPoller) serveHealth(address string) {
+	p.logger.WithFields(logrus.Fields{"address": address}).Info("serving health checks")
+	mux := http.NewServeMux()
+	p.registerHealthHandlers(mux)
+	err := http.ListenAndServe(address, mux)
+	p.logger.WithFields(logrus.Fields{"address": address}).WithError(err).Error("health checks stopped")
+}
@@ -0,0 +1,424 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrLeaseHeld is returned by a Leaser when another holder has a lease
+	// that hasn't expired
+	ErrLeaseHeld = errors.New("lease is held by another holder")
+	// ErrLeaseLost is returned when a poll's lease or shard is lost before
+	// its position is saved
+	ErrLeaseLost = errors.New("lease was lost")
+)
+
+// Leaser grants time limited leases, so that only one replica polls at a time.
+// Implementations must be safe to use from several processes
+type Leaser interface {
+	// Acquire acquires the lease on name for holder, or renews it if holder
+	// already has it, until ttl elapses. It returns ErrLeaseHeld, along with
+	// the current lease, if another holder has a lease that hasn't expired
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (Lease, error)
+	// Release gives up the lease on name if holder has it
+	Release(ctx context.Context, name, holder string) error
+}
+
+// Lease is a lease granted by a Leaser
+type Lease struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder"`
+	// Token is a fencing token that increases every time the lease changes
+	// holder. Downstream systems can reject writes with a token lower than
+	// the highest one they've seen, from a holder that lost its lease
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LeaseScope is what a lease covers
+type LeaseScope string
+
+const (
+	// LeaseScopePoller uses a single lease for every query, so one replica
+	// polls everything
+	LeaseScopePoller LeaseScope = "poller"
+	// LeaseScopePersistenceKey uses a lease per persistence key, so queries
+	// can be spread across replicas
+	LeaseScopePersistenceKey LeaseScope = "persistence_key"
+)
+
+// LeaseConfig configures leader election
+type LeaseConfig struct {
+	Leaser Leaser
+	// Scope defaults to LeaseScopePoller
+	Scope LeaseScope
+	// Name is the name of the poller's lease, and the prefix of the names of
+	// per persistence key leases. Defaults to lightning-poller
+	Name string
+	// Holder identifies this replica, defaults to the hostname and pid
+	Holder string
+	// TTL is how long a lease lasts without being renewed, defaults to 15s
+	TTL time.Duration
+	// RenewInterval is how often leases are acquired and renewed, defaults to
+	// a third of TTL
+	RenewInterval time.Duration
+}
+
+// heldLease is a lease that this replica holds, until validUntil by the local
+// clock, which doesn't depend on the leaser's clock
+type heldLease struct {
+	lease      Lease
+	validUntil time.Time
+	// lost is closed when the lease is lost, cancelling polls that use it
+	lost chan struct{}
+}
+
+type leaseContextKey struct{}
+
+// LeaseFromContext returns the lease that a poll holds, from the context
+// given to ContextCallback. Pass its token to downstream systems to fence
+// writes from replicas that have lost their lease
+func LeaseFromContext(ctx context.Context) (Lease, bool) {
+	lease, ok := ctx.Value(leaseContextKey{}).(Lease)
+	return lease, ok
+}
+
+// FencedPositionStore is a PositionStore that keeps the lease each position
+// was saved with, and rejects positions saved with an older token of the same
+// lease. With leases, polls save positions with SetFenced, so a replica that
+// lost its lease can't overwrite a position saved by the new holder. With
+// other stores, fencing is advisory: a poll checks that it still holds its
+// lease just before saving, which a replica that stalls in between can miss
+type FencedPositionStore interface {
+	PositionStore
+	// SetFenced saves a position with lease. It returns ErrLeaseLost if the
+	// position was saved with a newer token of the same lease
+	SetFenced(ctx context.Context, key string, position Position, lease Lease) error
+}
+
+// WithLeases only polls queries while this replica holds their lease
+func WithLeases(config LeaseConfig) Option {
+	return func(p *LightningPoller) error {
+		if config.Scope == "" {
+			config.Scope = LeaseScopePoller
+		}
+		if config.Name == "" {
+			config.Name = "lightning-poller"
+		}
+		if config.Holder == "" {
+			hostname, _ := os.Hostname()
+			config.Holder = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		if config.TTL <= 0 {
+			config.TTL = 15 * time.Second
+		}
+		if config.RenewInterval <= 0 {
+			config.RenewInterval = config.TTL / 3
+		}
+		if config.Leaser == nil || (config.Scope != LeaseScopePoller && config.Scope != LeaseScopePersistenceKey) {
+			return errorx.IllegalArgument.New("invalid lease configuration: a leaser and a scope of %s or %s are required", LeaseScopePoller, LeaseScopePersistenceKey)
+		}
+		p.leaseConfig = &config
+		return nil
+	}
+}
+
+// leasesEnabled checks whether leader election is configured
+func (p *LightningPoller) leasesEnabled() bool {
+	return p.leaseConfig != nil
+}
+
+// leaseName returns the name of the lease that covers a persistence key
+func (p *LightningPoller) leaseName(key string) string {
+	if p.leaseConfig.Scope == LeaseScopePersistenceKey {
+		return p.leaseConfig.Name + "/" + key
+	}
+	return p.leaseConfig.Name
+}
+
+// leaseNames returns the names of every lease the poller needs
+func (p *LightningPoller) leaseNames() []string {
+	if p.leaseConfig.Scope != LeaseScopePersistenceKey {
+		return []string{p.leaseConfig.Name}
+	}
+	names := []string{}
+	for _, query := range p.queries() {
+		names = append(names, p.leaseName(query.PersistenceKey))
+	}
+	return names
+}
+
+// holdsLease checks whether this replica holds the lease that covers a
+// persistence key. It's always true when leases aren't enabled
+func (p *LightningPoller) holdsLease(key string) bool {
+	if !p.leasesEnabled() {
+		return true
+	}
+	_, ok := p.currentLease(key)
+	return ok
+}
+
+// currentLease returns the lease that covers a persistence key if this
+// replica holds it
+func (p *LightningPoller) currentLease(key string) (*heldLease, bool) {
+	p.leasesMu.Lock()
+	defer p.leasesMu.Unlock()
+	held, ok := p.leases[p.leaseName(key)]
+	if !ok || !p.clock.Now().Before(held.validUntil) {
+		return nil, false
+	}
+	return held, true
+}
+
+// leaseContext returns a context that's cancelled when the lease that covers
+// a persistence key is lost, carrying the lease for LeaseFromContext. ok is
+// false if this replica doesn't hold the lease. The context has no deadline,
+// since renewals keep the lease past its current expiry, and a lease that
+// can't be renewed is lost once it expires
+func (p *LightningPoller) leaseContext(ctx context.Context, key string) (leaseCtx context.Context, cancel context.CancelFunc, ok bool) {
+	if !p.leasesEnabled() {
+		leaseCtx, cancel = context.WithCancel(ctx)
+		return leaseCtx, cancel, true
+	}
+	held, ok := p.currentLease(key)
+	if !ok {
+		return ctx, func() {}, false
+	}
+	leaseCtx, cancel = context.WithCancel(context.WithValue(ctx, leaseContextKey{}, held.lease))
+	go func() {
+		select {
+		case <-held.lost:
+			cancel()
+		case <-leaseCtx.Done():
+		}
+	}()
+	return leaseCtx, cancel, true
+}
+
+// startLeases acquires leases before returning, then renews them in the
+// background. stop releases them and waits for the release to finish. It's a
+// no-op when leases aren't enabled
+func (p *LightningPoller) startLeases(ctx context.Context) (stop func()) {
+	if !p.leasesEnabled() {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.renewLeases(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(p.leaseConfig.RenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.releaseLeases()
+				return
+			case <-ticker.C:
+				p.renewLeases(ctx)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// renewLeases acquires or renews every lease the poller needs, and drops the
+// ones it has lost or no longer needs
+func (p *LightningPoller) renewLeases(ctx context.Context) {
+	names := p.leaseNames()
+	needed := map[string]bool{}
+	for _, name := range names {
+		needed[name] = true
+		now := p.clock.Now()
+		lease, err := p.leaseConfig.Leaser.Acquire(ctx, name, p.leaseConfig.Holder, p.leaseConfig.TTL)
+		logger := p.logger.WithFields(logrus.Fields{"lease": name, "holder": p.leaseConfig.Holder})
+		switch {
+		case err == nil:
+			p.setLease(name, lease, now.Add(p.leaseConfig.TTL))
+		case errors.Is(err, ErrLeaseHeld):
+			p.loseLease(name, "held by "+lease.Holder)
+		default:
+			// keep the lease until it expires by the local clock, in case
+			// the leaser recovers before then
+			logger.WithError(err).Error("error renewing lease")
+			p.expireLease(name)
+		}
+	}
+	p.leasesMu.Lock()
+	unneeded := []string{}
+	for name := range p.leases {
+		if !needed[name] {
+			unneeded = append(unneeded, name)
+		}
+	}
+	p.leasesMu.Unlock()
+	for _, name := range unneeded {
+		p.loseLease(name, "no longer needed")
+		err := p.leaseConfig.Leaser.Release(ctx, name, p.leaseConfig.Holder)
+		p.logOnErr("error releasing lease", err)
+	}
+}
+
+// setLease records a lease that was acquired or renewed. Newly acquired
+// leases reload their queries' positions, which the previous holder may have
+// advanced
+func (p *LightningPoller) setLease(name string, lease Lease, validUntil time.Time) {
+	p.leasesMu.Lock()
+	held, ok := p.leases[name]
+	acquired := !ok || held.lease.Token != lease.Token
+	if acquired {
+		if ok {
+			close(held.lost)
+		}
+		held = &heldLease{lost: make(chan struct{})}
+		p.leases[name] = held
+	}
+	held.lease = lease
+	held.validUntil = validUntil
+	p.leasesMu.Unlock()
+	if acquired {
+		p.logger.WithFields(logrus.Fields{"lease": name, "holder": lease.Holder, "token": lease.Token}).Info("acquired lease")
+		p.reloadLeasedPositions(name)
+	}
+}
+
+// loseLease forgets a lease and cancels the polls that use it
+func (p *LightningPoller) loseLease(name, reason string) {
+	p.leasesMu.Lock()
+	held, ok := p.leases[name]
+	delete(p.leases, name)
+	p.leasesMu.Unlock()
+	if ok {
+		close(held.lost)
+		p.logger.WithFields(logrus.Fields{"lease": name, "reason": reason}).Warn("lost lease")
+	}
+}
+
+// expireLease drops a lease that couldn't be renewed once it has expired by
+// the local clock
+func (p *LightningPoller) expireLease(name string) {
+	p.leasesMu.Lock()
+	held, ok := p.leases[name]
+	p.leasesMu.Unlock()
+	if ok && !p.clock.Now().Before(held.validUntil) {
+		p.loseLease(name, "expired")
+	}
+}
+
+// releaseLeases gives up every lease, so that another replica can take over
+// without waiting for them to expire
+func (p *LightningPoller) releaseLeases() {
+	p.leasesMu.Lock()
+	names := make([]string, 0, len(p.leases))
+	for name := range p.leases {
+		names = append(names, name)
+	}
+	p.leasesMu.Unlock()
+	for _, name := range names {
+		p.loseLease(name, "released")
+		ctx, cancel := context.WithTimeout(context.Background(), p.leaseConfig.TTL)
+		err := p.leaseConfig.Leaser.Release(ctx, name, p.leaseConfig.Holder)
+		cancel()
+		p.logOnErr("error releasing lease", err)
+	}
+}
+
+// savePolledPosition saves the position of a poll, or one set while the query
+// isn't polling, fenced by the token of the lease in ctx when the store is a
+// FencedPositionStore
+func (p *LightningPoller) savePolledPosition(ctx context.Context, key string, position Position) error {
+	lease, leased := LeaseFromContext(ctx)
+	store, fenced := p.store.(FencedPositionStore)
+	if !leased || !fenced {
+		return p.setPosition(key, position)
+	}
+	err := store.SetFenced(ctx, key, position, lease)
+	p.loseFencedLease(lease, err)
+	return err
+}
+
+// loseFencedLease drops a lease once the store has rejected a position saved
+// with it, since another replica has held it since
+func (p *LightningPoller) loseFencedLease(lease Lease, err error) {
+	if errors.Is(err, ErrLeaseLost) {
+		p.loseLease(lease.Name, "position saved with a newer token")
+	}
+}
+
+// reloadLeasedPositions reloads the persisted positions of the queries that a
+// newly acquired lease covers
+func (p *LightningPoller) reloadLeasedPositions(name string) {
+	if !p.config.PersistenceEnabled || !p.positionsReady() {
+		return
+	}
+	for _, query := range p.queries() {
+		if p.leaseName(query.PersistenceKey) == name {
+			p.reloadPosition(query)
+		}
+	}
+}
+
+// reloadPosition replaces a query's position with its persisted one, after
+// another replica may have advanced it. A query that's polling, such as a poll
+// from before the handover that hasn't stopped yet, is reloaded once the poll
+// finishes, so it doesn't continue from the position it had in memory
+func (p *LightningPoller) reloadPosition(query QueryWithCallback) {
+	if !p.config.PersistenceEnabled || !p.positionsReady() {
+		return
+	}
+	if !p.lockOrReloadLater(query) {
+		return
+	}
+	defer p.unlockInProgressQuery(query)
+	p.loadSavedPosition(query)
+}
+
+// lockOrReloadLater locks a query like checkInProgressAndLock, returning true
+// if it did. If the query is polling, its position is reloaded when the poll
+// unlocks it instead
+func (p *LightningPoller) lockOrReloadLater(query QueryWithCallback) bool {
+	key := query.PersistenceKey
+	p.inProgressQueriesMu.Lock()
+	defer p.inProgressQueriesMu.Unlock()
+	inProgress, ok := p.inProgressQueries[key]
+	if !ok {
+		// the query has been removed
+		return false
+	}
+	if inProgress {
+		p.pendingReloads[key] = true
+		return false
+	}
+	p.inProgressQueries[key] = true
+	return true
+}
+
+// loadSavedPosition replaces the position of a query whose in progress lock
+// the caller holds with its persisted one
+func (p *LightningPoller) loadSavedPosition(query QueryWithCallback) {
+	position, err := p.getPosition(query.PersistenceKey)
+	if err != nil {
+		p.logOnErr(fmt.Sprintf("error reloading position for %s", query.PersistenceKey), err)
+		return
+	}
+	p.setCurrentPosition(query.PersistenceKey, position)
+	p.recordProgress(query.PersistenceKey)
+	p.setUpToDateQuery(false, query)
+}
+
+// positionsReady checks whether positions have been loaded
+func (p *LightningPoller) positionsReady() bool {
+	p.positionsMu.Lock()
+	defer p.positionsMu.Unlock()
+	return p.positions != nil
+}
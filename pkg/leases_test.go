@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	_ "modernc.org/sqlite"
+)
+
+func TestReloadPositionWaitsForThePollInProgress(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	store, err := OpenBadgerPositionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	delivering, release := make(chan struct{}), make(chan struct{})
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			close(delivering)
+			<-release
+			// the poll doesn't save a position, so only the reload can move it
+			return false
+		},
+	}
+	poller, err := New(WithSalesforceClient(server.Client()), WithQueries(query), WithPositionStore(store), WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := poller.RunOnce(context.Background())
+		done <- err
+	}()
+	<-delivering
+	// another replica advances the saved position during the poll
+	saved := NewPositionAt(lastModifiedDate.Add(time.Minute))
+	err = store.Set("Accounts", saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.reloadPosition(query)
+	close(release)
+	<-done
+	position := poller.getCurrentPosition("Accounts")
+	if position == nil || !position.LastModifiedDate.Equal(*saved.LastModifiedDate) {
+		t.Fatalf("expected the saved position to be reloaded after the poll, got %+v", position)
+	}
+	poller.inProgressQueriesMu.Lock()
+	inProgress := poller.inProgressQueries["Accounts"]
+	poller.inProgressQueriesMu.Unlock()
+	if inProgress {
+		t.Fatal("expected the query to be unlocked after the reload")
+	}
+}
+
+// recordingFencedStore records the errors of fenced saves
+type recordingFencedStore struct {
+	*SQLPositionStore
+	errs []error
+}
+
+func (s *recordingFencedStore) SetFenced(ctx context.Context, key string, position Position, lease Lease) error {
+	err := s.SQLPositionStore.SetFenced(ctx, key, position, lease)
+	if err != nil {
+		s.errs = append(s.errs, err)
+	}
+	return err
+}
+
+func TestFencedSaveOutlivesTheLeaseTTLWhileItsRenewed(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "leases.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the lease renewals and the position saves share one sqlite connection
+	db.SetMaxOpenConns(1)
+	store := &recordingFencedStore{SQLPositionStore: NewSQLPositionStore(db)}
+	err = store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaser := NewSQLLeaser(db)
+	err = leaser.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl := 200 * time.Millisecond
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			// the callback takes longer than the lease lasts without renewals
+			time.Sleep(3 * ttl)
+			return true
+		},
+	}
+	poller, err := New(WithSalesforceClient(server.Client()), WithQueries(query), WithPositionStore(store), WithLastModifiedDateCorrection(0),
+		WithLeases(LeaseConfig{Leaser: leaser, Holder: "replica-1", TTL: ttl, RenewInterval: ttl / 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.errs) > 0 {
+		t.Fatalf("expected the fenced save to succeed while the lease is renewed, got %v", store.errs)
+	}
+	position, err := store.Get("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position.LastModifiedDate == nil || !position.LastModifiedDate.Equal(lastModifiedDate) {
+		t.Fatalf("expected the position to be saved after the slow callback, got %+v", position)
+	}
+}
@@ -1,24 +1,19 @@
 package pkg
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/catalystsquad/app-utils-go/errorutils"
-	"github.com/catalystsquad/app-utils-go/logging"
 	"github.com/catalystsquad/salesforce-utils/pkg"
-	"github.com/dgraph-io/badger/v3"
-	"github.com/go-playground/validator/v10"
 	"github.com/joomcode/errorx"
-	"github.com/samber/lo"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
@@ -31,57 +26,297 @@ type Position struct {
 
 type LightningPoller struct {
 	config            *RunConfig
-	db                *badger.DB
+	store             PositionStore
 	SfUtils           *pkg.SalesforceUtils
+	client            SalesforceClient
+	logger            Logger
+	clock             Clock
 	positions         map[string]*Position
+	positionsMu       *sync.Mutex
 	sfUtilsReAuthLock *sync.Mutex
 	// inProgressQueries tracks whether a query is currently running, to
-	// prevent future polls from starting a duplicate query
+	// prevent future polls from starting a duplicate query. pendingReloads
+	// are queries whose saved position is reloaded once they stop running,
+	// and are also guarded by inProgressQueriesMu
 	inProgressQueries   map[string]bool
+	pendingReloads      map[string]bool
 	inProgressQueriesMu *sync.Mutex
 	// upToDateQueries tracks whether a query is caught up with the latest
 	// objects in salesforce for managing when to wait for dependencies
 	upToDateQueries   map[string]bool
 	upToDateQueriesMu *sync.Mutex
+	// queryStats tracks pages, delivered records and errors per persistence
+	// key, used for summarizing runs
+	queryStats    map[string]*QueryStats
+	queryStatuses map[string]*queryStatus
+	queryStatsMu  *sync.Mutex
+	// lastPolled tracks when each query was last started, for queries that
+	// configure their own interval
+	lastPolled   map[string]time.Time
+	lastPolledMu *sync.Mutex
+	// pausedQueries tracks queries that have been paused, which are skipped
+	// until they're resumed
+	pausedQueries   map[string]bool
+	pausedQueriesMu *sync.Mutex
+	metrics         *pollerMetrics
+	// registerer is where metrics are registered when they're enabled, a
+	// registry of the poller's own unless WithRegisterer is given
+	registerer   prometheus.Registerer
+	lifecycle    *lifecycle
+	alertHandler AlertHandler
+	// sfConfig, startFrom, startFromExclusions, configFile and configFileUsed
+	// are set by options, and used when the poller is created. configFileUsed
+	// is the file WithEnvConfig read, which is reloaded when it changes
+	sfConfig            *pkg.Config
+	startFrom           *time.Time
+	startFromExclusions []string
+	configFile          string
+	configFileUsed      string
+	// ownsStore is false when the store was given with WithPositionStore, so
+	// it isn't opened or closed by the poller
+	ownsStore bool
+	// queryOverrides are per persistence key settings from the config file,
+	// which can be reloaded while the poller runs
+	queryOverrides   map[string]QueryOverride
+	queryOverridesMu *sync.Mutex
+	// queriesMu guards config.Queries, which can change while the poller
+	// runs, see AddQuery
+	queriesMu *sync.Mutex
+	// orgs are the named salesforce connections by name, along with the
+	// default connection under an empty name. They don't change once the
+	// poller is created
+	orgs map[string]*orgConnection
+	// authConfig creates an OAuthClient for the default connection instead of
+	// salesforce-utils
+	authConfig *AuthConfig
+	// leaseConfig enables leader election, and leases are the leases this
+	// replica holds by name
+	leaseConfig *LeaseConfig
+	leases      map[string]*heldLease
+	leasesMu    *sync.Mutex
+	// shardConfig enables sharding, shards are the keys assigned to this
+	// replica, and shardHeartbeat is when it last heartbeated successfully
+	shardConfig    *ShardConfig
+	shards         map[string]*ownedShard
+	shardsMu       *sync.Mutex
+	shardHeartbeat time.Time
+	// snapshots keep the watched fields of delivered records, for queries
+	// with WatchFields. An owned store is only opened once such a query
+	// polls. ownsSnapshots is false when the store was given with
+	// WithSnapshotStore
+	snapshots     SnapshotStore
+	ownsSnapshots bool
+	snapshotsMu   *sync.Mutex
 }
 
 type RunConfig struct {
 	Queries                            []QueryWithCallback `validate:"required"`
 	StartupPositionOverrides           map[string]time.Time
 	Ticker                             *time.Ticker
+	PollInterval                       time.Duration `json:"poll_interval"`
 	PersistenceEnabled                 bool          `json:"persistence_enabled"`
 	PersistencePath                    string        `json:"persistence_path"`
 	LastModifiedDateCorrectionDuration time.Duration `json:"last_modified_date_correction_duration"`
 	SkipDependencyCheck                bool          `json:"skip_dependency_check"`
+	AdminAddress                       string        `json:"admin_address"`
+	MetricsEnabled                     bool          `json:"metrics_enabled"`
+	HealthAddress                      string        `json:"health_address"`
+	// HealthMaxConsecutiveFailures and HealthMaxLag are the default
+	// thresholds for reporting a query as degraded, see QueryWithCallback
+	HealthMaxConsecutiveFailures int           `json:"health_max_consecutive_failures"`
+	HealthMaxLag                 time.Duration `json:"health_max_lag"`
+	// StallThreshold and LagAlertThreshold are the default thresholds for
+	// the watchdog to alert on, zero disables them
+	StallThreshold    time.Duration `json:"stall_threshold"`
+	LagAlertThreshold time.Duration `json:"lag_alert_threshold"`
+	WatchdogInterval  time.Duration `json:"watchdog_interval"`
+	AlertWebhookURL   string        `json:"alert_webhook_url"`
+	// WatchConfig reloads query overrides when the config file read by
+	// WithEnvConfig changes
+	WatchConfig bool `json:"watch_config"`
+	// ReauthMaxAttempts and ReauthBackoff bound the attempts to reauthenticate
+	// after a session expires, before the poll fails
+	ReauthMaxAttempts int           `json:"reauth_max_attempts"`
+	ReauthBackoff     time.Duration `json:"reauth_backoff"`
+	// SnapshotPath is where the snapshots of queries with WatchFields are
+	// kept, unless a store is given with WithSnapshotStore
+	SnapshotPath string `json:"snapshot_path"`
 }
 
 type QueryWithCallback struct {
 	Query          func() string                       `json:"query" validate:"required"`
 	PersistenceKey string                              `json:"persistenceKey"`
-	Callback       func(result []byte, err error) bool `validate:"required"`
-	DependsOn      []string
+	Callback       func(result []byte, err error) bool `validate:"required_without_all=ContextCallback TxCallback"`
+	// ContextCallback can be used instead of Callback to receive the context
+	// of the poll's trace, so that downstream work joins the same trace
+	ContextCallback func(ctx context.Context, result []byte, err error) bool
+	DependsOn       []string
+	// Interval optionally polls this query less often than the poll interval.
+	// Queries are still started on the poller's ticker, so an Interval shorter
+	// than the poll interval has no effect
+	Interval time.Duration `json:"interval"`
+	// MaxConsecutiveFailures overrides LP_HEALTH_MAX_CONSECUTIVE_FAILURES for
+	// this query, readiness reports degraded once this many polls in a row
+	// have failed
+	MaxConsecutiveFailures int `json:"max_consecutive_failures"`
+	// MaxLag overrides LP_HEALTH_MAX_LAG for this query, readiness reports
+	// degraded once the query is behind salesforce by more than this
+	MaxLag time.Duration `json:"max_lag"`
+	// StallThreshold overrides LP_STALL_THRESHOLD for this query, the
+	// watchdog alerts once the query's position hasn't advanced, and it
+	// hasn't caught up, for longer than this
+	StallThreshold time.Duration `json:"stall_threshold"`
+	// LagAlertThreshold overrides LP_LAG_ALERT_THRESHOLD for this query, the
+	// watchdog alerts once the query is behind salesforce by more than this
+	LagAlertThreshold time.Duration `json:"lag_alert_threshold"`
+	// Org binds the query to a salesforce org added with WithOrg or
+	// WithOrgClient, empty uses the default connection. The query's
+	// persistence key and the dependencies in DependsOn that don't name an
+	// org are prefixed with the org, see OrgKey
+	Org string `json:"org"`
+	// TxCallback can be used instead of Callback to deliver records in a
+	// transaction of the database that positions are stored in, which must be
+	// a TxPositionStore. The position is saved in the same transaction, so
+	// records and the position commit together. Returning an error rolls back
+	// the transaction and fails the poll
+	TxCallback func(ctx context.Context, tx *sql.Tx, result []byte) error
+	// WatchFields only delivers records once one of these fields has changed
+	// since the record was last delivered, instead of whenever its
+	// LastModifiedDate changes. Records are always delivered when they're
+	// deleted or undeleted. Delivered records have the changes of their
+	// watched fields in attributes.changes, see FieldChange. Requires a
+	// snapshot store, from WithSnapshotStore or LP_SNAPSHOT_PATH
+	WatchFields []string `json:"watch_fields"`
 }
 
-func NewLightningPoller(queries []QueryWithCallback, sfConfig pkg.Config, startFrom *time.Time, startFromExclusions []string) (*LightningPoller, error) {
+// NewLightningPoller creates a poller configured from LP_ environment variables
+// and the config file, see WithEnvConfig, followed by opts. Use New to create a
+// poller without reading the environment
+func NewLightningPoller(queries []QueryWithCallback, sfConfig pkg.Config, startFrom *time.Time, startFromExclusions []string, opts ...Option) (*LightningPoller, error) {
+	return New(append([]Option{
+		WithEnvConfig(),
+		WithQueries(queries...),
+		WithSalesforceConfig(sfConfig),
+		WithStartFrom(startFrom, startFromExclusions),
+	}, opts...)...)
+}
+
+// New creates a poller from opts, starting from DefaultRunConfig. Nothing is
+// read from the environment unless WithEnvConfig is given. Queries are
+// required, and so is a salesforce client from WithSalesforceClient or
+// WithSalesforceConfig
+func New(opts ...Option) (*LightningPoller, error) {
 	poller := &LightningPoller{
+		config:              DefaultRunConfig(),
+		logger:              defaultLogger(),
+		clock:               systemClock{},
+		sfUtilsReAuthLock:   &sync.Mutex{},
 		inProgressQueries:   make(map[string]bool),
+		pendingReloads:      make(map[string]bool),
 		inProgressQueriesMu: &sync.Mutex{},
 		upToDateQueries:     make(map[string]bool),
 		upToDateQueriesMu:   &sync.Mutex{},
+		queryStats:          make(map[string]*QueryStats),
+		queryStatsMu:        &sync.Mutex{},
+		lastPolled:          make(map[string]time.Time),
+		lastPolledMu:        &sync.Mutex{},
+		positionsMu:         &sync.Mutex{},
+		queryStatuses:       make(map[string]*queryStatus),
+		pausedQueries:       make(map[string]bool),
+		pausedQueriesMu:     &sync.Mutex{},
+		metrics:             newPollerMetrics(),
+		lifecycle:           &lifecycle{},
+		queryOverridesMu:    &sync.Mutex{},
+		queriesMu:           &sync.Mutex{},
+		orgs:                make(map[string]*orgConnection),
+		leases:              make(map[string]*heldLease),
+		leasesMu:            &sync.Mutex{},
+		shards:              make(map[string]*ownedShard),
+		shardsMu:            &sync.Mutex{},
+		snapshotsMu:         &sync.Mutex{},
+	}
+	for _, opt := range opts {
+		err := opt(poller)
+		if err != nil {
+			return nil, err
+		}
 	}
-	poller.initMaps(queries)
-	config, err := initConfig(queries, startFrom, startFromExclusions)
+	// a store given with WithPositionStore belongs to the caller
+	poller.ownsStore = poller.store == nil
+	poller.ownsSnapshots = poller.snapshots == nil
+	config := poller.config
+	for i, query := range config.Queries {
+		config.Queries[i] = namespaceQuery(query)
+	}
+	if poller.configFileUsed != "" {
+		poller.logger.WithFields(logrus.Fields{"file": poller.configFileUsed}).Info("Using config file")
+	}
+	if poller.startFrom != nil {
+		config.StartupPositionOverrides = getStartupPositionOverridesFromTimeIgnoringHistory(config.Queries, *poller.startFrom, poller.startFromExclusions)
+	}
+	poller.logger.WithFields(logrus.Fields{"startupPositionOverrides": config.StartupPositionOverrides}).Debug("startup position overrides")
+	err := validateRunConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	poller.config = config
+	if config.Ticker == nil {
+		config.Ticker = time.NewTicker(config.PollInterval)
+	}
+	poller.initMaps(config.Queries)
+	if poller.alertHandler == nil {
+		poller.alertHandler = defaultAlertHandler(config, poller.logger)
+	}
+	err = poller.validateCallbacks(config.Queries)
+	if err != nil {
+		return nil, err
+	}
+	if config.MetricsEnabled {
+		if poller.registerer == nil {
+			poller.registerer = newMetricsRegistry()
+		}
+		err = poller.RegisterMetrics(poller.registerer)
+		if err != nil {
+			return nil, errorx.Decorate(err, "error registering metrics")
+		}
+	}
 	if !config.SkipDependencyCheck {
 		err = poller.validateDependsOn()
 		if err != nil {
 			return nil, err
 		}
 	}
-	poller.SfUtils, err = pkg.NewSalesforceUtils(true, sfConfig)
+	// the default connection is only created when a query uses it, so that
+	// every query can be bound to an org
+	if poller.client == nil && poller.usesDefaultConnection() {
+		if poller.authConfig != nil {
+			poller.client, err = connectOAuth(*poller.authConfig, poller.clock)
+			if err != nil {
+				return nil, err
+			}
+		} else if poller.sfConfig != nil {
+			poller.SfUtils, err = pkg.NewSalesforceUtils(true, *poller.sfConfig)
+			if err != nil {
+				return nil, err
+			}
+			poller.client = poller.SfUtils
+		} else {
+			return nil, errorx.IllegalArgument.New("invalid configuration: a salesforce client or salesforce config is required")
+		}
+	}
+	err = poller.connectOrgs()
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range config.Queries {
+		err = poller.validateOrg(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// overrides are validated against the client, so they're applied last
+	overrides := poller.queryOverrides
+	poller.queryOverrides = nil
+	err = poller.SetQueryOverrides(overrides)
 	if err != nil {
 		return nil, err
 	}
@@ -94,14 +329,38 @@ func (p *LightningPoller) initMaps(queries []QueryWithCallback) {
 	for _, query := range queries {
 		p.inProgressQueries[query.PersistenceKey] = false
 		p.upToDateQueries[query.PersistenceKey] = false
+		p.queryStats[query.PersistenceKey] = &QueryStats{}
 	}
 }
 
+// validateCallbacks ensures that every query has a callback, and that
+// transactional callbacks have a store that supports them
+func (p *LightningPoller) validateCallbacks(queries []QueryWithCallback) error {
+	for _, query := range queries {
+		if query.Callback == nil && query.ContextCallback == nil && query.TxCallback == nil {
+			return errorx.IllegalArgument.New("invalid configuration: query %s requires a Callback, ContextCallback or TxCallback", query.PersistenceKey)
+		}
+		if _, ok := p.store.(TxPositionStore); query.TxCallback != nil && !ok {
+			return errorx.IllegalArgument.New("invalid configuration: query %s has a TxCallback, which requires a TxPositionStore given with WithPositionStore", query.PersistenceKey)
+		}
+		if query.TxCallback != nil && !p.config.PersistenceEnabled {
+			// the callback's writes commit with a position that's never loaded
+			// without persistence, such as when LP_PERSISTENCE_ENABLED turns it
+			// off after WithPositionStore
+			return errorx.IllegalArgument.New("invalid configuration: query %s has a TxCallback, which requires persistence to be enabled", query.PersistenceKey)
+		}
+		if len(query.WatchFields) > 0 && p.snapshots == nil && p.config.SnapshotPath == "" {
+			return errorx.IllegalArgument.New("invalid configuration: query %s has WatchFields, which requires a snapshot store given with WithSnapshotStore or LP_SNAPSHOT_PATH", query.PersistenceKey)
+		}
+	}
+	return nil
+}
+
 // validateDependsOn iterates over all dependsOn fields and ensures that they
 // reference a real persistenceKey by checking the keys of the inProgressQueries
 func (p *LightningPoller) validateDependsOn() error {
 	missingDependencies := []string{}
-	for _, query := range p.config.Queries {
+	for _, query := range p.queries() {
 		for _, dependency := range query.DependsOn {
 			if _, ok := p.inProgressQueries[dependency]; !ok {
 				missingDependencies = append(missingDependencies, dependency)
@@ -111,20 +370,82 @@ func (p *LightningPoller) validateDependsOn() error {
 	if len(missingDependencies) > 0 {
 		return errors.New(fmt.Sprintf("dependsOn field includes persistenceKeys that don't exist. Missing persistenceKeys: %s", strings.Join(missingDependencies, ",")))
 	}
+	return validateDependencyCycles(p.queries())
+}
+
+// validateDependencyCycles rejects queries that depend on themselves, directly
+// or through other queries, since they'd never be up to date
+func validateDependencyCycles(queries []QueryWithCallback) error {
+	dependsOn := map[string][]string{}
+	for _, query := range queries {
+		dependsOn[query.PersistenceKey] = query.DependsOn
+	}
+	// keys are visiting while their dependencies are checked, and visited
+	// once none of them lead back
+	visiting, visited := map[string]bool{}, map[string]bool{}
+	path := []string{}
+	var visit func(key string) []string
+	visit = func(key string) []string {
+		if visiting[key] {
+			for i := range path {
+				if path[i] == key {
+					return append(append([]string{}, path[i:]...), key)
+				}
+			}
+		}
+		if visited[key] {
+			return nil
+		}
+		visiting[key] = true
+		path = append(path, key)
+		for _, dependency := range dependsOn[key] {
+			if cycle := visit(dependency); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		visiting[key], visited[key] = false, true
+		return nil
+	}
+	for _, query := range queries {
+		if cycle := visit(query.PersistenceKey); cycle != nil {
+			return errorx.IllegalArgument.New("invalid configuration: queries depend on themselves: %s", strings.Join(cycle, " -> "))
+		}
+	}
 	return nil
 }
 
 func (p *LightningPoller) Run() {
 	if p.config.PersistenceEnabled {
-		err := p.openBadgerDb(p.config.PersistencePath)
+		err := p.openPositionStore(p.config.PersistencePath)
 		if err != nil {
 			return
 		}
 	}
-	defer p.closeBadgerDb()
+	defer p.closePositionStore()
+	defer p.closeSnapshotStore()
+	stopLeases := p.startLeases(context.Background())
+	defer stopLeases()
+	stopSharding := p.startSharding(context.Background())
+	defer stopSharding()
 	err := p.loadPositions()
-	errorutils.PanicOnErr(nil, "error loading poller position", err)
+	p.panicOnErr("error loading poller position", err)
+	if p.config.AdminAddress != "" {
+		go p.serveAdmin(p.config.AdminAddress)
+	}
+	if p.config.HealthAddress != "" {
+		go p.serveHealth(p.config.HealthAddress)
+	}
+	if p.watchdogEnabled() {
+		go p.runWatchdog()
+	}
+	if p.config.WatchConfig && p.configFileUsed != "" {
+		p.watchConfig()
+	}
+	p.lifecycle.start(p.clock.Now())
+	defer p.lifecycle.stop()
 	for range p.config.Ticker.C {
+		p.lifecycle.tick(p.clock.Now())
 		p.poll()
 	}
 }
@@ -132,49 +453,85 @@ func (p *LightningPoller) Run() {
 // loadPositions loads positions into memory, using saved state if saved state exists
 func (p *LightningPoller) loadPositions() error {
 	// init poller's positions map
+	p.positionsMu.Lock()
 	p.positions = map[string]*Position{}
+	p.positionsMu.Unlock()
 	// load position for each query based on persistence key
-	for _, query := range p.config.Queries {
+	for _, query := range p.queries() {
 		err := p.loadPosition(query)
 		if err != nil {
 			return err
 		}
 	}
+	p.lifecycle.setPositionsLoaded()
 	return nil
 }
 
 func (p *LightningPoller) loadPosition(query QueryWithCallback) error {
 	// check if there is a position override for the persistence key
 	key := query.PersistenceKey
+	// start the stall clock from when the position was loaded
+	p.recordProgress(key)
 	if timeOverride, exists := p.config.StartupPositionOverrides[key]; exists {
-		p.positions[key] = &Position{LastModifiedDate: &timeOverride}
-	} else {
-		if p.config.PersistenceEnabled {
-			// fetch saved position and set it on the map
-			savedPosition, err := p.getPosition([]byte(key))
-			if err != nil {
-				return err
-			}
-			p.positions[key] = savedPosition
-		} else {
-			// persistence is disabled, initialize to zero values
-			p.positions[key] = &Position{LastModifiedDate: &time.Time{}}
+		p.setCurrentPosition(key, &Position{LastModifiedDate: &timeOverride})
+		return nil
+	}
+	// without persistence, queries start from zero values
+	position := &Position{LastModifiedDate: &time.Time{}}
+	if p.config.PersistenceEnabled {
+		// fetch saved position and set it on the map
+		savedPosition, err := p.getPosition(key)
+		if err != nil {
+			return err
 		}
+		position = savedPosition
+	}
+	// start_from only applies to a query that hasn't saved a position yet, so
+	// restarts don't move it back. changing it while running moves the
+	// position once, see SetQueryOverrides
+	if startFrom := p.getQueryOverride(key).StartFrom; startFrom != nil && (position.LastModifiedDate == nil || position.LastModifiedDate.IsZero()) {
+		startPosition := NewPositionAt(*startFrom)
+		position = &startPosition
 	}
+	p.setCurrentPosition(key, position)
 	return nil
 }
 
 func (p *LightningPoller) poll() {
-	for _, queryWithCallback := range p.config.Queries {
-		go func(queryWithCallback QueryWithCallback) {
-			err := p.runQuery(queryWithCallback)
-			if err != nil {
-				logging.Log.WithFields(logrus.Fields{"persistence_key": queryWithCallback.PersistenceKey}).WithError(err).Error("error polling")
-			}
-		}(queryWithCallback)
+	for _, queryWithCallback := range p.queries() {
+		if !p.checkIntervalElapsedAndMark(queryWithCallback) {
+			continue
+		}
+		go p.pollQuery(queryWithCallback)
+	}
+}
+
+// pollQuery runs a single query and logs any error
+func (p *LightningPoller) pollQuery(queryWithCallback QueryWithCallback) {
+	err := p.runQuery(context.Background(), queryWithCallback)
+	if err != nil {
+		p.queryLogger(queryWithCallback.PersistenceKey).WithError(err).Error("error polling")
 	}
 }
 
+// checkIntervalElapsedAndMark checks whether the query's interval has elapsed
+// since it was last started, and records the current time as the last start if
+// it has. queries without an interval are always due
+func (p *LightningPoller) checkIntervalElapsedAndMark(queryWithCallback QueryWithCallback) bool {
+	interval := p.queryInterval(queryWithCallback)
+	if interval <= 0 {
+		return true
+	}
+	p.lastPolledMu.Lock()
+	defer p.lastPolledMu.Unlock()
+	now := p.clock.Now()
+	if lastPolled, ok := p.lastPolled[queryWithCallback.PersistenceKey]; ok && now.Sub(lastPolled) < interval {
+		return false
+	}
+	p.lastPolled[queryWithCallback.PersistenceKey] = now
+	return true
+}
+
 // checkInProgressAndLock will check to see if a previoius poll is still in progress
 // for the given query, and update the inProgressQueries map if it is not
 // currently polling. we use a mutex here to ensure that two threads don't
@@ -182,7 +539,9 @@ func (p *LightningPoller) poll() {
 func (p *LightningPoller) checkInProgressAndLock(queryWithCallback QueryWithCallback) bool {
 	p.inProgressQueriesMu.Lock()
 	defer p.inProgressQueriesMu.Unlock()
-	if p.inProgressQueries[queryWithCallback.PersistenceKey] {
+	// a query that's been removed is treated as in progress, so that polls
+	// that were already scheduled don't run it
+	if inProgress, ok := p.inProgressQueries[queryWithCallback.PersistenceKey]; !ok || inProgress {
 		return true
 	}
 	p.inProgressQueries[queryWithCallback.PersistenceKey] = true
@@ -190,11 +549,21 @@ func (p *LightningPoller) checkInProgressAndLock(queryWithCallback QueryWithCall
 }
 
 // unlockInProgressQuery will unlock the persistenceKey in the
-// inProgressQueries map
+// inProgressQueries map. If a reload of its position is pending, the position
+// is reloaded before the query is unlocked
 func (p *LightningPoller) unlockInProgressQuery(queryWithCallback QueryWithCallback) {
+	key := queryWithCallback.PersistenceKey
 	p.inProgressQueriesMu.Lock()
-	defer p.inProgressQueriesMu.Unlock()
-	p.inProgressQueries[queryWithCallback.PersistenceKey] = false
+	reload := p.pendingReloads[key]
+	delete(p.pendingReloads, key)
+	if !reload {
+		p.inProgressQueries[key] = false
+	}
+	p.inProgressQueriesMu.Unlock()
+	if reload {
+		p.loadSavedPosition(queryWithCallback)
+		p.unlockInProgressQuery(queryWithCallback)
+	}
 }
 
 // dependenciesUpToDate checks if all of an object's dependencies are up to
@@ -212,33 +581,83 @@ func (p *LightningPoller) dependenciesUpToDate(queryWithCallback QueryWithCallba
 
 func (p *LightningPoller) setUpToDateQuery(val bool, queryWithCallback QueryWithCallback) {
 	p.upToDateQueriesMu.Lock()
-	defer p.upToDateQueriesMu.Unlock()
 	p.upToDateQueries[queryWithCallback.PersistenceKey] = val
+	p.upToDateQueriesMu.Unlock()
+	if val {
+		// a query that's caught up isn't stalled, even though its position
+		// doesn't advance until records change
+		p.recordProgress(queryWithCallback.PersistenceKey)
+	}
 }
 
-func (p *LightningPoller) runQuery(queryWithCallback QueryWithCallback) error {
+func (p *LightningPoller) runQuery(ctx context.Context, queryWithCallback QueryWithCallback) (err error) {
+	if p.isPaused(queryWithCallback.PersistenceKey) {
+		p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{"reason": "query is paused"}).Debug("skipping poll")
+		p.observeSkip(queryWithCallback.PersistenceKey, skipReasonPaused)
+		return nil
+	}
+	parentCtx := ctx
+	ctx, cancel, leased := p.leaseContext(ctx, queryWithCallback.PersistenceKey)
+	defer cancel()
+	if !leased {
+		p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{"reason": "another replica holds the lease"}).Debug("skipping poll")
+		p.observeSkip(queryWithCallback.PersistenceKey, skipReasonLease)
+		return nil
+	}
+	ctx, cancelShard, owned := p.shardContext(ctx, queryWithCallback.PersistenceKey)
+	defer cancelShard()
+	if !owned {
+		p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{"reason": "assigned to another member"}).Debug("skipping poll")
+		p.observeSkip(queryWithCallback.PersistenceKey, skipReasonShard)
+		return nil
+	}
 	if p.checkInProgressAndLock(queryWithCallback) {
 		// polling is still true, do nothing
-		logging.Log.WithFields(logrus.Fields{"reason": "previous poll still in progress", "persistence_key": queryWithCallback.PersistenceKey}).Info("skipping poll")
+		p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{"reason": "previous poll still in progress"}).Info("skipping poll")
+		p.observeSkip(queryWithCallback.PersistenceKey, skipReasonInProgress)
 		return nil
 	}
 	defer p.unlockInProgressQuery(queryWithCallback)
+	p.metrics.pollsStarted.WithLabelValues(queryWithCallback.PersistenceKey, queryWithCallback.Org).Inc()
+	ctx, span := startSpan(ctx, "poll", queryWithCallback.PersistenceKey)
+	defer func() { endSpan(span, err) }()
 
 	// no poll in progress, so run the query and callback until there are no
 	// more records to consume
-	var err error
 	shouldQuery := true
 	for shouldQuery {
+		if ctx.Err() != nil {
+			if parentCtx.Err() == nil {
+				// the lease or shard was lost, another replica takes over
+				p.queryLogger(queryWithCallback.PersistenceKey).Warn("query handed over, stopping poll")
+				return nil
+			}
+			return ctx.Err()
+		}
+		// a query paused mid poll stops before its next page
+		if p.isPaused(queryWithCallback.PersistenceKey) {
+			p.queryLogger(queryWithCallback.PersistenceKey).Info("query paused, stopping poll")
+			return nil
+		}
 		// if we're not supposed to skip the dependency check, check in the middle of the loop in case the dependencies change
 		if !p.config.SkipDependencyCheck && !p.dependenciesUpToDate(queryWithCallback) {
-			logging.Log.WithFields(logrus.Fields{"reason": "dependencies are not up to date", "persistence_key": queryWithCallback.PersistenceKey}).Info("skipping poll")
+			p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{"reason": "dependencies are not up to date"}).Info("skipping poll")
+			p.observeSkip(queryWithCallback.PersistenceKey, skipReasonDependencies)
+			return nil
+		}
+		shouldQuery, err = p.doQueryWithRetry(ctx, queryWithCallback)
+		if err != nil && (errors.Is(err, ErrLeaseLost) || (ctx.Err() != nil && parentCtx.Err() == nil)) {
+			// the lease or shard was lost mid page, which isn't an error in
+			// this replica
+			p.queryLogger(queryWithCallback.PersistenceKey).WithError(err).Warn("query handed over, stopping poll")
 			return nil
 		}
-		shouldQuery, err = p.doQuery(queryWithCallback)
 		if err != nil {
+			p.recordError(queryWithCallback.PersistenceKey, err)
 			return err
 		}
 	}
+	p.recordSuccess(queryWithCallback.PersistenceKey)
 	return nil
 }
 
@@ -247,7 +666,7 @@ func (p *LightningPoller) runQuery(queryWithCallback QueryWithCallback) error {
 // the saved IDs
 func (p *LightningPoller) removeAlreadyQueriedRecords(recordsJSON []byte, queryWithCallback QueryWithCallback) (newRecordsJSON []byte, err error) {
 	newRecordsJSON = recordsJSON
-	lastPosition := p.positions[queryWithCallback.PersistenceKey]
+	lastPosition := p.getCurrentPosition(queryWithCallback.PersistenceKey)
 	// last modified dates are the same, check IDs and delete records that have matching IDs
 	length := gjson.GetBytes(recordsJSON, "#").Int()
 	// iterator for tracking index after deletes in json occur
@@ -262,7 +681,7 @@ func (p *LightningPoller) removeAlreadyQueriedRecords(recordsJSON []byte, queryW
 			// remove the record from the json if it is. if the
 			// LastModifiedDate does not match, then the record must have
 			// been updated again, so reprocess it.
-			currentRecordTimestamp, recordTimestampErr := getRecordsLastModifiedDate(correctedIterator, newRecordsJSON)
+			currentRecordTimestamp, recordTimestampErr := p.getRecordsLastModifiedDate(correctedIterator, newRecordsJSON)
 			if recordTimestampErr != nil {
 				err = recordTimestampErr
 				return
@@ -270,7 +689,7 @@ func (p *LightningPoller) removeAlreadyQueriedRecords(recordsJSON []byte, queryW
 			if recordsPreviousLastModifiedDate.Equal(currentRecordTimestamp) {
 				newRecordsJSON, err = sjson.DeleteBytes(newRecordsJSON, fmt.Sprintf("%d", correctedIterator))
 				if err != nil {
-					errorutils.LogOnErr(nil, "error removing record from json", err)
+					p.logOnErr("error removing record from json", err)
 					return
 				}
 				// decrement corrected iterator when a record is removed
@@ -281,40 +700,90 @@ func (p *LightningPoller) removeAlreadyQueriedRecords(recordsJSON []byte, queryW
 		correctedIterator++
 	}
 	newRecordsLength := gjson.GetBytes(newRecordsJSON, "#").Int()
-	logging.Log.WithFields(logrus.Fields{
+	p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{
 		"queried_records_total": length,
 		"new_records_total":     newRecordsLength,
-		"persistence_key":       queryWithCallback.PersistenceKey,
 	}).Debug("removed already queried records")
 	return
 }
 
-func (p *LightningPoller) updatePosition(key string, response pkg.SoqlResponse, recordsJSON []byte) error {
-	newPosition, err := getPositionFromResult(response, recordsJSON, *p.positions[key])
+func (p *LightningPoller) updatePosition(ctx context.Context, key string, response pkg.SoqlResponse, recordsJSON []byte) error {
+	previousPosition := *p.getCurrentPosition(key)
+	newPosition, err := p.getPositionFromResult(response, recordsJSON, previousPosition)
 	if err != nil {
 		return err
 	}
-	p.positions[key] = &newPosition
+	p.setCurrentPosition(key, &newPosition)
+	if positionAdvanced(previousPosition, newPosition) {
+		p.recordProgress(key)
+	}
 	// update saved position if persistence is enabled
 	if p.config.PersistenceEnabled {
-		err := p.setPosition(key, newPosition)
+		if !p.assigned(key) {
+			// another replica may have advanced the saved position
+			return ErrLeaseLost
+		}
+		err := p.savePolledPosition(ctx, key, newPosition)
 		if err != nil {
 			return err
 		}
 	}
-	logging.Log.WithFields(logrus.Fields{"lastModifiedDate": newPosition.LastModifiedDate, "persistence_key": key}).Debug("updated position")
+	p.queryLogger(key).WithFields(logrus.Fields{"lastModifiedDate": newPosition.LastModifiedDate}).Debug("updated position")
 	return nil
 }
 
 // saveNextRecordsURL saves the nextRecordsURL from a response to the current
 // position without overriding the last queried records
 func (p *LightningPoller) saveNextRecordsURL(url string, queryWithCallback QueryWithCallback) {
-	p.positions[queryWithCallback.PersistenceKey].NextURL = url
+	position := *p.getCurrentPosition(queryWithCallback.PersistenceKey)
+	position.NextURL = url
+	p.setCurrentPosition(queryWithCallback.PersistenceKey, &position)
+}
+
+// getCurrentPosition returns the in memory position for a key. positions are
+// replaced rather than modified so that they can be read while a query is
+// running, so the returned position must not be modified
+func (p *LightningPoller) getCurrentPosition(key string) *Position {
+	p.positionsMu.Lock()
+	defer p.positionsMu.Unlock()
+	return p.positions[key]
+}
+
+// setCurrentPosition replaces the in memory position for a key
+func (p *LightningPoller) setCurrentPosition(key string, position *Position) {
+	p.positionsMu.Lock()
+	defer p.positionsMu.Unlock()
+	p.positions[key] = position
+}
+
+// copyCurrentPositions returns a copy of the in memory positions map
+func (p *LightningPoller) copyCurrentPositions() map[string]*Position {
+	p.positionsMu.Lock()
+	defer p.positionsMu.Unlock()
+	positions := make(map[string]*Position, len(p.positions))
+	for key, position := range p.positions {
+		positions[key] = position
+	}
+	return positions
+}
+
+// positionAdvanced checks whether a new position is further along than the
+// previous one, either with a later last modified date, or with more
+// previously queried records at the same last modified date. pages of records
+// that all have the same last modified date only advance the record IDs
+func positionAdvanced(previous, next Position) bool {
+	if next.LastModifiedDate == nil {
+		return false
+	}
+	if previous.LastModifiedDate == nil || next.LastModifiedDate.After(*previous.LastModifiedDate) {
+		return true
+	}
+	return next.LastModifiedDate.Equal(*previous.LastModifiedDate) && len(next.PreviousRecordIDs) > len(previous.PreviousRecordIDs)
 }
 
-func getPositionFromResult(response pkg.SoqlResponse, recordsJSON []byte, previousPosition Position) (position Position, err error) {
+func (p *LightningPoller) getPositionFromResult(response pkg.SoqlResponse, recordsJSON []byte, previousPosition Position) (position Position, err error) {
 	// save last modified timestamp from last record in response
-	timestamp, timestampErr := getFinalLastModifiedDateFromJSON(recordsJSON)
+	timestamp, timestampErr := p.getFinalLastModifiedDateFromJSON(recordsJSON)
 	if timestampErr != nil {
 		err = timestampErr
 		return
@@ -329,13 +798,16 @@ func getPositionFromResult(response pkg.SoqlResponse, recordsJSON []byte, previo
 	// that occurs if the response from salesforce changes as a result of
 	// eventual consistency
 	if previousPosition.LastModifiedDate != nil && previousPosition.LastModifiedDate.Equal(timestamp) {
-		lastQueriedIDs = previousPosition.PreviousRecordIDs
+		// copy the previous IDs, the previous position must not be modified
+		for id, recordTimestamp := range previousPosition.PreviousRecordIDs {
+			lastQueriedIDs[id] = recordTimestamp
+		}
 	}
 
 	gjsonIDresult := gjson.GetBytes(recordsJSON, "#.Id").Array()
 	for i, result := range gjsonIDresult {
 		id := result.String()
-		recordTimestamp, recordTimestampErr := getRecordsLastModifiedDate(i, recordsJSON)
+		recordTimestamp, recordTimestampErr := p.getRecordsLastModifiedDate(i, recordsJSON)
 		if recordTimestampErr != nil {
 			err = recordTimestampErr
 			return
@@ -347,133 +819,45 @@ func getPositionFromResult(response pkg.SoqlResponse, recordsJSON []byte, previo
 	return
 }
 
-func getRecordsLastModifiedDate(recordPosition int, recordsJSON []byte) (lastModifiedDate time.Time, err error) {
+func (p *LightningPoller) getRecordsLastModifiedDate(recordPosition int, recordsJSON []byte) (lastModifiedDate time.Time, err error) {
 	path := fmt.Sprintf("%d.LastModifiedDate", recordPosition)
 	lastModifiedDateString := gjson.GetBytes(recordsJSON, path).String()
 	if lastModifiedDateString == "" {
-		logging.Log.WithFields(logrus.Fields{"json": string(recordsJSON)}).Debug("could not retrieve final last modified date from records json")
+		p.logger.WithFields(logrus.Fields{"json": string(recordsJSON)}).Debug("could not retrieve final last modified date from records json")
 		return lastModifiedDate, errors.New("could not retrieve final last modified date from records")
 	}
 	return getTimestampFromResultLastModifiedDate(lastModifiedDateString)
 }
 
-func getFinalLastModifiedDateFromJSON(recordsJSON []byte) (time.Time, error) {
+func (p *LightningPoller) getFinalLastModifiedDateFromJSON(recordsJSON []byte) (time.Time, error) {
 	numRecords := gjson.GetBytes(recordsJSON, "#").Int()
 	finalArrayIndex := numRecords - 1
-	return getRecordsLastModifiedDate(int(finalArrayIndex), recordsJSON)
-}
-
-// initConfig reads in config file and ENV variables if set.
-func initConfig(queries []QueryWithCallback, startFrom *time.Time, startFromExclusions []string) (*RunConfig, error) {
-	var cfgFile string
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := os.UserHomeDir()
-		cobra.CheckErr(err)
-
-		// Search config in home directory with name ".salesforce-lightning-poller" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigType("yaml")
-		viper.SetConfigName(".salesforce-lightning-poller")
-	}
-	// If a config file is found, read it in.
-	err := viper.ReadInConfig()
-	if err == nil {
-		logging.Log.WithField("file", viper.ConfigFileUsed()).Info("Using config file")
-	}
-	// setup env vars
-	viper.SetEnvPrefix("LP")
-	viper.AutomaticEnv() // read in environment variables that match
-	viper.SetDefault("grant_type", "password")
-	viper.SetDefault("poll_interval", "10s")
-	viper.SetDefault("last_modified_date_correction_duration", "5m")
-	viper.SetDefault("persistence_enabled", false)
-	viper.SetDefault("skip_dependency_check", false)
-	viper.SetDefault("persistence_path", ".")
-	viper.SetDefault("api_version", "54.0")
-	viper.SetDefault("startup_position_overrides", "")
-	var startupPositionOverrides map[string]time.Time
-	if startFrom != nil {
-		startupPositionOverrides = getStartupPositionOverridesFromTimeIgnoringHistory(queries, *startFrom, startFromExclusions)
-	} else {
-		startupPositionOverrides, err = stringToTimeMap(viper.GetString("startup_position_overrides"))
-		if err != nil {
-			return nil, errorx.Decorate(err, "error initializing config, unable to parse startup_position_override")
-		}
-	}
-	logging.Log.WithFields(logrus.Fields{"startupPositionOverrides": startupPositionOverrides}).Debug("startup position overrides")
-	config := &RunConfig{
-		Queries:                            queries,
-		Ticker:                             time.NewTicker(viper.GetDuration("poll_interval")),
-		PersistenceEnabled:                 viper.GetBool("persistence_enabled"),
-		PersistencePath:                    viper.GetString("persistence_path"),
-		StartupPositionOverrides:           startupPositionOverrides,
-		LastModifiedDateCorrectionDuration: viper.GetDuration("last_modified_date_correction_duration"),
-		SkipDependencyCheck:                viper.GetBool("skip_dependency_check"),
-	}
-	theValidator := validator.New()
-	err = theValidator.Struct(config)
-	if err != nil {
-		errs := []error{}
-		for _, err := range err.(validator.ValidationErrors) {
-			errs = append(errs, errorx.IllegalArgument.New("invalid configuration: %s is a required configuration", err.Field()))
-		}
-		return nil, errorx.DecorateMany("error initializing config", errs...)
-	}
-	return config, nil
+	return p.getRecordsLastModifiedDate(int(finalArrayIndex), recordsJSON)
 }
 
-func getStartupPositionOverridesFromTimeIgnoringHistory(queries []QueryWithCallback, startFrom time.Time, exclusions []string) map[string]time.Time {
-	overrides := make(map[string]time.Time)
-	for _, query := range queries {
-		key := query.PersistenceKey
-		if lo.Contains(exclusions, key) {
-			// skip any persistence keys that are excluded
-			continue
-		}
-		overrides[query.PersistenceKey] = startFrom
-	}
-	return overrides
-}
-
-func stringToTimeMap(i string) (o map[string]time.Time, err error) {
-	o = map[string]time.Time{}
-	if i != "" {
-		stringArray := strings.Split(i, ",")
-		for _, s := range stringArray {
-			kvp := strings.Split(s, "=")
-			if len(kvp) != 2 {
-				return nil, errorx.IllegalArgument.New("string map invalid format")
-			}
-			o[kvp[0]], err = time.Parse(time.RFC3339, kvp[1])
-			if err != nil {
-				return nil, err
-			}
-		}
+func (p *LightningPoller) openPositionStore(path string) error {
+	if !p.ownsStore {
+		// the store was given with WithPositionStore
+		return nil
 	}
-	return o, nil
-}
-
-func (p *LightningPoller) openBadgerDb(path string) error {
-	db, err := badger.Open(badger.DefaultOptions(path))
-	if err != nil {
-		errorutils.LogOnErr(logging.Log.WithField("path", path), "error opening badger db", err)
-	} else {
-		p.db = db
+	store, err := OpenBadgerPositionStore(path)
+	if err == nil {
+		p.store = store
 	}
 	return err
 }
 
-func (p *LightningPoller) closeBadgerDb() {
-	err := p.db.Close()
-	errorutils.LogOnErr(nil, "error closing badger database", err)
+func (p *LightningPoller) closePositionStore() {
+	if p.store == nil || !p.ownsStore {
+		// persistence is disabled, or the store belongs to the caller
+		return
+	}
+	err := p.store.Close()
+	p.logOnErr("error closing position store", err)
 }
 
 func (p *LightningPoller) getNextRecordsURL(queryWithCallback QueryWithCallback) string {
-	return p.positions[queryWithCallback.PersistenceKey].NextURL
+	return p.getCurrentPosition(queryWithCallback.PersistenceKey).NextURL
 }
 
 // getPollQuery is used to modify the base query according to configuration.
@@ -482,7 +866,7 @@ func (p *LightningPoller) getPollQuery(queryWithCallback QueryWithCallback) (str
 	builder.WriteString(queryWithCallback.Query())
 	// query for last updated and update query based on stored timestamp
 	persistenceKey := queryWithCallback.PersistenceKey
-	currentPosition := p.positions[persistenceKey]
+	currentPosition := p.getCurrentPosition(persistenceKey)
 	operator := "where"
 	// if there's a where clause, switch the operator to and so we append a condition instead of creating one
 	if strings.Contains(strings.ToLower(builder.String()), operator) {
@@ -495,8 +879,8 @@ func (p *LightningPoller) getPollQuery(queryWithCallback QueryWithCallback) (str
 	// time from the last modified date to ensure that we don't miss any
 	// records that were passed as a result of eventual consistency or mid
 	// second updates
-	now := time.Now()
-	correctedTime := now.Add(-p.config.LastModifiedDateCorrectionDuration)
+	now := p.clock.Now()
+	correctedTime := now.Add(-p.correctionDuration(persistenceKey))
 	if lastModifiedDate.After(correctedTime) {
 		lastModifiedDate = correctedTime
 	}
@@ -511,24 +895,8 @@ func (p *LightningPoller) getPollQuery(queryWithCallback QueryWithCallback) (str
 }
 
 // getPosition fetches the persisted position. If there is none, then it initializes to zero values
-func (p *LightningPoller) getPosition(key []byte) (position *Position, err error) {
-	err = p.db.View(func(txn *badger.Txn) error {
-		item, getErr := txn.Get(key)
-		if getErr != nil {
-			return getErr
-		}
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &position)
-		})
-	})
-	if err != nil {
-		// if the key is not found, then return a new position with zero state
-		if strings.Contains(err.Error(), "Key not found") {
-			err = nil
-			position = &Position{LastModifiedDate: &time.Time{}}
-		}
-	}
-	return
+func (p *LightningPoller) getPosition(key string) (*Position, error) {
+	return p.store.Get(key)
 }
 
 func getRfcFormattedUtcTimestampString(timestamp time.Time) string {
@@ -536,70 +904,104 @@ func getRfcFormattedUtcTimestampString(timestamp time.Time) string {
 }
 
 func (p *LightningPoller) setPosition(key string, position Position) error {
-	positionBytes, err := json.Marshal(position)
-	if err != nil {
-		return err
-	}
-	err = p.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(key), positionBytes)
-	})
-	return err
+	return p.store.Set(key, position)
 }
 
-func (p *LightningPoller) reAuthenticateSFUtils() {
-	// use a mutex lock so that only one thread attempts reauthentication.
-	// return if it's locked
-	if ok := p.sfUtilsReAuthLock.TryLock(); ok {
-		defer p.sfUtilsReAuthLock.Unlock()
-		err := p.SfUtils.Authenticate()
+// ErrCallbackRejected is returned when a query's callback returns false, the
+// poll stops without advancing the position, and the page is delivered again
+// by the next poll
+var ErrCallbackRejected = errors.New("callback rejected a page of records")
+
+// deliver passes new records to the query's callback, then updates the
+// position from every record in the response if the callback succeeded. It
+// returns ErrCallbackRejected if the callback returns false
+func (p *LightningPoller) deliver(ctx context.Context, queryWithCallback QueryWithCallback, response pkg.SoqlResponse, recordsJSON, newRecordsJSON []byte, recordCount int) error {
+	var snapshots map[string]Snapshot
+	if len(queryWithCallback.WatchFields) > 0 {
+		var err error
+		newRecordsJSON, snapshots, err = p.detectChanges(queryWithCallback, newRecordsJSON)
 		if err != nil {
-			// panic if we failed, so that the service can fail and restart
-			logging.Log.WithError(err).Panic("attempted reauthenticating salesforce utils and failed")
+			return err
 		}
+		recordCount = int(gjson.GetBytes(newRecordsJSON, "#").Int())
+	}
+	if queryWithCallback.TxCallback != nil {
+		return p.deliverTx(ctx, queryWithCallback, response, recordsJSON, newRecordsJSON, recordCount, snapshots)
 	}
+	// when every record was suppressed, the position advances past them
+	// without calling the callback
+	if recordCount > 0 {
+		savePosition := p.invokeCallback(ctx, queryWithCallback, newRecordsJSON, recordCount)
+		if !savePosition {
+			return ErrCallbackRejected
+		}
+	}
+	err := p.saveSnapshots(queryWithCallback.PersistenceKey, snapshots)
+	if err != nil {
+		return err
+	}
+	p.recordDelivered(queryWithCallback.PersistenceKey, recordCount)
+	err = p.updatePosition(ctx, queryWithCallback.PersistenceKey, response, recordsJSON)
+	if err != nil {
+		p.logOnErr("error updating position", err)
+	}
+	return err
 }
 
-func (p *LightningPoller) doQuery(queryWithCallback QueryWithCallback) (bool, error) {
-	logging.Log.WithFields(logrus.Fields{"persistence_key": queryWithCallback.PersistenceKey}).Info("querying")
+func (p *LightningPoller) doQuery(ctx context.Context, queryWithCallback QueryWithCallback) (shouldQuery bool, err error) {
+	p.queryLogger(queryWithCallback.PersistenceKey).Info("querying")
+	ctx, span := startSpan(ctx, "page", queryWithCallback.PersistenceKey)
+	defer func() { endSpan(span, err) }()
 
 	// attempt to query with the NextRecordsUrl first
 	nextRecordsURL := p.getNextRecordsURL(queryWithCallback)
+	span.SetAttributes(nextURLUsedAttribute.Bool(nextRecordsURL != ""))
 	if nextRecordsURL != "" {
-		logging.Log.WithFields(logrus.Fields{"persistence_key": queryWithCallback.PersistenceKey}).Debug("using next records url")
-		nextURLResponse, err := p.SfUtils.GetNextRecords(nextRecordsURL)
+		p.queryLogger(queryWithCallback.PersistenceKey).Debug("using next records url")
+		span.SetAttributes(cursorAttribute.String(nextRecordsURL))
+		generation := p.sessionGeneration(queryWithCallback.Org)
+		nextURLResponse, err := p.getNextRecords(ctx, queryWithCallback.PersistenceKey, nextRecordsURL)
 		if err != nil {
+			if isSessionExpired(err) {
+				return p.handleSessionExpired(ctx, queryWithCallback, generation)
+			}
 			// check if the NextRecordsUrl was not valid, return and
 			// log if it was some other error
 			// TODO could check the error better than this
 			if strings.Contains(err.Error(), "INVALID_QUERY_LOCATOR") {
-				logging.Log.WithFields(logrus.Fields{
-					"persistence_key": queryWithCallback.PersistenceKey,
-				}).WithError(err).Debug("invalid query locator, resetting next records url")
+				p.queryLogger(queryWithCallback.PersistenceKey).WithError(err).Debug("invalid query locator, resetting next records url")
 				// if the query authenticator is invalid, then reset the next records url
 				p.saveNextRecordsURL("", queryWithCallback)
 				return true, nil
 			} else {
-				errorutils.LogOnErr(nil, "error getting next records", err)
+				p.logOnErr("error getting next records", err)
 				return false, err
 			}
 		}
+		p.recordPage(queryWithCallback.PersistenceKey, len(nextURLResponse.Records))
+		span.SetAttributes(pageSizeAttribute.Int(len(nextURLResponse.Records)))
 		if len(nextURLResponse.Records) > 0 {
 			recordsJSON, err := json.Marshal(nextURLResponse.Records)
 			if err != nil {
-				errorutils.LogOnErr(nil, "error marshaling soql query response", err)
+				p.logOnErr("error marshaling soql query response", err)
 				return false, err
 			}
-			var callbackErr error
-			savePosition := queryWithCallback.Callback(recordsJSON, callbackErr)
-			if savePosition {
-				positionErr := p.updatePosition(queryWithCallback.PersistenceKey, nextURLResponse, recordsJSON)
-				if positionErr != nil {
-					errorutils.LogOnErr(nil, "error updating position", positionErr)
-					return false, positionErr
-				}
+			// records that share the position's LastModifiedDate can be
+			// delivered already, when the query was run again after its
+			// first pages, such as after an invalid query locator
+			newRecordsJSON, err := p.removeAlreadyQueriedRecords(recordsJSON, queryWithCallback)
+			if err != nil {
+				return false, err
+			}
+			newRecordsLength := int(gjson.GetBytes(newRecordsJSON, "#").Int())
+			err = p.deliver(ctx, queryWithCallback, nextURLResponse, recordsJSON, newRecordsJSON, newRecordsLength)
+			if err != nil {
+				return false, err
 			}
 			p.setUpToDateQuery(nextURLResponse.Done, queryWithCallback)
-			return true, nil
+			// querying again after a last page without new records would
+			// read the same pages again
+			return newRecordsLength > 0 || !nextURLResponse.Done, nil
 		} else {
 			p.setUpToDateQuery(nextURLResponse.Done, queryWithCallback)
 			return false, nil
@@ -610,31 +1012,34 @@ func (p *LightningPoller) doQuery(queryWithCallback QueryWithCallback) (bool, er
 	// query
 	query, err := p.getPollQuery(queryWithCallback)
 	if err != nil {
-		errorutils.LogOnErr(nil, "error building query", err)
+		p.logOnErr("error building query", err)
 		return false, err
 	}
-	logging.Log.WithFields(logrus.Fields{"query": query}).Debug("query")
-	queryResponse, err := p.SfUtils.ExecuteSoqlQueryAll(query)
+	p.logger.WithFields(logrus.Fields{"query": query}).Debug("query")
+	if lastModifiedDate := p.getCurrentPosition(queryWithCallback.PersistenceKey).LastModifiedDate; lastModifiedDate != nil {
+		span.SetAttributes(cursorAttribute.String(getRfcFormattedUtcTimestampString(*lastModifiedDate)))
+	}
+	generation := p.sessionGeneration(queryWithCallback.Org)
+	queryResponse, err := p.executeSoqlQueryAll(ctx, queryWithCallback.PersistenceKey, query)
 	if err != nil {
 		// check if we failed due to an expired session
-		if strings.Contains(err.Error(), "INVALID_SESSION_ID") {
-			logging.Log.Error("salesforce query failed due to session expiration")
-			p.reAuthenticateSFUtils()
-			return true, nil
+		if isSessionExpired(err) {
+			return p.handleSessionExpired(ctx, queryWithCallback, generation)
 		}
-		errorutils.LogOnErr(nil, "error making soql query", err)
+		p.logOnErr("error making soql query", err)
 		return false, err
 	}
+	p.recordPage(queryWithCallback.PersistenceKey, len(queryResponse.Records))
+	span.SetAttributes(pageSizeAttribute.Int(len(queryResponse.Records)))
 
-	logging.Log.WithFields(logrus.Fields{
-		"persistence_key": queryWithCallback.PersistenceKey,
-		"record_count":    len(queryResponse.Records),
-		"done":            queryResponse.Done,
+	p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{
+		"record_count": len(queryResponse.Records),
+		"done":         queryResponse.Done,
 	}).Debug("got query response")
 	if len(queryResponse.Records) > 0 {
 		recordsJSON, err := json.Marshal(queryResponse.Records)
 		if err != nil {
-			errorutils.LogOnErr(nil, "error marshaling soql query response", err)
+			p.logOnErr("error marshaling soql query response", err)
 			return false, err
 		}
 		newRecordsJSON, err := p.removeAlreadyQueriedRecords(recordsJSON, queryWithCallback)
@@ -643,16 +1048,11 @@ func (p *LightningPoller) doQuery(queryWithCallback QueryWithCallback) (bool, er
 		}
 		newRecordsLength := gjson.GetBytes(newRecordsJSON, "#").Int()
 		if newRecordsLength > 0 {
-			var callbackErr error
-			savePosition := queryWithCallback.Callback(newRecordsJSON, callbackErr)
-			if savePosition {
-				// pass the original recordsJSON so that we save IDs of all of
-				// the records in the response
-				positionErr := p.updatePosition(queryWithCallback.PersistenceKey, queryResponse, recordsJSON)
-				if positionErr != nil {
-					errorutils.LogOnErr(nil, "error updating position", positionErr)
-					return false, positionErr
-				}
+			// pass the original recordsJSON so that we save IDs of all of
+			// the records in the response
+			err = p.deliver(ctx, queryWithCallback, queryResponse, recordsJSON, newRecordsJSON, int(newRecordsLength))
+			if err != nil {
+				return false, err
 			}
 			p.setUpToDateQuery(queryResponse.Done, queryWithCallback)
 			return true, nil
@@ -669,6 +1069,25 @@ func (p *LightningPoller) doQuery(queryWithCallback QueryWithCallback) (bool, er
 	return false, nil
 }
 
+// isSessionExpired checks whether a salesforce request failed because the
+// session expired
+func isSessionExpired(err error) bool {
+	return strings.Contains(err.Error(), "INVALID_SESSION_ID")
+}
+
+// handleSessionExpired reauthenticates after a request made with the given
+// session generation failed, and tells the caller to query again. The poll
+// fails if reauthentication keeps failing
+func (p *LightningPoller) handleSessionExpired(ctx context.Context, queryWithCallback QueryWithCallback, generation uint64) (bool, error) {
+	p.queryLogger(queryWithCallback.PersistenceKey).Error("salesforce query failed due to session expiration")
+	err := p.reAuthenticate(ctx, queryWithCallback.Org, generation)
+	if err != nil {
+		p.logOnErr("attempted reauthenticating salesforce utils and failed", err)
+		return false, err
+	}
+	return true, nil
+}
+
 func getTimestampFromResultLastModifiedDate(lastModifiedDate string) (timestamp time.Time, err error) {
 	return time.Parse("2006-01-02T15:04:05.000+0000", lastModifiedDate)
 }
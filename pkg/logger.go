@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is the structured logger used by the poller. Use WithLogger to
+// replace the default, which logs with the app-utils-go logrus logger
+type Logger interface {
+	WithFields(fields map[string]interface{}) Logger
+	WithError(err error) Logger
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// NewLogrusLogger adapts a logrus logger or entry to a Logger
+func NewLogrusLogger(logger logrus.FieldLogger) Logger {
+	return logrusLogger{FieldLogger: logger}
+}
+
+type logrusLogger struct {
+	logrus.FieldLogger
+}
+
+func (l logrusLogger) WithFields(fields map[string]interface{}) Logger {
+	return logrusLogger{FieldLogger: l.FieldLogger.WithFields(fields)}
+}
+
+func (l logrusLogger) WithError(err error) Logger {
+	return logrusLogger{FieldLogger: l.FieldLogger.WithError(err)}
+}
+
+func defaultLogger() Logger {
+	return NewLogrusLogger(logging.Log)
+}
+
+// logOnErr logs err with msg if err isn't nil
+func (p *LightningPoller) logOnErr(msg string, err error) {
+	if err != nil {
+		p.logger.WithError(err).Error(msg)
+	}
+}
+
+// panicOnErr logs err with msg and panics if err isn't nil
+func (p *LightningPoller) panicOnErr(msg string, err error) {
+	if err != nil {
+		p.logger.WithError(err).Error(msg)
+		panic(err)
+	}
+}
@@ -0,0 +1,225 @@
+package pkg
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "lightning_poller"
+
+// reasons that a poll was skipped, used as the reason label
+const (
+	skipReasonInProgress   = "in_progress"
+	skipReasonDependencies = "dependencies"
+	skipReasonPaused       = "paused"
+	skipReasonLease        = "lease"
+	skipReasonShard        = "shard"
+)
+
+// pollerMetrics holds the prometheus metrics for a poller. Metrics are always
+// recorded, and are exposed once they're registered with RegisterMetrics
+type pollerMetrics struct {
+	pollsStarted      *prometheus.CounterVec
+	pollsSkipped      *prometheus.CounterVec
+	pollsSucceeded    *prometheus.CounterVec
+	pollsFailed       *prometheus.CounterVec
+	recordsFetched    *prometheus.CounterVec
+	recordsDelivered  *prometheus.CounterVec
+	recordsSuppressed *prometheus.CounterVec
+	callbackDuration  *prometheus.HistogramVec
+	salesforceLatency *prometheus.HistogramVec
+}
+
+func newPollerMetrics() *pollerMetrics {
+	keyLabels := []string{"persistence_key", "org"}
+	return &pollerMetrics{
+		pollsStarted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "polls_started_total",
+			Help:      "Number of polls started",
+		}, keyLabels),
+		pollsSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "polls_skipped_total",
+			Help:      "Number of polls skipped, by reason",
+		}, []string{"persistence_key", "org", "reason"}),
+		pollsSucceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "polls_succeeded_total",
+			Help:      "Number of polls that caught up without an error",
+		}, keyLabels),
+		pollsFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "polls_failed_total",
+			Help:      "Number of polls that ended with an error",
+		}, keyLabels),
+		recordsFetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "records_fetched_total",
+			Help:      "Number of records fetched from salesforce, before already queried records are removed",
+		}, keyLabels),
+		recordsDelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "records_delivered_total",
+			Help:      "Number of records acknowledged by the callback, after already queried records are removed",
+		}, keyLabels),
+		recordsSuppressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "records_suppressed_total",
+			Help:      "Number of records not delivered because their watched fields didn't change",
+		}, keyLabels),
+		callbackDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "callback_duration_seconds",
+			Help:      "Time spent in the callback",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}, keyLabels),
+		salesforceLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "salesforce_request_duration_seconds",
+			Help:      "Latency of salesforce requests, by request type",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"persistence_key", "org", "request"}),
+	}
+}
+
+func (m *pollerMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.pollsStarted,
+		m.pollsSkipped,
+		m.pollsSucceeded,
+		m.pollsFailed,
+		m.recordsFetched,
+		m.recordsDelivered,
+		m.recordsSuppressed,
+		m.callbackDuration,
+		m.salesforceLatency,
+	}
+}
+
+// deleteKey removes every series for a persistence key, for queries that
+// have been removed
+func (m *pollerMetrics) deleteKey(key string) {
+	for _, collector := range m.collectors() {
+		if vec, ok := collector.(interface {
+			DeletePartialMatch(labels prometheus.Labels) int
+		}); ok {
+			vec.DeletePartialMatch(prometheus.Labels{"persistence_key": key})
+		}
+	}
+}
+
+// WithRegisterer enables metrics and registers them with registerer, such as
+// prometheus.DefaultRegisterer, instead of a registry of the poller's own
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(p *LightningPoller) error {
+		p.config.MetricsEnabled = true
+		p.registerer = registerer
+		return nil
+	}
+}
+
+// newMetricsRegistry creates the registry of a poller that isn't given a
+// registerer, with the go and process metrics the default registry has, so
+// that several pollers can run in one process
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}
+
+// MetricsHandler serves the metrics that were registered when metrics were
+// enabled, which the admin api serves on /metrics. It serves nothing if the
+// registerer given with WithRegisterer can't be gathered from
+func (p *LightningPoller) MetricsHandler() http.Handler {
+	gatherer, ok := p.registerer.(prometheus.Gatherer)
+	if !ok {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+// RegisterMetrics registers the poller's prometheus metrics with registerer.
+// Setting LP_METRICS_ENABLED registers them with a registry of the poller's
+// own, see MetricsHandler
+func (p *LightningPoller) RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range append(p.metrics.collectors(), &stateCollector{poller: p}) {
+		err := registerer.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *LightningPoller) observeSkip(key, reason string) {
+	p.metrics.pollsSkipped.WithLabelValues(key, p.orgOf(key), reason).Inc()
+}
+
+func (p *LightningPoller) observeSalesforceRequest(key, request string, start time.Time) {
+	p.metrics.salesforceLatency.WithLabelValues(key, p.orgOf(key), request).Observe(p.clock.Now().Sub(start).Seconds())
+}
+
+var (
+	lagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "replication_lag_seconds"),
+		"How far the query is behind salesforce, the time between now and the last modified date of its position, or zero once it's caught up",
+		[]string{"persistence_key", "org"}, nil,
+	)
+	previousRecordIDsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "previous_record_ids"),
+		"Number of previously queried record ids held in the query's position",
+		[]string{"persistence_key", "org"}, nil,
+	)
+	upToDateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "up_to_date"),
+		"Whether the query is caught up with salesforce",
+		[]string{"persistence_key", "org"}, nil,
+	)
+	dependencyBlockedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "dependency_blocked"),
+		"Whether the query is waiting on dependencies that are not up to date",
+		[]string{"persistence_key", "org"}, nil,
+	)
+)
+
+// stateCollector reports gauges computed from the poller's state at scrape
+// time
+type stateCollector struct {
+	poller *LightningPoller
+}
+
+func (c *stateCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- lagDesc
+	descs <- previousRecordIDsDesc
+	descs <- upToDateDesc
+	descs <- dependencyBlockedDesc
+}
+
+func (c *stateCollector) Collect(metrics chan<- prometheus.Metric) {
+	now := c.poller.clock.Now()
+	for _, query := range c.poller.queries() {
+		key := query.PersistenceKey
+		metrics <- prometheus.MustNewConstMetric(lagDesc, prometheus.GaugeValue, c.poller.lag(key, now).Seconds(), key, query.Org)
+		if position := c.poller.getCurrentPosition(key); position != nil {
+			metrics <- prometheus.MustNewConstMetric(previousRecordIDsDesc, prometheus.GaugeValue, float64(len(position.PreviousRecordIDs)), key, query.Org)
+		}
+		c.poller.upToDateQueriesMu.Lock()
+		upToDate := c.poller.upToDateQueries[key]
+		c.poller.upToDateQueriesMu.Unlock()
+		metrics <- prometheus.MustNewConstMetric(upToDateDesc, prometheus.GaugeValue, boolToFloat(upToDate), key, query.Org)
+		blocked := !c.poller.config.SkipDependencyCheck && !c.poller.dependenciesUpToDate(query)
+		metrics <- prometheus.MustNewConstMetric(dependencyBlockedDesc, prometheus.GaugeValue, boolToFloat(blocked), key, query.Org)
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package pkg_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newMetricsPoller(t *testing.T, server *pollertest.Server, options ...lp.Option) *lp.LightningPoller {
+	t.Helper()
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	poller, err := lp.New(append([]lp.Option{lp.WithSalesforceClient(server.Client()), lp.WithQueries(query)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return poller
+}
+
+func TestPollersInOneProcessHaveTheirOwnMetrics(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("LP_METRICS_ENABLED", "true")
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now().Add(-time.Hour), "Name": "Acme"})
+	for i := 0; i < 2; i++ {
+		poller := newMetricsPoller(t, server, lp.WithEnvConfig())
+		recorder := httptest.NewRecorder()
+		poller.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := io.ReadAll(recorder.Body)
+		if !strings.Contains(string(body), `lightning_poller_polls_started_total{org="",persistence_key="Accounts"} 1`) {
+			t.Fatalf("expected poller %d to serve its own metrics, got %s", i, body)
+		}
+	}
+}
+
+func TestWithRegistererRegistersMetricsWithTheRegisterer(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	registry := prometheus.NewRegistry()
+	newMetricsPoller(t, server, lp.WithRegisterer(registry))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "lightning_poller_polls_started_total" {
+			return
+		}
+	}
+	t.Fatalf("expected the poller's metrics in the registry, got %d families", len(families))
+}
@@ -0,0 +1,360 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+	"github.com/joomcode/errorx"
+)
+
+// AuthFlow is an oauth flow for authenticating with salesforce
+type AuthFlow string
+
+const (
+	// AuthFlowPassword authenticates as a user with their password
+	AuthFlowPassword AuthFlow = "password"
+	// AuthFlowJWTBearer authenticates as a user with an assertion signed by
+	// the connected app's private key, without a password
+	AuthFlowJWTBearer AuthFlow = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	// AuthFlowClientCredentials authenticates as the connected app's run as
+	// user with its client id and secret. It requires a my domain
+	AuthFlowClientCredentials AuthFlow = "client_credentials"
+)
+
+const (
+	defaultJWTAudience   = "https://login.salesforce.com"
+	defaultTokenLifetime = 2 * time.Hour
+	defaultRefreshBefore = 5 * time.Minute
+	// jwtLifetime is how long a JWT bearer assertion is valid for, salesforce
+	// rejects assertions that expire more than 3 minutes after they're sent
+	jwtLifetime = 3 * time.Minute
+)
+
+// AuthConfig configures an OAuthClient
+type AuthConfig struct {
+	Flow AuthFlow
+	// Domain is the domain to authenticate with, such as
+	// mydomain.my.salesforce.com. A url with a scheme can be used instead
+	Domain       string
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+	// PrivateKey is the PEM encoded RSA private key of the connected app's
+	// certificate, used to sign JWT bearer assertions
+	PrivateKey []byte
+	// Audience is the aud claim of JWT bearer assertions, defaults to
+	// https://login.salesforce.com. Use https://test.salesforce.com for
+	// sandboxes
+	Audience   string
+	APIVersion string
+	// TokenLifetime is how long an access token lasts when the token response
+	// doesn't say, which should match the org's session timeout. Defaults to
+	// 2h
+	TokenLifetime time.Duration
+	// RefreshBefore is how long before an access token expires that it's
+	// refreshed, defaults to 5m
+	RefreshBefore time.Duration
+	HTTPClient    *http.Client
+	// Clock tells the client the time, to sign assertions and refresh tokens.
+	// Defaults to the system clock, the poller gives clients it creates its
+	// own clock
+	Clock Clock
+}
+
+// OAuthClient is a salesforce REST client that authenticates with the
+// password, JWT bearer or client credentials flow, and refreshes its access
+// token before it expires. It implements SalesforceClient and PageSizeClient
+type OAuthClient struct {
+	config     AuthConfig
+	baseURL    string
+	privateKey *rsa.PrivateKey
+	// refreshMu is held while authenticating, so that only one request
+	// refreshes an expiring token and the others wait for it
+	refreshMu   *sync.Mutex
+	tokenMu     *sync.Mutex
+	accessToken string
+	instanceURL string
+	expiresAt   time.Time
+}
+
+// NewOAuthClient creates a client from config. It doesn't authenticate until
+// Authenticate is called or the first request is made
+func NewOAuthClient(config AuthConfig) (*OAuthClient, error) {
+	client := &OAuthClient{config: config, refreshMu: &sync.Mutex{}, tokenMu: &sync.Mutex{}}
+	if config.Domain == "" || config.ClientID == "" {
+		return nil, errorx.IllegalArgument.New("invalid auth configuration: domain and client id are required")
+	}
+	switch config.Flow {
+	case AuthFlowPassword:
+		if config.ClientSecret == "" || config.Username == "" || config.Password == "" {
+			return nil, errorx.IllegalArgument.New("invalid auth configuration: the password flow requires a client secret, username and password")
+		}
+	case AuthFlowJWTBearer:
+		if config.Username == "" {
+			return nil, errorx.IllegalArgument.New("invalid auth configuration: the jwt bearer flow requires a username")
+		}
+		privateKey, err := parseRSAPrivateKey(config.PrivateKey)
+		if err != nil {
+			return nil, errorx.Decorate(err, "invalid auth configuration: the jwt bearer flow requires an RSA private key")
+		}
+		client.privateKey = privateKey
+	case AuthFlowClientCredentials:
+		if config.ClientSecret == "" {
+			return nil, errorx.IllegalArgument.New("invalid auth configuration: the client credentials flow requires a client secret")
+		}
+	default:
+		return nil, errorx.IllegalArgument.New("invalid auth configuration: unsupported flow %q", config.Flow)
+	}
+	client.baseURL = config.Domain
+	if !strings.Contains(client.baseURL, "://") {
+		client.baseURL = "https://" + client.baseURL
+	}
+	if client.config.Audience == "" {
+		client.config.Audience = defaultJWTAudience
+	}
+	if client.config.APIVersion == "" {
+		client.config.APIVersion = "54.0"
+	}
+	if client.config.TokenLifetime <= 0 {
+		client.config.TokenLifetime = defaultTokenLifetime
+	}
+	if client.config.RefreshBefore <= 0 {
+		client.config.RefreshBefore = defaultRefreshBefore
+	}
+	if client.config.HTTPClient == nil {
+		client.config.HTTPClient = http.DefaultClient
+	}
+	if client.config.Clock == nil {
+		client.config.Clock = systemClock{}
+	}
+	return client, nil
+}
+
+// ParseAuthFlow parses a grant type, accepting jwt and jwt_bearer as short
+// names for the JWT bearer flow
+func ParseAuthFlow(grantType string) (AuthFlow, error) {
+	switch strings.ToLower(grantType) {
+	case "", string(AuthFlowPassword):
+		return AuthFlowPassword, nil
+	case "jwt", "jwt_bearer", string(AuthFlowJWTBearer):
+		return AuthFlowJWTBearer, nil
+	case string(AuthFlowClientCredentials):
+		return AuthFlowClientCredentials, nil
+	}
+	return "", errorx.IllegalArgument.New("unsupported grant type %q", grantType)
+}
+
+// Authenticate gets a new access token
+func (c *OAuthClient) Authenticate() error {
+	form := url.Values{"grant_type": {string(c.config.Flow)}}
+	switch c.config.Flow {
+	case AuthFlowPassword:
+		form.Set("client_id", c.config.ClientID)
+		form.Set("client_secret", c.config.ClientSecret)
+		form.Set("username", c.config.Username)
+		form.Set("password", c.config.Password)
+	case AuthFlowJWTBearer:
+		assertion, err := c.jwtAssertion(c.config.Clock.Now())
+		if err != nil {
+			return errorx.Decorate(err, "error signing jwt assertion")
+		}
+		form.Set("assertion", assertion)
+	case AuthFlowClientCredentials:
+		form.Set("client_id", c.config.ClientID)
+		form.Set("client_secret", c.config.ClientSecret)
+	}
+	requested := c.config.Clock.Now()
+	response, err := c.config.HTTPClient.PostForm(c.baseURL+"/services/oauth2/token", form)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error authenticating, status %d: %s", response.StatusCode, body)
+	}
+	token := struct {
+		AccessToken string      `json:"access_token"`
+		InstanceURL string      `json:"instance_url"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}{}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return err
+	}
+	if token.AccessToken == "" || token.InstanceURL == "" {
+		return fmt.Errorf("error authenticating, the token response is missing an access token or instance url: %s", body)
+	}
+	lifetime := c.config.TokenLifetime
+	if seconds, parseErr := token.ExpiresIn.Int64(); parseErr == nil && seconds > 0 {
+		lifetime = time.Duration(seconds) * time.Second
+	}
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.accessToken = token.AccessToken
+	c.instanceURL = token.InstanceURL
+	// the token's lifetime starts when it was requested rather than at its
+	// issued_at, which is salesforce's time rather than the client's clock
+	c.expiresAt = requested.Add(lifetime)
+	return nil
+}
+
+// ExpiresAt returns when the current access token is expected to expire, or
+// the zero time before the client has authenticated
+func (c *OAuthClient) ExpiresAt() time.Time {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.expiresAt
+}
+
+// ExecuteSoqlQueryAll runs a query, including deleted and archived records
+func (c *OAuthClient) ExecuteSoqlQueryAll(query string) (pkg.SoqlResponse, error) {
+	path := fmt.Sprintf("/services/data/v%s/queryAll?q=%s", c.config.APIVersion, url.QueryEscape(query))
+	return c.get(path, nil)
+}
+
+// ExecuteSoqlQueryAllWithPageSize runs a query, asking for pages of pageSize
+// records with the Sforce-Query-Options header
+func (c *OAuthClient) ExecuteSoqlQueryAllWithPageSize(query string, pageSize int) (pkg.SoqlResponse, error) {
+	path := fmt.Sprintf("/services/data/v%s/queryAll?q=%s", c.config.APIVersion, url.QueryEscape(query))
+	return c.get(path, http.Header{"Sforce-Query-Options": {fmt.Sprintf("batchSize=%d", pageSize)}})
+}
+
+// GetNextRecords gets the next page of a query from its next records url
+func (c *OAuthClient) GetNextRecords(nextRecordsURL string) (pkg.SoqlResponse, error) {
+	return c.get(nextRecordsURL, nil)
+}
+
+// refreshIfExpiring authenticates if the client hasn't authenticated yet, or
+// its access token is about to expire
+func (c *OAuthClient) refreshIfExpiring() error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	c.tokenMu.Lock()
+	refresh := c.accessToken == "" || c.config.Clock.Now().After(c.expiresAt.Add(-c.config.RefreshBefore))
+	c.tokenMu.Unlock()
+	if !refresh {
+		return nil
+	}
+	return c.Authenticate()
+}
+
+// SObjectField is a field of a salesforce object, from its describe metadata
+type SObjectField struct {
+	Name string `json:"name"`
+	// Type is the salesforce field type, such as string, boolean, double or
+	// datetime
+	Type string `json:"type"`
+}
+
+// Describe gets the fields of a salesforce object, such as Account
+func (c *OAuthClient) Describe(sobject string) ([]SObjectField, error) {
+	description := struct {
+		Fields []SObjectField `json:"fields"`
+	}{}
+	path := fmt.Sprintf("/services/data/v%s/sobjects/%s/describe", c.config.APIVersion, url.PathEscape(sobject))
+	err := c.getJSON(path, nil, &description)
+	return description.Fields, err
+}
+
+func (c *OAuthClient) get(path string, header http.Header) (pkg.SoqlResponse, error) {
+	result := pkg.SoqlResponse{}
+	err := c.getJSON(path, header, &result)
+	return result, err
+}
+
+// getJSON makes an authenticated request and parses the response into result
+func (c *OAuthClient) getJSON(path string, header http.Header, result any) error {
+	err := c.refreshIfExpiring()
+	if err != nil {
+		return err
+	}
+	c.tokenMu.Lock()
+	base, token := c.instanceURL, c.accessToken
+	c.tokenMu.Unlock()
+	request, err := http.NewRequest(http.MethodGet, base+path, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := c.config.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		// salesforce errors include the error code, such as
+		// INVALID_SESSION_ID, which the poller checks for
+		return fmt.Errorf("salesforce request failed with status %d: %s", response.StatusCode, body)
+	}
+	return json.Unmarshal(body, result)
+}
+
+// jwtAssertion signs a JWT bearer assertion for the configured user
+func (c *OAuthClient) jwtAssertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": c.config.ClientID,
+		"sub": c.config.Username,
+		"aud": c.config.Audience,
+		"exp": now.Add(jwtLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey parses a PEM encoded PKCS1 or PKCS8 RSA private key
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errorx.IllegalArgument.New("private key isn't PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errorx.IllegalArgument.New("private key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
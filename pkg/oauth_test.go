@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+// timerClock is a fakeClock that records waits and advances past them instead
+// of sleeping
+type timerClock struct {
+	fakeClock
+	waits []time.Duration
+}
+
+func (c *timerClock) After(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	c.advance(d)
+	fired := make(chan time.Time, 1)
+	fired <- c.Now()
+	return fired
+}
+
+func TestOAuthClientRefreshesItsTokenByThePollersClock(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now().Add(-time.Hour), "Name": "Acme"})
+	clock := &fakeClock{now: time.Now()}
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	poller, err := New(WithAuthConfig(AuthConfig{
+		Flow:          AuthFlowClientCredentials,
+		Domain:        server.URL,
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		TokenLifetime: time.Hour,
+		RefreshBefore: 5 * time.Minute,
+	}), WithClock(clock), WithQueries(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount("token"); n != 1 {
+		t.Fatalf("expected the token to be reused before it expires, got %d token requests", n)
+	}
+	// the system clock hasn't moved, only the poller's clock is close to the
+	// token's expiry
+	clock.advance(56 * time.Minute)
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server.RequestCount("token"); n != 2 {
+		t.Fatalf("expected the token to be refreshed by the poller's clock, got %d token requests", n)
+	}
+}
+
+func TestReauthenticationBacksOffWithTheClock(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	clock := &timerClock{fakeClock: fakeClock{now: time.Now()}}
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	poller, err := New(WithSalesforceClient(server.Client()), WithClock(clock), WithQueries(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.config.ReauthBackoff = time.Hour
+	server.FailAuth(500, 500)
+	err = poller.reAuthenticate(context.Background(), "", poller.sessionGeneration(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clock.waits) != 2 || clock.waits[0] != time.Hour || clock.waits[1] != 2*time.Hour {
+		t.Fatalf("expected backoffs of 1h and 2h on the clock, got %v", clock.waits)
+	}
+}
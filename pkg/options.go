@@ -0,0 +1,239 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+)
+
+// Option configures a poller created with New or NewLightningPoller. Options
+// are applied in order, so later options override earlier ones
+type Option func(p *LightningPoller) error
+
+// Clock tells the poller the time. Use WithClock to replace the system clock,
+// for example with a fake clock in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// TimerClock is a Clock that can also wait. Backoffs wait with it when the
+// poller's clock implements it, so that a fake clock can skip them
+type TimerClock interface {
+	Clock
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// after waits for d with the poller's clock if it can wait, or the system
+// clock if it can't
+func (p *LightningPoller) after(d time.Duration) <-chan time.Time {
+	if clock, ok := p.clock.(TimerClock); ok {
+		return clock.After(d)
+	}
+	return time.After(d)
+}
+
+// SalesforceClient is the subset of salesforce-utils that the poller uses.
+// *pkg.SalesforceUtils is the default implementation
+type SalesforceClient interface {
+	ExecuteSoqlQueryAll(query string) (pkg.SoqlResponse, error)
+	GetNextRecords(url string) (pkg.SoqlResponse, error)
+	Authenticate() error
+}
+
+// WithLogger logs with logger instead of the app-utils-go logrus logger
+func WithLogger(logger Logger) Option {
+	return func(p *LightningPoller) error {
+		p.logger = logger
+		return nil
+	}
+}
+
+// WithClock reads the time from clock instead of the system clock, including
+// the token expiry of OAuthClients the poller creates. Backoffs and the
+// watchdog wait with clock if it's a TimerClock. The poll ticker still uses
+// the system clock
+func WithClock(clock Clock) Option {
+	return func(p *LightningPoller) error {
+		p.clock = clock
+		return nil
+	}
+}
+
+// WithSalesforceClient queries salesforce with client instead of creating
+// salesforce-utils from the salesforce config, which also skips the initial
+// authentication. SfUtils is nil when this is set
+func WithSalesforceClient(client SalesforceClient) Option {
+	return func(p *LightningPoller) error {
+		p.client = client
+		return nil
+	}
+}
+
+// WithSalesforceConfig creates salesforce-utils from config, which
+// authenticates when the poller is created
+func WithSalesforceConfig(config pkg.Config) Option {
+	return func(p *LightningPoller) error {
+		p.sfConfig = &config
+		p.authConfig = nil
+		return nil
+	}
+}
+
+// WithAuthConfig queries salesforce with an OAuthClient created from config,
+// which supports the JWT bearer and client credentials flows and refreshes
+// its token before it expires. It authenticates when the poller is created
+func WithAuthConfig(config AuthConfig) Option {
+	return func(p *LightningPoller) error {
+		p.authConfig = &config
+		return nil
+	}
+}
+
+// WithQueries adds queries to the poller
+func WithQueries(queries ...QueryWithCallback) Option {
+	return func(p *LightningPoller) error {
+		p.config.Queries = append(p.config.Queries, queries...)
+		return nil
+	}
+}
+
+// WithPollInterval sets how often queries are polled
+func WithPollInterval(interval time.Duration) Option {
+	return func(p *LightningPoller) error {
+		p.config.PollInterval = interval
+		return nil
+	}
+}
+
+// WithPersistence persists positions in a badger database in path
+func WithPersistence(path string) Option {
+	return func(p *LightningPoller) error {
+		p.config.PersistenceEnabled = true
+		p.config.PersistencePath = path
+		return nil
+	}
+}
+
+// WithPositionStore persists positions in store instead of badger. The poller
+// doesn't close stores that it's given
+func WithPositionStore(store PositionStore) Option {
+	return func(p *LightningPoller) error {
+		p.config.PersistenceEnabled = true
+		p.store = store
+		return nil
+	}
+}
+
+// WithSnapshotStore keeps the snapshots of queries with WatchFields in store
+// instead of badger at LP_SNAPSHOT_PATH. The poller doesn't close stores that
+// it's given
+func WithSnapshotStore(store SnapshotStore) Option {
+	return func(p *LightningPoller) error {
+		p.snapshots = store
+		return nil
+	}
+}
+
+// WithLastModifiedDateCorrection sets how far before the current time a query
+// that has caught up queries from, to catch records that become visible late
+func WithLastModifiedDateCorrection(correction time.Duration) Option {
+	return func(p *LightningPoller) error {
+		p.config.LastModifiedDateCorrectionDuration = correction
+		return nil
+	}
+}
+
+// WithStartupPositionOverrides starts the given persistence keys from a time,
+// ignoring their saved positions
+func WithStartupPositionOverrides(overrides map[string]time.Time) Option {
+	return func(p *LightningPoller) error {
+		p.config.StartupPositionOverrides = overrides
+		return nil
+	}
+}
+
+// WithStartFrom starts every query from startFrom, ignoring saved positions,
+// except for the persistence keys in exclusions. It's a no-op when startFrom is
+// nil
+func WithStartFrom(startFrom *time.Time, exclusions []string) Option {
+	return func(p *LightningPoller) error {
+		p.startFrom = startFrom
+		p.startFromExclusions = exclusions
+		return nil
+	}
+}
+
+// WithSkipDependencyCheck polls queries without waiting for their
+// dependencies to catch up
+func WithSkipDependencyCheck() Option {
+	return func(p *LightningPoller) error {
+		p.config.SkipDependencyCheck = true
+		return nil
+	}
+}
+
+// WithAdminAddress serves the admin api on address from Run()
+func WithAdminAddress(address string) Option {
+	return func(p *LightningPoller) error {
+		p.config.AdminAddress = address
+		return nil
+	}
+}
+
+// WithHealthAddress serves the health checks on address from Run()
+func WithHealthAddress(address string) Option {
+	return func(p *LightningPoller) error {
+		p.config.HealthAddress = address
+		return nil
+	}
+}
+
+// WithHealthThresholds sets the default thresholds for readiness to report a
+// query as degraded, zero disables them
+func WithHealthThresholds(maxConsecutiveFailures int, maxLag time.Duration) Option {
+	return func(p *LightningPoller) error {
+		p.config.HealthMaxConsecutiveFailures = maxConsecutiveFailures
+		p.config.HealthMaxLag = maxLag
+		return nil
+	}
+}
+
+// WithWatchdog sets the default thresholds for the watchdog to alert on, and
+// how often it checks them. Zero thresholds disable them
+func WithWatchdog(stallThreshold, lagAlertThreshold, interval time.Duration) Option {
+	return func(p *LightningPoller) error {
+		p.config.StallThreshold = stallThreshold
+		p.config.LagAlertThreshold = lagAlertThreshold
+		p.config.WatchdogInterval = interval
+		return nil
+	}
+}
+
+// WithReauthRetries sets how many times the poller tries to reauthenticate
+// after a session expires before failing the poll, and the backoff before
+// the first retry, which doubles after each retry
+func WithReauthRetries(maxAttempts int, backoff time.Duration) Option {
+	return func(p *LightningPoller) error {
+		p.config.ReauthMaxAttempts = maxAttempts
+		p.config.ReauthBackoff = backoff
+		return nil
+	}
+}
+
+// WithAlertHandler sends watchdog alerts to handler instead of logging them
+func WithAlertHandler(handler AlertHandler) Option {
+	return func(p *LightningPoller) error {
+		p.alertHandler = handler
+		return nil
+	}
+}
@@ -0,0 +1,338 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+	"github.com/joomcode/errorx"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// orgKeySeparator separates an org's name from the persistence keys of its
+// queries
+const orgKeySeparator = ":"
+
+// orgConnection is a named salesforce connection. Each org authenticates and
+// reauthenticates on its own, so an expired session in one org doesn't block
+// the others
+type orgConnection struct {
+	name       string
+	config     *pkg.Config
+	authConfig *AuthConfig
+	sfUtils    *pkg.SalesforceUtils
+	client     SalesforceClient
+	// reAuthLock is held while reauthenticating, and guards generation,
+	// which counts the sessions that have replaced the first one
+	reAuthLock *sync.Mutex
+	generation uint64
+}
+
+// orgConfig is an entry in the orgs section of the config file
+type orgConfig struct {
+	Name               string        `mapstructure:"name"`
+	Domain             string        `mapstructure:"domain"`
+	ClientID           string        `mapstructure:"client_id"`
+	ClientSecret       string        `mapstructure:"client_secret"`
+	Username           string        `mapstructure:"username"`
+	Password           string        `mapstructure:"password"`
+	GrantType          string        `mapstructure:"grant_type"`
+	APIVersion         string        `mapstructure:"api_version"`
+	PrivateKeyFile     string        `mapstructure:"private_key_file"`
+	JWTAudience        string        `mapstructure:"jwt_audience"`
+	TokenLifetime      time.Duration `mapstructure:"token_lifetime"`
+	TokenRefreshBefore time.Duration `mapstructure:"token_refresh_before"`
+}
+
+// OrgKey returns the persistence key that a query bound to org is tracked and
+// persisted under, such as acme:Accounts. Queries without an org keep their
+// persistence key
+func OrgKey(org, key string) string {
+	if org == "" {
+		return key
+	}
+	return org + orgKeySeparator + key
+}
+
+// WithOrg adds a named salesforce org, connecting to it with salesforce-utils
+// created from config, which authenticates when the poller is created. Bind
+// queries to it with QueryWithCallback.Org
+func WithOrg(name string, config pkg.Config) Option {
+	return func(p *LightningPoller) error {
+		return p.addOrg(&orgConnection{name: name, config: &config})
+	}
+}
+
+// WithOrgAuthConfig adds a named salesforce org that's queried with an
+// OAuthClient created from config, which authenticates when the poller is
+// created
+func WithOrgAuthConfig(name string, config AuthConfig) Option {
+	return func(p *LightningPoller) error {
+		return p.addOrg(&orgConnection{name: name, authConfig: &config})
+	}
+}
+
+// WithOrgClient adds a named salesforce org that's queried with client
+func WithOrgClient(name string, client SalesforceClient) Option {
+	return func(p *LightningPoller) error {
+		return p.addOrg(&orgConnection{name: name, client: client})
+	}
+}
+
+func (p *LightningPoller) addOrg(org *orgConnection) error {
+	if org.name == "" || strings.Contains(org.name, orgKeySeparator) {
+		return errorx.IllegalArgument.New("invalid configuration: org names are required and can't contain %q", orgKeySeparator)
+	}
+	if _, ok := p.orgs[org.name]; ok {
+		return errorx.IllegalArgument.New("invalid configuration: org %s is configured more than once", org.name)
+	}
+	org.reAuthLock = &sync.Mutex{}
+	p.orgs[org.name] = org
+	return nil
+}
+
+// Orgs returns the names of the configured orgs, not including the default
+// connection
+func (p *LightningPoller) Orgs() []string {
+	names := make([]string, 0, len(p.orgs))
+	for name := range p.orgs {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// connectOrgs creates clients for the orgs that weren't given one, and adds
+// the default connection if there is one
+func (p *LightningPoller) connectOrgs() error {
+	for name, org := range p.orgs {
+		if org.client != nil {
+			continue
+		}
+		if org.authConfig != nil {
+			client, err := connectOAuth(*org.authConfig, p.clock)
+			if err != nil {
+				return errorx.Decorate(err, "error connecting to org %s", name)
+			}
+			org.client = client
+			continue
+		}
+		sfUtils, err := pkg.NewSalesforceUtils(true, *org.config)
+		if err != nil {
+			return errorx.Decorate(err, "error connecting to org %s", name)
+		}
+		org.sfUtils = sfUtils
+		org.client = sfUtils
+	}
+	if p.client != nil {
+		p.orgs[""] = &orgConnection{client: p.client, reAuthLock: p.sfUtilsReAuthLock}
+	}
+	return nil
+}
+
+// connection returns the connection for an org, the default connection for an
+// empty org, or nil if it isn't configured
+func (p *LightningPoller) connection(org string) *orgConnection {
+	return p.orgs[org]
+}
+
+// clientFor returns the salesforce client for the query with the given
+// persistence key, which is the default client for unknown keys
+func (p *LightningPoller) clientFor(key string) SalesforceClient {
+	if connection := p.connection(p.orgOf(key)); connection != nil {
+		return connection.client
+	}
+	return p.client
+}
+
+// validateOrg checks that a query's org is configured
+func (p *LightningPoller) validateOrg(query QueryWithCallback) error {
+	if p.connection(query.Org) != nil {
+		return nil
+	}
+	if query.Org == "" {
+		return errorx.IllegalArgument.New("invalid configuration: query %s requires a salesforce client or salesforce config", query.PersistenceKey)
+	}
+	return errorx.IllegalArgument.New("invalid configuration: query %s uses org %s, which isn't configured", query.PersistenceKey, query.Org)
+}
+
+// namespaceQuery prefixes the persistence key of a query bound to an org with
+// the org's name, along with its dependencies that aren't already prefixed,
+// which are in the same org
+func namespaceQuery(query QueryWithCallback) QueryWithCallback {
+	if query.Org == "" {
+		return query
+	}
+	prefix := query.Org + orgKeySeparator
+	if !strings.HasPrefix(query.PersistenceKey, prefix) {
+		query.PersistenceKey = prefix + query.PersistenceKey
+	}
+	dependsOn := make([]string, 0, len(query.DependsOn))
+	for _, dependency := range query.DependsOn {
+		if !strings.Contains(dependency, orgKeySeparator) {
+			dependency = prefix + dependency
+		}
+		dependsOn = append(dependsOn, dependency)
+	}
+	query.DependsOn = dependsOn
+	return query
+}
+
+// orgOf returns the org of the query with the given persistence key, which is
+// empty for the default connection
+func (p *LightningPoller) orgOf(key string) string {
+	query, _ := p.getQuery(key)
+	return query.Org
+}
+
+// queryLogger returns a logger with the query's persistence key, and its org
+// if it has one
+func (p *LightningPoller) queryLogger(key string) Logger {
+	fields := logrus.Fields{"persistence_key": key}
+	if org := p.orgOf(key); org != "" {
+		fields["org"] = org
+	}
+	return p.logger.WithFields(fields)
+}
+
+// sessionGeneration returns the generation of an org's current session, which
+// is passed to reAuthenticate when a request made with it fails
+func (p *LightningPoller) sessionGeneration(org string) uint64 {
+	connection := p.connection(org)
+	connection.reAuthLock.Lock()
+	defer connection.reAuthLock.Unlock()
+	return connection.generation
+}
+
+// reAuthenticate replaces an org's session after a request made with the
+// given generation of it failed. Only one goroutine reauthenticates an org at
+// a time, the others wait for it, and return without authenticating again
+// once it has replaced the session. Failed attempts are retried with a
+// doubling backoff, up to LP_REAUTH_MAX_ATTEMPTS
+func (p *LightningPoller) reAuthenticate(ctx context.Context, org string, generation uint64) error {
+	connection := p.connection(org)
+	connection.reAuthLock.Lock()
+	defer connection.reAuthLock.Unlock()
+	if connection.generation != generation {
+		// another query already replaced the session
+		return nil
+	}
+	backoff := p.config.ReauthBackoff
+	for attempt := 1; ; attempt++ {
+		err := connection.client.Authenticate()
+		if err == nil {
+			connection.generation++
+			return nil
+		}
+		if attempt >= p.config.ReauthMaxAttempts {
+			return errorx.Decorate(err, "error reauthenticating after %d attempts", attempt)
+		}
+		logger := p.logger
+		if org != "" {
+			logger = logger.WithFields(logrus.Fields{"org": org})
+		}
+		logger.WithFields(logrus.Fields{"attempt": attempt, "backoff": backoff}).WithError(err).Warn("retrying reauthentication")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.after(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// connectOAuth creates an OAuthClient that tells the time with clock, unless
+// its config has its own, and authenticates it, failing early like
+// salesforce-utils does when it's created
+func connectOAuth(config AuthConfig, clock Clock) (*OAuthClient, error) {
+	if config.Clock == nil {
+		config.Clock = clock
+	}
+	client, err := NewOAuthClient(config)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Authenticate()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// authConfigFromSettings creates the auth config for a grant type other than
+// password, which salesforce-utils doesn't support. It returns nil for the
+// password grant type, which keeps using salesforce-utils. salesforce-utils
+// doesn't know when its token expires, so it only reauthenticates once a
+// request fails with INVALID_SESSION_ID, see reAuthenticate
+func authConfigFromSettings(config pkg.Config, privateKeyFile, audience string, lifetime, refreshBefore time.Duration) (*AuthConfig, error) {
+	flow, err := ParseAuthFlow(config.GrantType)
+	if err != nil || flow == AuthFlowPassword {
+		return nil, err
+	}
+	authConfig := &AuthConfig{
+		Flow:          flow,
+		Domain:        config.Domain,
+		ClientID:      config.ClientId,
+		ClientSecret:  config.ClientSecret,
+		Username:      config.Username,
+		APIVersion:    config.ApiVersion,
+		Audience:      audience,
+		TokenLifetime: lifetime,
+		RefreshBefore: refreshBefore,
+	}
+	if privateKeyFile != "" {
+		authConfig.PrivateKey, err = os.ReadFile(privateKeyFile)
+		if err != nil {
+			return nil, errorx.Decorate(err, "error reading private key")
+		}
+	}
+	return authConfig, nil
+}
+
+// orgsFromViper reads the orgs section of the config file
+func orgsFromViper(v *viper.Viper) ([]orgConfig, error) {
+	configs := []orgConfig{}
+	err := v.UnmarshalKey("orgs", &configs, viper.DecodeHook(mapstructure.StringToTimeDurationHookFunc()), func(config *mapstructure.DecoderConfig) {
+		config.ErrorUnused = true
+	})
+	if err != nil {
+		return nil, errorx.Decorate(err, "error parsing orgs")
+	}
+	for i, config := range configs {
+		if config.GrantType == "" {
+			configs[i].GrantType = v.GetString("grant_type")
+		}
+		if config.APIVersion == "" {
+			configs[i].APIVersion = v.GetString("api_version")
+		}
+	}
+	return configs, nil
+}
+
+func (c orgConfig) salesforceConfig() pkg.Config {
+	return pkg.Config{
+		Domain:       c.Domain,
+		ClientId:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Username:     c.Username,
+		Password:     c.Password,
+		GrantType:    c.GrantType,
+		ApiVersion:   c.APIVersion,
+	}
+}
+
+// usesDefaultConnection checks whether any query isn't bound to an org
+func (p *LightningPoller) usesDefaultConnection() bool {
+	for _, query := range p.config.Queries {
+		if query.Org == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package pkg_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/tidwall/gjson"
+)
+
+// blockingAuthClient is a client whose reauthentication waits until release
+// is closed
+type blockingAuthClient struct {
+	lp.SalesforceClient
+	authenticating chan struct{}
+	release        chan struct{}
+	once           sync.Once
+}
+
+func (c *blockingAuthClient) Authenticate() error {
+	c.once.Do(func() { close(c.authenticating) })
+	<-c.release
+	return c.SalesforceClient.Authenticate()
+}
+
+// orgDeliveries records the ids delivered for each persistence key
+type orgDeliveries struct {
+	mu  sync.Mutex
+	ids map[string][]string
+}
+
+func (d *orgDeliveries) query(org string) lp.QueryWithCallback {
+	key := lp.OrgKey(org, "Accounts")
+	return lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Org:            org,
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			for _, record := range gjson.ParseBytes(result).Array() {
+				d.ids[key] = append(d.ids[key], record.Get("Id").String())
+			}
+			return true
+		},
+	}
+}
+
+func (d *orgDeliveries) get(key string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.ids[key]...)
+}
+
+func newOrgServer(t *testing.T, id string) *pollertest.Server {
+	t.Helper()
+	server := pollertest.NewServer()
+	t.Cleanup(server.Close)
+	server.Put("Account", pollertest.Record{"Id": id, "LastModifiedDate": time.Now().Add(-time.Hour)})
+	return server
+}
+
+func TestQueriesAreRoutedToTheirOrgsClient(t *testing.T) {
+	acme, globex := newOrgServer(t, "001ACME"), newOrgServer(t, "001GLOBEX")
+	deliveries := &orgDeliveries{ids: map[string][]string{}}
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller, err := lp.New(lp.WithOrgClient("acme", acme.Client()), lp.WithOrgClient("globex", globex.Client()),
+		lp.WithQueries(deliveries.query("acme"), deliveries.query("globex")), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for org, expected := range map[string]string{"acme": "001ACME", "globex": "001GLOBEX"} {
+		key := lp.OrgKey(org, "Accounts")
+		if ids := deliveries.get(key); len(ids) != 1 || ids[0] != expected {
+			t.Fatalf("expected %s to deliver %s from its org, got %v", key, expected, ids)
+		}
+		state, err := poller.QueryState(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Org != org {
+			t.Fatalf("expected %s to report its org, got %q", key, state.Org)
+		}
+		position, err := store.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if position.LastModifiedDate == nil || position.LastModifiedDate.IsZero() {
+			t.Fatalf("expected the position of %s to be persisted under its org key", key)
+		}
+	}
+	if _, err = poller.QueryState("Accounts"); err == nil {
+		t.Fatal("expected the unprefixed key not to be tracked")
+	}
+}
+
+func TestReauthenticatingAnOrgDoesntBlockTheOthers(t *testing.T) {
+	acme, globex := newOrgServer(t, "001ACME"), newOrgServer(t, "001GLOBEX")
+	acmeClient := &blockingAuthClient{SalesforceClient: acme.Client(), authenticating: make(chan struct{}), release: make(chan struct{})}
+	deliveries := &orgDeliveries{ids: map[string][]string{}}
+	poller, err := lp.New(lp.WithOrgClient("acme", acmeClient), lp.WithOrgClient("globex", globex.Client()),
+		lp.WithQueries(deliveries.query("acme"), deliveries.query("globex")), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// acme's session expires after it's authenticated
+	err = acmeClient.SalesforceClient.Authenticate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme.ExpireSession()
+	done := make(chan error, 1)
+	go func() {
+		_, err := poller.RunOnce(context.Background())
+		done <- err
+	}()
+	select {
+	case <-acmeClient.authenticating:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected acme to reauthenticate")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deliveries.get("globex:Accounts")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected globex to keep polling while acme reauthenticates")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids := deliveries.get("acme:Accounts"); len(ids) != 0 {
+		t.Fatalf("expected acme to wait for its session, got %v", ids)
+	}
+	close(acmeClient.release)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the run to finish once acme reauthenticated")
+	}
+	if ids := deliveries.get("acme:Accounts"); len(ids) != 1 || ids[0] != "001ACME" {
+		t.Fatalf("expected acme to deliver once reauthenticated, got %v", ids)
+	}
+}
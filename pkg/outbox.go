@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+	"github.com/joomcode/errorx"
+)
+
+// TxPositionStore is a PositionStore in a database that records can be
+// written to in the same transaction as the position, for queries with a
+// TxCallback
+type TxPositionStore interface {
+	PositionStore
+	// BeginTx starts a transaction in the store's database
+	BeginTx(ctx context.Context) (*sql.Tx, error)
+	// SetTx saves a position in tx
+	SetTx(ctx context.Context, tx *sql.Tx, key string, position Position) error
+}
+
+// FencedTxPositionStore is a TxPositionStore that can fence positions saved
+// in a transaction, see FencedPositionStore
+type FencedTxPositionStore interface {
+	TxPositionStore
+	// SetTxFenced is SetFenced in tx
+	SetTxFenced(ctx context.Context, tx *sql.Tx, key string, position Position, lease Lease) error
+}
+
+// deliverTx passes new records to the query's TxCallback and saves the
+// position in the same transaction, so that a crash either keeps both or
+// neither, and records are never delivered twice. The in memory position is
+// only advanced once the transaction commits, followed by the snapshots of
+// records with watched fields
+func (p *LightningPoller) deliverTx(ctx context.Context, queryWithCallback QueryWithCallback, response pkg.SoqlResponse, recordsJSON, newRecordsJSON []byte, recordCount int, snapshots map[string]Snapshot) (err error) {
+	key := queryWithCallback.PersistenceKey
+	ctx, span := startSpan(ctx, "callback", key, recordCountAttribute.Int(recordCount))
+	defer func() { endSpan(span, err) }()
+	previousPosition := *p.getCurrentPosition(key)
+	newPosition, err := p.getPositionFromResult(response, recordsJSON, previousPosition)
+	if err != nil {
+		return err
+	}
+	store := p.store.(TxPositionStore)
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		return errorx.Decorate(err, "error starting transaction")
+	}
+	defer func() {
+		if err != nil {
+			p.logOnErr("error rolling back transaction", tx.Rollback())
+		}
+	}()
+	if recordCount > 0 {
+		start := p.clock.Now()
+		err = queryWithCallback.TxCallback(ctx, tx, newRecordsJSON)
+		p.metrics.callbackDuration.WithLabelValues(key, queryWithCallback.Org).Observe(p.clock.Now().Sub(start).Seconds())
+		if err != nil {
+			return errorx.Decorate(err, "error in transactional callback")
+		}
+	}
+	lease, leased := LeaseFromContext(ctx)
+	if fenced, ok := store.(FencedTxPositionStore); ok && leased {
+		err = fenced.SetTxFenced(ctx, tx, key, newPosition, lease)
+		p.loseFencedLease(lease, err)
+	} else {
+		err = store.SetTx(ctx, tx, key, newPosition)
+	}
+	if errors.Is(err, ErrLeaseLost) {
+		return err
+	}
+	if err != nil {
+		return errorx.Decorate(err, "error saving position")
+	}
+	if !p.assigned(key) {
+		// another replica may have advanced the saved position
+		return ErrLeaseLost
+	}
+	err = tx.Commit()
+	if err != nil {
+		return errorx.Decorate(err, "error committing transaction")
+	}
+	// the records are committed, so a failure to save their snapshots only
+	// means they're compared with older snapshots next time
+	p.logOnErr("error saving snapshots", p.saveSnapshots(key, snapshots))
+	p.recordDelivered(key, recordCount)
+	p.setCurrentPosition(key, &newPosition)
+	if positionAdvanced(previousPosition, newPosition) {
+		p.recordProgress(key)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+	"github.com/fsnotify/fsnotify"
+	"github.com/joomcode/errorx"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// salesforce's limits on the batch size of a query
+const (
+	minPageSize = 200
+	maxPageSize = 2000
+)
+
+// QueryOverride overrides the settings of a single persistence key. Zero
+// values keep the query's own settings
+type QueryOverride struct {
+	// Interval overrides QueryWithCallback.Interval
+	Interval time.Duration `mapstructure:"interval" json:"interval,omitempty"`
+	// LastModifiedDateCorrectionDuration overrides
+	// LP_LAST_MODIFIED_DATE_CORRECTION_DURATION
+	LastModifiedDateCorrectionDuration time.Duration `mapstructure:"last_modified_date_correction_duration" json:"last_modified_date_correction_duration,omitempty"`
+	// PageSize asks salesforce for pages of this many records, between 200
+	// and 2000. The salesforce client must implement PageSizeClient
+	PageSize int `mapstructure:"page_size" json:"page_size,omitempty"`
+	// Retry retries failed pages within a poll, instead of waiting for the
+	// next poll
+	Retry *RetryPolicy `mapstructure:"retry" json:"retry,omitempty"`
+	// Paused pauses the query, see Pause. Changing it resumes or pauses the
+	// query, even if it was paused or resumed with the admin api
+	Paused bool `mapstructure:"paused" json:"paused,omitempty"`
+	// StartFrom starts the query from this time when positions are loaded,
+	// unless the persistence key has a startup position override or a saved
+	// position. Changing it while the poller is running moves the query's
+	// position once
+	StartFrom *time.Time `mapstructure:"start_from" json:"start_from,omitempty"`
+}
+
+// RetryPolicy retries a failed page up to MaxAttempts times in total, waiting
+// Backoff before the first retry and doubling it before each retry after that
+type RetryPolicy struct {
+	MaxAttempts int           `mapstructure:"max_attempts" json:"max_attempts"`
+	Backoff     time.Duration `mapstructure:"backoff" json:"backoff"`
+}
+
+// PageSizeClient is implemented by salesforce clients that can set the page
+// size of a query, which salesforce calls the batch size
+type PageSizeClient interface {
+	ExecuteSoqlQueryAllWithPageSize(query string, pageSize int) (pkg.SoqlResponse, error)
+}
+
+// queryOverrideConfig is an entry in the query_overrides section of the
+// config file. Overrides are a list rather than a map because viper lowercases
+// map keys, and persistence keys are case sensitive
+type queryOverrideConfig struct {
+	PersistenceKey string `mapstructure:"persistence_key"`
+	QueryOverride  `mapstructure:",squash"`
+}
+
+// WithQueryOverrides sets overrides by persistence key
+func WithQueryOverrides(overrides map[string]QueryOverride) Option {
+	return func(p *LightningPoller) error {
+		p.queryOverrides = overrides
+		return nil
+	}
+}
+
+// QueryOverrides returns a copy of the current overrides by persistence key
+func (p *LightningPoller) QueryOverrides() map[string]QueryOverride {
+	p.queryOverridesMu.Lock()
+	defer p.queryOverridesMu.Unlock()
+	overrides := make(map[string]QueryOverride, len(p.queryOverrides))
+	for key, override := range p.queryOverrides {
+		overrides[key] = override
+	}
+	return overrides
+}
+
+// SetQueryOverrides replaces every override. Invalid overrides are rejected
+// and the current ones are kept. Pausing and start positions are applied
+// immediately, everything else applies to the next poll or page. Changing the
+// start_from of a query that's polling fails with ErrQueryInProgress, without
+// changing anything, pause the query first
+func (p *LightningPoller) SetQueryOverrides(overrides map[string]QueryOverride) error {
+	err := p.validateQueryOverrides(overrides)
+	if err != nil {
+		return err
+	}
+	p.queryOverridesMu.Lock()
+	previous := p.queryOverrides
+	p.queryOverridesMu.Unlock()
+	// queries that move to a new start_from are locked before anything
+	// changes, so that one that's polling rejects the whole change
+	moving := []QueryWithCallback{}
+	if _, _, positionsLoaded := p.lifecycle.snapshot(); positionsLoaded {
+		moving = p.startFromChanges(previous, overrides)
+	}
+	locked := []QueryWithCallback{}
+	defer func() {
+		for _, query := range locked {
+			p.unlockInProgressQuery(query)
+		}
+	}()
+	for _, query := range moving {
+		if p.checkInProgressAndLock(query) {
+			return fmt.Errorf("error moving %s to its start_from override: %w", query.PersistenceKey, ErrQueryInProgress)
+		}
+		locked = append(locked, query)
+	}
+	for _, query := range moving {
+		startFrom := *overrides[query.PersistenceKey].StartFrom
+		err = p.replaceLockedPosition(query, func(Position) Position {
+			return NewPositionAt(startFrom)
+		})
+		if err != nil {
+			return fmt.Errorf("error moving %s to its start_from override: %w", query.PersistenceKey, err)
+		}
+	}
+	p.queryOverridesMu.Lock()
+	p.queryOverrides = overrides
+	p.queryOverridesMu.Unlock()
+	p.applyPausedOverrides(previous, overrides)
+	return nil
+}
+
+func (p *LightningPoller) getQueryOverride(key string) QueryOverride {
+	p.queryOverridesMu.Lock()
+	defer p.queryOverridesMu.Unlock()
+	return p.queryOverrides[key]
+}
+
+func (p *LightningPoller) validateQueryOverrides(overrides map[string]QueryOverride) error {
+	errs := []error{}
+	for key, override := range overrides {
+		if _, ok := p.getQuery(key); !ok {
+			// overrides can be declared before the query exists
+			p.queryLogger(key).Warn("override for unknown persistence key")
+		}
+		if override.Interval < 0 || override.LastModifiedDateCorrectionDuration < 0 {
+			errs = append(errs, errorx.IllegalArgument.New("invalid override for %s: durations can't be negative", key))
+		}
+		if override.PageSize != 0 {
+			if override.PageSize < minPageSize || override.PageSize > maxPageSize {
+				errs = append(errs, errorx.IllegalArgument.New("invalid override for %s: page size must be between %d and %d", key, minPageSize, maxPageSize))
+			}
+			if _, ok := p.clientFor(key).(PageSizeClient); !ok {
+				errs = append(errs, errorx.IllegalArgument.New("invalid override for %s: the salesforce client doesn't support page sizes", key))
+			}
+		}
+		if override.Retry != nil && (override.Retry.MaxAttempts < 1 || override.Retry.Backoff < 0) {
+			errs = append(errs, errorx.IllegalArgument.New("invalid override for %s: retry requires at least one attempt and a backoff that isn't negative", key))
+		}
+	}
+	if len(errs) > 0 {
+		return errorx.DecorateMany("invalid query overrides", errs...)
+	}
+	return nil
+}
+
+// startFromChanges returns the queries whose start_from override is set to a
+// new time
+func (p *LightningPoller) startFromChanges(previous, next map[string]QueryOverride) []QueryWithCallback {
+	queries := []QueryWithCallback{}
+	for key, override := range next {
+		query, ok := p.getQuery(key)
+		if !ok || override.StartFrom == nil || !p.assigned(key) {
+			// the replica that polls the query moves it
+			continue
+		}
+		if before := previous[key].StartFrom; before == nil || !before.Equal(*override.StartFrom) {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// applyPausedOverrides pauses or resumes queries when their paused override
+// changes
+func (p *LightningPoller) applyPausedOverrides(previous, next map[string]QueryOverride) {
+	for key, override := range next {
+		if _, ok := p.getQuery(key); !ok {
+			continue
+		}
+		if override.Paused != previous[key].Paused {
+			if override.Paused {
+				p.logOnErr("error pausing query from override", p.Pause(key))
+			} else {
+				p.logOnErr("error resuming query from override", p.Resume(key))
+			}
+		}
+	}
+	for key, override := range previous {
+		if _, ok := next[key]; !ok && override.Paused {
+			p.logOnErr("error resuming query from override", p.Resume(key))
+		}
+	}
+}
+
+// queryInterval returns how often a query is polled
+func (p *LightningPoller) queryInterval(queryWithCallback QueryWithCallback) time.Duration {
+	if interval := p.getQueryOverride(queryWithCallback.PersistenceKey).Interval; interval > 0 {
+		return interval
+	}
+	return queryWithCallback.Interval
+}
+
+// correctionDuration returns how far back a query that's caught up queries
+// from
+func (p *LightningPoller) correctionDuration(key string) time.Duration {
+	if correction := p.getQueryOverride(key).LastModifiedDateCorrectionDuration; correction > 0 {
+		return correction
+	}
+	return p.config.LastModifiedDateCorrectionDuration
+}
+
+// doQueryWithRetry runs doQuery, retrying it if the query has a retry policy
+func (p *LightningPoller) doQueryWithRetry(ctx context.Context, queryWithCallback QueryWithCallback) (shouldQuery bool, err error) {
+	policy := p.getQueryOverride(queryWithCallback.PersistenceKey).Retry
+	backoff := time.Duration(0)
+	if policy != nil {
+		backoff = policy.Backoff
+	}
+	for attempt := 1; ; attempt++ {
+		shouldQuery, err = p.doQuery(ctx, queryWithCallback)
+		if err == nil || errors.Is(err, ErrLeaseLost) || policy == nil || attempt >= policy.MaxAttempts {
+			return
+		}
+		p.queryLogger(queryWithCallback.PersistenceKey).WithFields(logrus.Fields{"attempt": attempt, "backoff": backoff}).WithError(err).Warn("retrying page")
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-p.after(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// queryOverridesFromViper reads the query_overrides section of the config
+// file, rejecting unknown fields and duplicate persistence keys
+func queryOverridesFromViper(v *viper.Viper) (map[string]QueryOverride, error) {
+	configs := []queryOverrideConfig{}
+	err := v.UnmarshalKey("query_overrides", &configs, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToTimeHookFunc(time.RFC3339),
+	)), func(config *mapstructure.DecoderConfig) {
+		config.ErrorUnused = true
+	})
+	if err != nil {
+		return nil, errorx.Decorate(err, "error parsing query_overrides")
+	}
+	overrides := make(map[string]QueryOverride, len(configs))
+	for _, config := range configs {
+		if config.PersistenceKey == "" {
+			return nil, errorx.IllegalArgument.New("invalid query_overrides: persistence_key is required")
+		}
+		if _, ok := overrides[config.PersistenceKey]; ok {
+			return nil, errorx.IllegalArgument.New("invalid query_overrides: %s is overridden more than once", config.PersistenceKey)
+		}
+		overrides[config.PersistenceKey] = config.QueryOverride
+	}
+	return overrides, nil
+}
+
+// watchConfig reloads query overrides when the config file changes. Reloads
+// that can't be read or are invalid are logged and the current overrides are
+// kept
+func (p *LightningPoller) watchConfig() {
+	v := viper.New()
+	v.SetConfigFile(p.configFileUsed)
+	v.OnConfigChange(func(event fsnotify.Event) {
+		p.reloadConfig()
+	})
+	p.logger.WithFields(logrus.Fields{"file": p.configFileUsed}).Info("watching config file")
+	v.WatchConfig()
+}
+
+func (p *LightningPoller) reloadConfig() {
+	logger := p.logger.WithFields(logrus.Fields{"file": p.configFileUsed})
+	v, err := newEnvViper(p.config, p.configFileUsed)
+	if err == nil {
+		var overrides map[string]QueryOverride
+		overrides, err = queryOverridesFromViper(v)
+		if err == nil {
+			err = p.SetQueryOverrides(overrides)
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Error("rejected config reload, keeping the current config")
+		return
+	}
+	logger.Info("reloaded config")
+}
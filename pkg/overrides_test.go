@@ -0,0 +1,147 @@
+package pkg_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/tidwall/gjson"
+)
+
+func TestSetQueryOverridesKeepsTheOverridesWhenAQueryIsPolling(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	delivering, release := make(chan struct{}), make(chan struct{})
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			close(delivering)
+			<-release
+			return true
+		},
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := poller.RunOnce(context.Background())
+		done <- err
+	}()
+	<-delivering
+	startFrom := lastModifiedDate.Add(-24 * time.Hour)
+	err = poller.SetQueryOverrides(map[string]lp.QueryOverride{"Accounts": {StartFrom: &startFrom, Paused: true}})
+	if !errors.Is(err, lp.ErrQueryInProgress) {
+		t.Fatalf("expected ErrQueryInProgress, got %v", err)
+	}
+	if override := poller.QueryOverrides()["Accounts"]; override.StartFrom != nil || override.Paused {
+		t.Fatalf("expected the previous overrides to be kept, got %+v", override)
+	}
+	close(release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	// once the poll has finished, the same change moves the position
+	err = poller.SetQueryOverrides(map[string]lp.QueryOverride{"Accounts": {StartFrom: &startFrom}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := poller.QueryState("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastModifiedDate == nil || !state.LastModifiedDate.Equal(startFrom) {
+		t.Fatalf("expected the position at %s, got %v", startFrom, state.LastModifiedDate)
+	}
+}
+
+func TestStartFromOnlyAppliesWithoutASavedPosition(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account",
+		pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate.Add(-time.Minute), "Name": "Acme"},
+		pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate, "Name": "Beta"})
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	startFrom := lastModifiedDate.Add(-24 * time.Hour)
+	delivered := 0
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			delivered += len(gjson.ParseBytes(result).Array())
+			return true
+		},
+	}
+	// each run is a restart of the poller with the same config
+	for run := 1; run <= 2; run++ {
+		poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0),
+			lp.WithQueryOverrides(map[string]lp.QueryOverride{"Accounts": {StartFrom: &startFrom}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = poller.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivered != 2 {
+		t.Fatalf("expected the restart to resume from the saved position, got %d records delivered", delivered)
+	}
+}
+
+// plainClient hides the page size support of the client it wraps
+type plainClient struct {
+	lp.SalesforceClient
+}
+
+func TestPageSizeOverrideIsIgnoredForClientsWithoutPageSizes(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Lead", pollertest.Record{"Id": "00QA", "LastModifiedDate": time.Now().Add(-time.Hour), "Name": "Acme"})
+	key := lp.OrgKey("other", "Leads")
+	accounts := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	// the override is validated against the default client, which supports
+	// page sizes, before the query exists
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithOrgClient("other", plainClient{server.Client()}), lp.WithQueries(accounts), lp.WithLastModifiedDateCorrection(0),
+		lp.WithQueryOverrides(map[string]lp.QueryOverride{key: {PageSize: 200}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := 0
+	err = poller.AddQuery(lp.QueryWithCallback{
+		PersistenceKey: "Leads",
+		Org:            "other",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Lead" },
+		Callback: func(result []byte, err error) bool {
+			delivered += len(gjson.ParseBytes(result).Array())
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered != 1 {
+		t.Fatalf("expected the lead to be queried without a page size, got %d records delivered", delivered)
+	}
+}
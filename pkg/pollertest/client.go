@@ -0,0 +1,119 @@
+package pollertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+)
+
+// Client is a minimal salesforce REST client that implements the poller's
+// SalesforceClient interface. It authenticates with the password grant before
+// its first request, after that the poller reauthenticates when a session
+// expires
+type Client struct {
+	BaseURL    string
+	APIVersion string
+	HTTPClient *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	instanceURL string
+}
+
+// NewClient creates a client for the salesforce api at baseURL
+func NewClient(baseURL, apiVersion string) *Client {
+	return &Client{BaseURL: baseURL, APIVersion: apiVersion, HTTPClient: http.DefaultClient}
+}
+
+// Authenticate gets a new access token
+func (c *Client) Authenticate() error {
+	form := url.Values{"grant_type": {"password"}, "client_id": {"pollertest"}, "username": {"pollertest"}, "password": {"pollertest"}}
+	response, err := c.HTTPClient.PostForm(c.BaseURL+"/services/oauth2/token", form)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("error authenticating, status %d: %s", response.StatusCode, body)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		InstanceURL string `json:"instance_url"`
+	}{}
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessToken = token.AccessToken
+	c.instanceURL = token.InstanceURL
+	return nil
+}
+
+// ExecuteSoqlQueryAll runs a query, including deleted and archived records
+func (c *Client) ExecuteSoqlQueryAll(query string) (pkg.SoqlResponse, error) {
+	path := fmt.Sprintf("/services/data/v%s/queryAll?q=%s", c.APIVersion, url.QueryEscape(query))
+	return c.get(path, nil)
+}
+
+// ExecuteSoqlQueryAllWithPageSize runs a query, asking for pages of pageSize
+// records with the Sforce-Query-Options header
+func (c *Client) ExecuteSoqlQueryAllWithPageSize(query string, pageSize int) (pkg.SoqlResponse, error) {
+	path := fmt.Sprintf("/services/data/v%s/queryAll?q=%s", c.APIVersion, url.QueryEscape(query))
+	return c.get(path, http.Header{"Sforce-Query-Options": {fmt.Sprintf("batchSize=%d", pageSize)}})
+}
+
+// GetNextRecords gets the next page of a query from its next records url
+func (c *Client) GetNextRecords(nextRecordsURL string) (pkg.SoqlResponse, error) {
+	return c.get(nextRecordsURL, nil)
+}
+
+func (c *Client) get(path string, header http.Header) (pkg.SoqlResponse, error) {
+	result := pkg.SoqlResponse{}
+	c.mu.Lock()
+	authenticated := c.accessToken != ""
+	c.mu.Unlock()
+	if !authenticated {
+		err := c.Authenticate()
+		if err != nil {
+			return result, err
+		}
+	}
+	c.mu.Lock()
+	base, token := c.instanceURL, c.accessToken
+	c.mu.Unlock()
+	request, err := http.NewRequest(http.MethodGet, base+path, nil)
+	if err != nil {
+		return result, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return result, err
+	}
+	if response.StatusCode != http.StatusOK {
+		// salesforce errors include the error code, such as
+		// INVALID_SESSION_ID, which the poller checks for
+		return result, fmt.Errorf("salesforce request failed with status %d: %s", response.StatusCode, body)
+	}
+	err = json.Unmarshal(body, &result)
+	return result, err
+}
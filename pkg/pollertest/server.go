@@ -0,0 +1,451 @@
+// Package pollertest provides a fake salesforce REST api for testing pollers
+// and their callbacks end to end without a real org.
+//
+//	server := pollertest.NewServer()
+//	defer server.Close()
+//	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now(), "Name": "Acme"})
+//	poller, err := pkg.NewLightningPoller(queries, pkg2.Config{}, nil, nil, pkg.WithSalesforceClient(server.Client()))
+//
+// The server evaluates the object and the LastModifiedDate >= predicate that
+// the poller appends to queries, orders records by LastModifiedDate and Id,
+// and pages them with next records urls. Select lists and any other where
+// conditions are ignored, every field of a record is returned.
+package pollertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPageSize is the number of records returned per page, like
+// salesforce's default batch size
+const DefaultPageSize = 2000
+
+// DefaultAPIVersion is the api version used in the server's urls
+const DefaultAPIVersion = "54.0"
+
+// grantTypeJWTBearer is the grant type of the JWT bearer flow, which requires
+// an assertion
+const grantTypeJWTBearer = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// salesforce error codes returned by the fake
+const (
+	ErrorCodeInvalidSession       = "INVALID_SESSION_ID"
+	ErrorCodeInvalidQueryLocator  = "INVALID_QUERY_LOCATOR"
+	ErrorCodeMalformedQuery       = "MALFORMED_QUERY"
+	ErrorCodeServerUnavailable    = "SERVER_UNAVAILABLE"
+	ErrorCodeRequestLimitExceeded = "REQUEST_LIMIT_EXCEEDED"
+	ErrorCodeNotFound             = "NOT_FOUND"
+	ErrorCodeUnknownException     = "UNKNOWN_EXCEPTION"
+)
+
+// errorCode returns the error code salesforce responds with for a status
+func errorCode(status int) string {
+	switch {
+	case status == http.StatusBadRequest:
+		return ErrorCodeMalformedQuery
+	case status == http.StatusUnauthorized:
+		return ErrorCodeInvalidSession
+	case status == http.StatusForbidden:
+		return ErrorCodeRequestLimitExceeded
+	case status == http.StatusNotFound:
+		return ErrorCodeNotFound
+	case status == http.StatusServiceUnavailable:
+		return ErrorCodeServerUnavailable
+	default:
+		return ErrorCodeUnknownException
+	}
+}
+
+// lastModifiedDateFormat is the format salesforce uses for datetime fields
+const lastModifiedDateFormat = "2006-01-02T15:04:05.000+0000"
+
+// Record is a salesforce object. It must have an Id, and a LastModifiedDate as
+// a time.Time
+type Record map[string]interface{}
+
+func (r Record) id() string {
+	id, _ := r["Id"].(string)
+	return id
+}
+
+func (r Record) lastModifiedDate() time.Time {
+	lastModifiedDate, _ := r["LastModifiedDate"].(time.Time)
+	return lastModifiedDate
+}
+
+// storedRecord is a record in the object table
+type storedRecord struct {
+	record Record
+	// hidden records aren't returned by queries until they're revealed, to
+	// simulate records that become visible after later records
+	hidden bool
+}
+
+// cursor holds the remaining records of a query for its next records url
+type cursor struct {
+	object    string
+	records   []Record
+	totalSize int
+	pageSize  int
+}
+
+// Server is a fake salesforce REST api, serving oauth tokens, queries and
+// next records urls over an in-memory object table
+type Server struct {
+	*httptest.Server
+	APIVersion string
+
+	mu           sync.Mutex
+	objects      map[string]map[string]*storedRecord
+	pageSize     int
+	token        int
+	cursors      map[string]*cursor
+	nextLocator  int
+	failures     []int
+	reorderTies  bool
+	requestCount map[string]int
+	// authFailures are the statuses of the next token requests to fail, and
+	// grantTypes are the grant types of every token request
+	authFailures []int
+	grantTypes   []string
+}
+
+// NewServer starts a fake salesforce server. Close it when you're done
+func NewServer() *Server {
+	s := &Server{
+		APIVersion:   DefaultAPIVersion,
+		objects:      map[string]map[string]*storedRecord{},
+		pageSize:     DefaultPageSize,
+		token:        1,
+		cursors:      map[string]*cursor{},
+		requestCount: map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/oauth2/token", s.serveToken)
+	mux.HandleFunc("/services/data/", s.serveData)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns a salesforce client for the server, which can be passed to
+// pkg.WithSalesforceClient
+func (s *Server) Client() *Client {
+	return NewClient(s.URL, s.APIVersion)
+}
+
+// Put inserts or replaces records of an object by their Id
+func (s *Server) Put(object string, records ...Record) {
+	s.put(object, false, records)
+}
+
+// PutHidden inserts or replaces records that aren't returned by queries until
+// they're revealed. Use it to simulate eventual consistency, where a record
+// becomes visible after records with a later LastModifiedDate
+func (s *Server) PutHidden(object string, records ...Record) {
+	s.put(object, true, records)
+}
+
+func (s *Server) put(object string, hidden bool, records []Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table := s.table(object)
+	for _, record := range records {
+		table[record.id()] = &storedRecord{record: record, hidden: hidden}
+	}
+}
+
+// Reveal makes hidden records visible to queries
+func (s *Server) Reveal(object string, ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table := s.table(object)
+	for _, id := range ids {
+		if stored, ok := table[id]; ok {
+			stored.hidden = false
+		}
+	}
+}
+
+// Delete removes records of an object by their Id
+func (s *Server) Delete(object string, ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table := s.table(object)
+	for _, id := range ids {
+		delete(table, id)
+	}
+}
+
+// SetPageSize sets how many records are returned per page, unless a query asks
+// for a batch size
+func (s *Server) SetPageSize(pageSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pageSize = pageSize
+}
+
+// ExpireSession invalidates the current access token, so that requests fail
+// with INVALID_SESSION_ID until the client authenticates again
+func (s *Server) ExpireSession() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token++
+}
+
+// InvalidateQueryLocators invalidates every outstanding next records url, so
+// that they fail with INVALID_QUERY_LOCATOR
+func (s *Server) InvalidateQueryLocators() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors = map[string]*cursor{}
+}
+
+// FailNext makes the next query or next records requests respond with the
+// given statuses, in order, and the error code salesforce uses for each: 503
+// is SERVER_UNAVAILABLE, 401 INVALID_SESSION_ID, 403 REQUEST_LIMIT_EXCEEDED,
+// 400 MALFORMED_QUERY, 404 NOT_FOUND and anything else UNKNOWN_EXCEPTION. For
+// example FailNext(503, 503) fails the next two requests as unavailable
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// FailAuth makes the next token requests respond with the given statuses, in
+// order, for testing reauthentication retries
+func (s *Server) FailAuth(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authFailures = append(s.authFailures, statuses...)
+}
+
+// GrantTypes returns the grant type of every token request, in order
+func (s *Server) GrantTypes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.grantTypes...)
+}
+
+// ReorderTies returns records that share a LastModifiedDate in descending Id
+// order instead of ascending, to simulate salesforce returning records in a
+// different order between queries
+func (s *Server) ReorderTies(reorder bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reorderTies = reorder
+}
+
+// RequestCount returns how many requests have been made to an endpoint, one
+// of "token", "query" or "next_records"
+func (s *Server) RequestCount(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestCount[endpoint]
+}
+
+// table returns the records of an object, object names are case insensitive
+// like in soql. s.mu must be held
+func (s *Server) table(object string) map[string]*storedRecord {
+	object = strings.ToLower(object)
+	if s.objects[object] == nil {
+		s.objects[object] = map[string]*storedRecord{}
+	}
+	return s.objects[object]
+}
+
+func (s *Server) accessToken() string {
+	return fmt.Sprintf("fake-token-%d", s.token)
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "token requests must be posts")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("grant_type") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type", "error_description": "grant type not supported"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestCount["token"]++
+	grantType := r.PostForm.Get("grant_type")
+	s.grantTypes = append(s.grantTypes, grantType)
+	if len(s.authFailures) > 0 {
+		status := s.authFailures[0]
+		s.authFailures = s.authFailures[1:]
+		writeJSON(w, status, map[string]string{"error": "invalid_grant", "error_description": http.StatusText(status)})
+		return
+	}
+	if grantType == grantTypeJWTBearer && r.PostForm.Get("assertion") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "missing assertion"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": s.accessToken(),
+		"instance_url": s.URL,
+		"id":           s.URL + "/id/00D000000000000AAA/005000000000000AAA",
+		"token_type":   "Bearer",
+		"issued_at":    fmt.Sprintf("%d", time.Now().UnixMilli()),
+		"signature":    "fake",
+	})
+}
+
+func (s *Server) serveData(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := fmt.Sprintf("/services/data/v%s/", s.APIVersion)
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	if path == r.URL.Path {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "the requested resource does not exist")
+		return
+	}
+	endpoint := "query"
+	if strings.HasPrefix(path, "query/") || strings.HasPrefix(path, "queryAll/") {
+		endpoint = "next_records"
+	} else if path != "query" && path != "queryAll" {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "the requested resource does not exist")
+		return
+	}
+	s.requestCount[endpoint]++
+	if r.Header.Get("Authorization") != "Bearer "+s.accessToken() {
+		writeError(w, http.StatusUnauthorized, ErrorCodeInvalidSession, "Session expired or invalid")
+		return
+	}
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, status, errorCode(status), http.StatusText(status))
+		return
+	}
+	if endpoint == "next_records" {
+		locator := path[strings.Index(path, "/")+1:]
+		s.serveNextRecords(w, locator)
+		return
+	}
+	s.serveQuery(w, r.URL.Query().Get("q"), batchSize(r.Header.Get("Sforce-Query-Options"), s.pageSize))
+}
+
+func (s *Server) serveQuery(w http.ResponseWriter, soql string, pageSize int) {
+	query, err := parseQuery(soql)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeMalformedQuery, err.Error())
+		return
+	}
+	records := []Record{}
+	for _, stored := range s.table(query.object) {
+		if stored.hidden {
+			continue
+		}
+		if query.since != nil && stored.record.lastModifiedDate().Before(*query.since) {
+			continue
+		}
+		records = append(records, stored.record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].lastModifiedDate(), records[j].lastModifiedDate()
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		if s.reorderTies {
+			return records[i].id() > records[j].id()
+		}
+		return records[i].id() < records[j].id()
+	})
+	if query.limit > 0 && len(records) > query.limit {
+		records = records[:query.limit]
+	}
+	s.writePage(w, &cursor{object: query.object, records: records, totalSize: len(records), pageSize: pageSize})
+}
+
+func (s *Server) serveNextRecords(w http.ResponseWriter, locator string) {
+	remaining, ok := s.cursors[locator]
+	if !ok {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidQueryLocator, "invalid query locator")
+		return
+	}
+	delete(s.cursors, locator)
+	s.writePage(w, remaining)
+}
+
+// writePage writes the first page of the cursor's records, saving the rest
+// behind a next records url
+func (s *Server) writePage(w http.ResponseWriter, results *cursor) {
+	page := results.records
+	response := queryResponse{TotalSize: results.totalSize, Done: true}
+	if len(page) > results.pageSize {
+		s.nextLocator++
+		locator := fmt.Sprintf("01gFAKE%08d-%d", s.nextLocator, results.pageSize)
+		s.cursors[locator] = &cursor{object: results.object, records: page[results.pageSize:], totalSize: results.totalSize, pageSize: results.pageSize}
+		page = page[:results.pageSize]
+		response.Done = false
+		response.NextRecordsURL = fmt.Sprintf("/services/data/v%s/query/%s", s.APIVersion, locator)
+	}
+	response.Records = make([]map[string]interface{}, 0, len(page))
+	for _, record := range page {
+		response.Records = append(response.Records, s.recordJSON(results.object, record))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// batchSize reads the page size from a Sforce-Query-Options header such as
+// batchSize=500, which applies to every page of the query
+func batchSize(queryOptions string, defaultSize int) int {
+	for _, option := range strings.Split(queryOptions, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(option), "=")
+		if found && strings.EqualFold(name, "batchSize") {
+			if size, err := strconv.Atoi(value); err == nil && size > 0 {
+				return size
+			}
+		}
+	}
+	return defaultSize
+}
+
+// recordJSON formats a record the way salesforce returns it
+func (s *Server) recordJSON(object string, record Record) map[string]interface{} {
+	result := map[string]interface{}{
+		"attributes": map[string]string{
+			"type": object,
+			"url":  fmt.Sprintf("/services/data/v%s/sobjects/%s/%s", s.APIVersion, object, record.id()),
+		},
+	}
+	for field, value := range record {
+		if t, ok := value.(time.Time); ok {
+			value = t.UTC().Format(lastModifiedDateFormat)
+		}
+		result[field] = value
+	}
+	return result
+}
+
+type queryResponse struct {
+	TotalSize      int                      `json:"totalSize"`
+	Done           bool                     `json:"done"`
+	NextRecordsURL string                   `json:"nextRecordsUrl,omitempty"`
+	Records        []map[string]interface{} `json:"records"`
+}
+
+type apiError struct {
+	Message   string `json:"message"`
+	ErrorCode string `json:"errorCode"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, []apiError{{Message: message, ErrorCode: code}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,111 @@
+package pollertest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const accountQuery = "SELECT Id, Name, LastModifiedDate FROM Account"
+
+func ids(records []map[string]interface{}) string {
+	result := []string{}
+	for _, record := range records {
+		result = append(result, record["Id"].(string))
+	}
+	return strings.Join(result, ",")
+}
+
+func TestExpireSessionFailsRequestsUntilReauthenticated(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.Put("Account", Record{"Id": "001A", "LastModifiedDate": time.Now()})
+	client := server.Client()
+	_, err := client.ExecuteSoqlQueryAll(accountQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ExpireSession()
+	_, err = client.ExecuteSoqlQueryAll(accountQuery)
+	if err == nil || !strings.Contains(err.Error(), "status 401") || !strings.Contains(err.Error(), ErrorCodeInvalidSession) {
+		t.Fatalf("expected a 401 with %s, got %v", ErrorCodeInvalidSession, err)
+	}
+	err = client.Authenticate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.ExecuteSoqlQueryAll(accountQuery)
+	if err != nil || ids(response.Records) != "001A" {
+		t.Fatalf("expected 001A after reauthenticating, got %v, %v", response.Records, err)
+	}
+	if server.RequestCount("token") != 2 {
+		t.Fatalf("expected 2 token requests, got %d", server.RequestCount("token"))
+	}
+}
+
+func TestInvalidateQueryLocatorsFailsNextRecordsURLs(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.SetPageSize(1)
+	now := time.Now()
+	server.Put("Account", Record{"Id": "001A", "LastModifiedDate": now}, Record{"Id": "001B", "LastModifiedDate": now.Add(time.Second)})
+	client := server.Client()
+	response, err := client.ExecuteSoqlQueryAll(accountQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Done || response.NextRecordsUrl == "" {
+		t.Fatalf("expected a next records url, got %+v", response)
+	}
+	server.InvalidateQueryLocators()
+	_, err = client.GetNextRecords(response.NextRecordsUrl)
+	if err == nil || !strings.Contains(err.Error(), "status 400") || !strings.Contains(err.Error(), ErrorCodeInvalidQueryLocator) {
+		t.Fatalf("expected a 400 with %s, got %v", ErrorCodeInvalidQueryLocator, err)
+	}
+}
+
+func TestFailNextRespondsWithTheCodeOfEachStatus(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.Put("Account", Record{"Id": "001A", "LastModifiedDate": time.Now()})
+	client := server.Client()
+	statuses := map[int]string{
+		503: ErrorCodeServerUnavailable,
+		403: ErrorCodeRequestLimitExceeded,
+		401: ErrorCodeInvalidSession,
+		500: ErrorCodeUnknownException,
+	}
+	for status, code := range statuses {
+		server.FailNext(status)
+		_, err := client.ExecuteSoqlQueryAll(accountQuery)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status %d", status)) || !strings.Contains(err.Error(), code) {
+			t.Fatalf("expected status %d to fail with %s, got %v", status, code, err)
+		}
+	}
+	// only the scripted requests fail
+	response, err := client.ExecuteSoqlQueryAll(accountQuery)
+	if err != nil || ids(response.Records) != "001A" {
+		t.Fatalf("expected 001A once the failures are used up, got %v, %v", response.Records, err)
+	}
+}
+
+func TestReorderTiesReversesRecordsWithTheSameLastModifiedDate(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	now := time.Now()
+	server.Put("Account",
+		Record{"Id": "001A", "LastModifiedDate": now},
+		Record{"Id": "001B", "LastModifiedDate": now},
+		Record{"Id": "001C", "LastModifiedDate": now.Add(time.Second)})
+	client := server.Client()
+	response, err := client.ExecuteSoqlQueryAll(accountQuery)
+	if err != nil || ids(response.Records) != "001A,001B,001C" {
+		t.Fatalf("expected 001A,001B,001C, got %v, %v", response.Records, err)
+	}
+	server.ReorderTies(true)
+	response, err = client.ExecuteSoqlQueryAll(accountQuery)
+	if err != nil || ids(response.Records) != "001B,001A,001C" {
+		t.Fatalf("expected ties reversed as 001B,001A,001C, got %v, %v", response.Records, err)
+	}
+}
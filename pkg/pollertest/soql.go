@@ -0,0 +1,43 @@
+package pollertest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	fromPattern  = regexp.MustCompile(`(?i)\bfrom\s+(\w+)`)
+	sincePattern = regexp.MustCompile(`(?i)\bLastModifiedDate\s*>=\s*(\S+)`)
+	limitPattern = regexp.MustCompile(`(?i)\blimit\s+(\d+)`)
+)
+
+// query is the subset of a soql query that the server evaluates
+type query struct {
+	object string
+	since  *time.Time
+	limit  int
+}
+
+// parseQuery reads the object, LastModifiedDate >= predicate and limit from
+// soql
+func parseQuery(soql string) (query, error) {
+	result := query{}
+	from := fromPattern.FindStringSubmatch(soql)
+	if from == nil {
+		return result, fmt.Errorf("unexpected token, expected from in %q", soql)
+	}
+	result.object = from[1]
+	if since := sincePattern.FindStringSubmatch(soql); since != nil {
+		timestamp, err := time.Parse(time.RFC3339Nano, since[1])
+		if err != nil {
+			return result, fmt.Errorf("invalid LastModifiedDate %q: %w", since[1], err)
+		}
+		result.since = &timestamp
+	}
+	if limit := limitPattern.FindStringSubmatch(soql); limit != nil {
+		result.limit, _ = strconv.Atoi(limit[1])
+	}
+	return result, nil
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/errorutils"
+	"github.com/catalystsquad/app-utils-go/logging"
+	"github.com/dgraph-io/badger/v3"
+)
+
+// PositionStore persists positions by persistence key
+type PositionStore interface {
+	// Get fetches the persisted position. If there is none, then it returns
+	// a position with zero values
+	Get(key string) (*Position, error)
+	Set(key string, position Position) error
+	Delete(key string) error
+	// List returns every persisted position by persistence key
+	List() (map[string]*Position, error)
+	Close() error
+}
+
+// BadgerPositionStore is the default PositionStore, persisting positions to
+// a badger database on disk
+type BadgerPositionStore struct {
+	db *badger.DB
+}
+
+// OpenBadgerPositionStore opens the badger database at path, creating it if it
+// doesn't exist. Badger locks the directory, so only one process can open the
+// store at a time
+func OpenBadgerPositionStore(path string) (*BadgerPositionStore, error) {
+	db, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		errorutils.LogOnErr(logging.Log.WithField("path", path), "error opening badger db", err)
+		return nil, err
+	}
+	return &BadgerPositionStore{db: db}, nil
+}
+
+func (s *BadgerPositionStore) Get(key string) (position *Position, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, getErr := txn.Get([]byte(key))
+		if getErr != nil {
+			return getErr
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &position)
+		})
+	})
+	// if the key is not found, then return a new position with zero state
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		err = nil
+		position = &Position{LastModifiedDate: &time.Time{}}
+	}
+	return
+}
+
+func (s *BadgerPositionStore) Set(key string, position Position) error {
+	positionBytes, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), positionBytes)
+	})
+}
+
+func (s *BadgerPositionStore) Delete(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	})
+}
+
+func (s *BadgerPositionStore) List() (map[string]*Position, error) {
+	positions := map[string]*Position{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		iterator := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			var position *Position
+			err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &position)
+			})
+			if err != nil {
+				return err
+			}
+			positions[string(item.KeyCopy(nil))] = position
+		}
+		return nil
+	})
+	return positions, err
+}
+
+func (s *BadgerPositionStore) Close() error {
+	return s.db.Close()
+}
+
+// Ping returns an error if the badger database has been closed
+func (s *BadgerPositionStore) Ping() error {
+	if s.db.IsClosed() {
+		return errors.New("badger database is closed")
+	}
+	return nil
+}
+
+// pinger is implemented by position stores that can report whether they're
+// usable, which is checked by the liveness probe
+type pinger interface {
+	Ping() error
+}
+
+// NewPositionAt returns a position that starts polling from the given time,
+// without any next records url or previously queried records
+func NewPositionAt(lastModifiedDate time.Time) Position {
+	return Position{LastModifiedDate: &lastModifiedDate}
+}
+
+// Rewind returns a position that starts polling the given duration before
+// this position. Rewinding clears the next records url and previously
+// queried records, so that every record since the new position is delivered
+// again
+func (p Position) Rewind(duration time.Duration) Position {
+	lastModifiedDate := time.Time{}
+	if p.LastModifiedDate != nil {
+		lastModifiedDate = *p.LastModifiedDate
+	}
+	return NewPositionAt(lastModifiedDate.Add(-duration))
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrUnknownPersistenceKey is returned when a persistence key doesn't
+	// match any query
+	ErrUnknownPersistenceKey = errors.New("unknown persistence key")
+	// ErrQueryInProgress is returned when a query's position can't be changed
+	// because it's currently polling
+	ErrQueryInProgress = errors.New("query is in progress")
+	// ErrPositionsNotLoaded is returned when positions are changed before the
+	// poller has loaded them
+	ErrPositionsNotLoaded = errors.New("positions are not loaded")
+	// ErrQueryNotAssigned is returned when a query's position is changed on a
+	// replica that isn't polling it, because another replica holds its lease
+	// or shard. Change it on the replica that's polling it
+	ErrQueryNotAssigned = errors.New("query is assigned to another replica")
+)
+
+// QueryState describes the current state of a query
+type QueryState struct {
+	PersistenceKey        string     `json:"persistence_key"`
+	Org                   string     `json:"org,omitempty"`
+	InProgress            bool       `json:"in_progress"`
+	UpToDate              bool       `json:"up_to_date"`
+	Paused                bool       `json:"paused"`
+	Standby               bool       `json:"standby,omitempty"`
+	LastModifiedDate      *time.Time `json:"last_modified_date,omitempty"`
+	NextURL               string     `json:"next_url,omitempty"`
+	PreviousRecordIDCount int        `json:"previous_record_id_count"`
+	LastError             string     `json:"last_error,omitempty"`
+	LastErrorTime         *time.Time `json:"last_error_time,omitempty"`
+	LastSuccessTime       *time.Time `json:"last_success_time,omitempty"`
+	ConsecutiveFailures   int        `json:"consecutive_failures"`
+	Stats                 QueryStats `json:"stats"`
+}
+
+// QueryStates returns the state of every query, in the order they were
+// configured
+func (p *LightningPoller) QueryStates() []QueryState {
+	queries := p.queries()
+	states := make([]QueryState, 0, len(queries))
+	for _, query := range queries {
+		states = append(states, p.queryState(query.PersistenceKey))
+	}
+	return states
+}
+
+// QueryState returns the state of the query with the given persistence key
+func (p *LightningPoller) QueryState(key string) (QueryState, error) {
+	if _, ok := p.getQuery(key); !ok {
+		return QueryState{}, ErrUnknownPersistenceKey
+	}
+	return p.queryState(key), nil
+}
+
+func (p *LightningPoller) queryState(key string) QueryState {
+	state := QueryState{PersistenceKey: key, Org: p.orgOf(key), Paused: p.isPaused(key), Standby: !p.assigned(key)}
+	p.inProgressQueriesMu.Lock()
+	state.InProgress = p.inProgressQueries[key]
+	p.inProgressQueriesMu.Unlock()
+	p.upToDateQueriesMu.Lock()
+	state.UpToDate = p.upToDateQueries[key]
+	p.upToDateQueriesMu.Unlock()
+	if position := p.getCurrentPosition(key); position != nil {
+		state.LastModifiedDate = position.LastModifiedDate
+		state.NextURL = position.NextURL
+		state.PreviousRecordIDCount = len(position.PreviousRecordIDs)
+	}
+	stats, status := p.copyQueryStatus(key)
+	state.Stats = stats
+	state.ConsecutiveFailures = status.consecutiveFailures
+	if status.lastError != nil {
+		state.LastError = status.lastError.Error()
+		state.LastErrorTime = &status.lastErrorTime
+	}
+	if !status.lastSuccessTime.IsZero() {
+		state.LastSuccessTime = &status.lastSuccessTime
+	}
+	return state
+}
+
+// Pause stops polling the query with the given persistence key until it's
+// resumed. A poll that's in progress stops before its next page
+func (p *LightningPoller) Pause(key string) error {
+	return p.setPaused(key, true)
+}
+
+// Resume resumes polling a paused query
+func (p *LightningPoller) Resume(key string) error {
+	return p.setPaused(key, false)
+}
+
+func (p *LightningPoller) setPaused(key string, paused bool) error {
+	if _, ok := p.getQuery(key); !ok {
+		return ErrUnknownPersistenceKey
+	}
+	p.pausedQueriesMu.Lock()
+	defer p.pausedQueriesMu.Unlock()
+	p.pausedQueries[key] = paused
+	return nil
+}
+
+func (p *LightningPoller) isPaused(key string) bool {
+	p.pausedQueriesMu.Lock()
+	defer p.pausedQueriesMu.Unlock()
+	return p.pausedQueries[key]
+}
+
+// PollNow starts polling the query with the given persistence key immediately,
+// without waiting for the ticker or the query's interval. It doesn't wait for
+// the poll to finish. Paused queries and queries that are already in progress
+// are skipped as usual
+func (p *LightningPoller) PollNow(key string) error {
+	query, ok := p.getQuery(key)
+	if !ok {
+		return ErrUnknownPersistenceKey
+	}
+	go p.pollQuery(query)
+	return nil
+}
+
+// SetPosition replaces the position of the query with the given persistence
+// key, persisting it if persistence is enabled. It returns ErrQueryInProgress
+// if the query is currently polling, pause the query first to avoid that, and
+// ErrQueryNotAssigned on a replica that isn't polling the query
+func (p *LightningPoller) SetPosition(key string, position Position) error {
+	return p.replacePosition(key, func(Position) Position {
+		return position
+	})
+}
+
+// RewindPosition moves the position of the query with the given persistence
+// key back by the given duration. See SetPosition
+func (p *LightningPoller) RewindPosition(key string, duration time.Duration) error {
+	return p.replacePosition(key, func(current Position) Position {
+		return current.Rewind(duration)
+	})
+}
+
+// replacePosition replaces a query's position with the result of replace,
+// while holding the query's in progress lock so that it can't poll at the same
+// time
+func (p *LightningPoller) replacePosition(key string, replace func(current Position) Position) error {
+	query, ok := p.getQuery(key)
+	if !ok {
+		return ErrUnknownPersistenceKey
+	}
+	if p.checkInProgressAndLock(query) {
+		return ErrQueryInProgress
+	}
+	defer p.unlockInProgressQuery(query)
+	return p.replaceLockedPosition(query, replace)
+}
+
+// replaceLockedPosition replaces the position of a query whose in progress
+// lock the caller holds. It's saved with the query's lease, like a poll's
+// position, so a replica that has lost the lease can't overwrite the position
+// of the one that holds it
+func (p *LightningPoller) replaceLockedPosition(query QueryWithCallback, replace func(current Position) Position) error {
+	key := query.PersistenceKey
+	if !p.assigned(key) {
+		return ErrQueryNotAssigned
+	}
+	ctx, cancel, leased := p.leaseContext(context.Background(), key)
+	defer cancel()
+	if !leased {
+		return ErrQueryNotAssigned
+	}
+	current := p.getCurrentPosition(key)
+	if current == nil {
+		return ErrPositionsNotLoaded
+	}
+	position := replace(*current)
+	if p.config.PersistenceEnabled {
+		err := p.savePolledPosition(ctx, key, position)
+		if errors.Is(err, ErrLeaseLost) {
+			return ErrQueryNotAssigned
+		}
+		if err != nil {
+			return fmt.Errorf("error saving position: %w", err)
+		}
+	}
+	p.setCurrentPosition(key, &position)
+	p.recordProgress(key)
+	// the query has to catch up from its new position before dependent
+	// queries can run
+	p.setUpToDateQuery(false, query)
+	return nil
+}
+
+// getQuery finds the query with the given persistence key
+func (p *LightningPoller) getQuery(key string) (QueryWithCallback, bool) {
+	for _, query := range p.queries() {
+		if query.PersistenceKey == key {
+			return query, true
+		}
+	}
+	return QueryWithCallback{}, false
+}
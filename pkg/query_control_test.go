@@ -0,0 +1,218 @@
+package pkg_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+func TestPauseStopsAPollBeforeItsNextPage(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.SetPageSize(1)
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account",
+		pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"},
+		pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate.Add(time.Minute), "Name": "Beta"},
+		pollertest.Record{"Id": "001C", "LastModifiedDate": lastModifiedDate.Add(2 * time.Minute), "Name": "Gamma"})
+	var poller *lp.LightningPoller
+	pages := 0
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			pages++
+			if pages == 1 {
+				if err := poller.Pause("Accounts"); err != nil {
+					t.Error(err)
+				}
+			}
+			return true
+		},
+	}
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller, err = lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 1 {
+		t.Fatalf("expected the poll to stop after the page it was paused during, got %d pages", pages)
+	}
+	state, err := poller.QueryState("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.LastModifiedDate == nil || !state.LastModifiedDate.Equal(lastModifiedDate) {
+		t.Fatalf("expected the position at the accepted page, got %v", state.LastModifiedDate)
+	}
+	err = poller.Resume("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 3 {
+		t.Fatalf("expected the resumed poll to deliver the remaining pages, got %d pages", pages)
+	}
+}
+
+// newControlledPoller returns a poller with a persisted query of Accounts that
+// has caught up, and the channel its pages are delivered to
+func newControlledPoller(t *testing.T, server *pollertest.Server) (*lp.LightningPoller, lp.PositionStore, chan []byte) {
+	t.Helper()
+	pages := make(chan []byte, 10)
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			pages <- result
+			return true
+		},
+	}
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(pages) > 0 {
+		<-pages
+	}
+	return poller, store, pages
+}
+
+// postAdmin posts body to an admin api path and decodes the query state it
+// responds with
+func postAdmin(t *testing.T, handler http.Handler, path, body string) (int, lp.QueryState) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	state := lp.QueryState{}
+	if recorder.Code == http.StatusOK {
+		err := json.Unmarshal(recorder.Body.Bytes(), &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Code, state
+}
+
+func TestAdminPauseAndResume(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	poller, _, pages := newControlledPoller(t, server)
+	handler := poller.AdminHandler()
+	status, state := postAdmin(t, handler, "/queries/Accounts/pause", "")
+	if status != http.StatusOK || !state.Paused {
+		t.Fatalf("expected the query to be paused, got %d %+v", status, state)
+	}
+	server.Put("Account", pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate.Add(time.Minute), "Name": "Beta"})
+	_, err := poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 0 {
+		t.Fatal("expected a paused query not to poll")
+	}
+	status, state = postAdmin(t, handler, "/queries/Accounts/resume", "")
+	if status != http.StatusOK || state.Paused {
+		t.Fatalf("expected the query to be resumed, got %d %+v", status, state)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || !strings.Contains(string(<-pages), "001B") {
+		t.Fatal("expected the resumed query to deliver the record added while it was paused")
+	}
+	status, _ = postAdmin(t, handler, "/queries/Contacts/resume", "")
+	if status != http.StatusNotFound {
+		t.Fatalf("expected an unknown key to be not found, got %d", status)
+	}
+}
+
+func TestAdminPollNowDeliversNewRecords(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	poller, _, pages := newControlledPoller(t, server)
+	server.Put("Account", pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate.Add(time.Minute), "Name": "Beta"})
+	status, _ := postAdmin(t, poller.AdminHandler(), "/queries/Accounts/poll", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected the poll to start, got %d", status)
+	}
+	select {
+	case page := <-pages:
+		if !strings.Contains(string(page), "001B") {
+			t.Fatalf("expected the new record, got %s", page)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the poll to deliver the new record")
+	}
+}
+
+func TestAdminRewindAndSetPersistThePosition(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	poller, store, _ := newControlledPoller(t, server)
+	handler := poller.AdminHandler()
+	persisted := func() *time.Time {
+		t.Helper()
+		position, err := store.Get("Accounts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return position.LastModifiedDate
+	}
+	status, state := postAdmin(t, handler, "/queries/Accounts/rewind", `{"duration": "2h"}`)
+	expected := lastModifiedDate.Add(-2 * time.Hour)
+	if status != http.StatusOK || state.LastModifiedDate == nil || !state.LastModifiedDate.Equal(expected) {
+		t.Fatalf("expected the position rewound to %s, got %d %+v", expected, status, state)
+	}
+	if position := persisted(); position == nil || !position.Equal(expected) {
+		t.Fatalf("expected the rewound position to be persisted, got %v", position)
+	}
+	expected = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	status, state = postAdmin(t, handler, "/queries/Accounts/rewind", `{"timestamp": "2024-01-02T03:04:05Z"}`)
+	if status != http.StatusOK || state.LastModifiedDate == nil || !state.LastModifiedDate.Equal(expected) {
+		t.Fatalf("expected the position set to %s, got %d %+v", expected, status, state)
+	}
+	if position := persisted(); position == nil || !position.Equal(expected) {
+		t.Fatalf("expected the set position to be persisted, got %v", position)
+	}
+	for _, body := range []string{"", `{}`, `{"duration": "2h", "timestamp": "2024-01-02T03:04:05Z"}`, `{"duration": "two hours"}`} {
+		status, _ = postAdmin(t, handler, "/queries/Accounts/rewind", body)
+		if status != http.StatusBadRequest {
+			t.Fatalf("expected %q to be a bad request, got %d", body, status)
+		}
+	}
+}
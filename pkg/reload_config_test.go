@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+func TestReloadConfigRereadsTheFileItStartedWith(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(home, ".salesforce-lightning-poller.yaml")
+	err := os.WriteFile(path, []byte("query_overrides:\n  - persistence_key: Accounts\n    paused: true\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	poller, err := New(WithEnvConfig(), WithSalesforceClient(server.Client()), WithQueries(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poller.configFileUsed != path {
+		t.Fatalf("expected the config file %s to be found, got %q", path, poller.configFileUsed)
+	}
+	// a reload searching the home directory again would find nothing now
+	t.Setenv("HOME", t.TempDir())
+	err = os.WriteFile(path, []byte("query_overrides:\n  - persistence_key: Accounts\n    paused: true\n    interval: 5m\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.reloadConfig()
+	override := poller.QueryOverrides()["Accounts"]
+	if !override.Paused || override.Interval.Minutes() != 5 {
+		t.Fatalf("expected the overrides from %s, got %+v", path, override)
+	}
+}
@@ -0,0 +1,276 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// ErrReplayRejected is returned when a callback returns false during a replay
+var ErrReplayRejected = errors.New("callback rejected a replayed batch")
+
+// maxArchivedRecordSize is the longest line a replay reads from an archive
+const maxArchivedRecordSize = 64 * 1024 * 1024
+
+// ReplayConfig selects the archived records to replay
+type ReplayConfig struct {
+	// Dir is the directory of the FileSink that archived the records
+	Dir string
+	// PersistenceKey defaults to the persistence key of the query that's
+	// replayed
+	PersistenceKey string
+	// From and To limit the replay to records with a LastModifiedDate at or
+	// after From and before To. Zero values don't limit it
+	From time.Time
+	To   time.Time
+	// BatchSize is the most records passed to the callback at a time,
+	// defaults to 2000 like a salesforce page
+	BatchSize int
+	// DedupeWindow is how far behind the latest LastModifiedDate replayed so
+	// far a record is still checked for duplicates, defaults to 24h. Records
+	// the poller delivered again are close behind it, and only the records in
+	// the window are remembered, so a replay's memory doesn't grow with the
+	// archive
+	DedupeWindow time.Duration
+	// Logger defaults to the app-utils-go logrus logger
+	Logger Logger
+}
+
+// ReplaySummary describes a finished or stopped replay
+type ReplaySummary struct {
+	Files   int `json:"files"`
+	Batches int `json:"batches"`
+	Records int `json:"records"`
+	// Duplicates is how many records were skipped because a record with the
+	// same Id and LastModifiedDate was already replayed
+	Duplicates int `json:"duplicates"`
+	// LastModifiedDate is the LastModifiedDate of the last record the
+	// callback accepted, from which a stopped replay can be resumed
+	LastModifiedDate *time.Time `json:"last_modified_date,omitempty"`
+}
+
+// Replay feeds a query's archived records to its callback instead of
+// querying salesforce, in the order they were archived and in batches, like
+// pages of a poll. Records the poller delivered more than once are only
+// replayed once, unless they were delivered again more than DedupeWindow
+// after newer records, such as after a rewind. Replaying stops with ErrReplayRejected if the callback
+// returns false, and doesn't change the query's position. Queries with a
+// TxCallback can't be replayed
+func Replay(ctx context.Context, config ReplayConfig, query QueryWithCallback) (summary ReplaySummary, err error) {
+	if query.Callback == nil && query.ContextCallback == nil {
+		return summary, errorx.IllegalArgument.New("invalid configuration: replay requires a Callback or ContextCallback")
+	}
+	key := config.PersistenceKey
+	if key == "" {
+		key = query.PersistenceKey
+	}
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = 2000
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = defaultLogger()
+	}
+	logger = logger.WithFields(logrus.Fields{"persistence_key": key})
+	files, err := archiveFiles(config.Dir, key)
+	if err != nil {
+		return summary, err
+	}
+	seen := newReplayDedupe(config.DedupeWindow)
+	batch := []string{}
+	var batchLastModifiedDate *time.Time
+	deliver := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result := []byte("[" + strings.Join(batch, ",") + "]")
+		var accepted bool
+		if query.ContextCallback != nil {
+			accepted = query.ContextCallback(ctx, result, nil)
+		} else {
+			accepted = query.Callback(result, nil)
+		}
+		if !accepted {
+			return ErrReplayRejected
+		}
+		summary.Batches++
+		summary.Records += len(batch)
+		summary.LastModifiedDate = batchLastModifiedDate
+		batch = batch[:0]
+		return nil
+	}
+	for _, file := range files {
+		summary.Files++
+		err = readArchiveFile(file, func(record []byte) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !gjson.ValidBytes(record) {
+				// a line cut short by a crash while it was written
+				logger.WithFields(logrus.Fields{"file": file}).Warn("skipping invalid archived record")
+				return nil
+			}
+			lastModifiedDate, parseErr := getTimestampFromResultLastModifiedDate(gjson.GetBytes(record, "LastModifiedDate").String())
+			if parseErr != nil {
+				return errorx.Decorate(parseErr, "error parsing LastModifiedDate of archived record")
+			}
+			if (!config.From.IsZero() && lastModifiedDate.Before(config.From)) || (!config.To.IsZero() && !lastModifiedDate.Before(config.To)) {
+				return nil
+			}
+			if seen.duplicate(gjson.GetBytes(record, "Id").String(), lastModifiedDate) {
+				summary.Duplicates++
+				return nil
+			}
+			batch = append(batch, string(record))
+			batchLastModifiedDate = &lastModifiedDate
+			if len(batch) >= batchSize {
+				return deliver()
+			}
+			return nil
+		}, logger)
+		if err != nil {
+			return summary, err
+		}
+	}
+	err = deliver()
+	logger.WithFields(logrus.Fields{"files": summary.Files, "records": summary.Records, "duplicates": summary.Duplicates}).Info("replay finished")
+	return summary, err
+}
+
+// replayDedupe remembers the versions of the records replayed within a window
+// of the latest LastModifiedDate replayed so far
+type replayDedupe struct {
+	window time.Duration
+	latest time.Time
+	seen   map[string]time.Time
+	// prune is how many versions are remembered before the ones that left the
+	// window are forgotten
+	prune int
+}
+
+// minReplayDedupePrune is the fewest versions remembered before pruning
+const minReplayDedupePrune = 1024
+
+func newReplayDedupe(window time.Duration) *replayDedupe {
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	return &replayDedupe{window: window, seen: map[string]time.Time{}, prune: minReplayDedupePrune}
+}
+
+// duplicate reports whether a version of a record was already replayed, and
+// remembers it if it wasn't. Versions older than the window aren't checked
+func (d *replayDedupe) duplicate(id string, lastModifiedDate time.Time) bool {
+	if lastModifiedDate.After(d.latest) {
+		d.latest = lastModifiedDate
+	}
+	cutoff := d.latest.Add(-d.window)
+	if lastModifiedDate.Before(cutoff) {
+		return false
+	}
+	version := id + "/" + lastModifiedDate.String()
+	if _, ok := d.seen[version]; ok {
+		return true
+	}
+	d.seen[version] = lastModifiedDate
+	if len(d.seen) >= d.prune {
+		for version, seenLastModifiedDate := range d.seen {
+			if seenLastModifiedDate.Before(cutoff) {
+				delete(d.seen, version)
+			}
+		}
+		// prune again once the versions remembered have doubled, so pruning
+		// stays linear
+		d.prune = 2 * len(d.seen)
+		if d.prune < minReplayDedupePrune {
+			d.prune = minReplayDedupePrune
+		}
+	}
+	return false
+}
+
+// archiveFiles returns a persistence key's archive files in the order they
+// were written, which is the order of their names
+func archiveFiles(dir, key string) ([]string, error) {
+	keyDir := filepath.Join(dir, url.QueryEscape(key))
+	entries, err := os.ReadDir(keyDir)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error reading archive for %s", key)
+	}
+	files := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.Contains(entry.Name(), ".ndjson") {
+			files = append(files, filepath.Join(keyDir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readArchiveFile passes each record in an archive file to fn. A compressed
+// file that ends early, because the sink crashed before closing it, is read
+// up to where it ends
+func readArchiveFile(path string, fn func(record []byte) error, logger Logger) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errorx.Decorate(err, "error opening archive file")
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gzipReader, err := gzip.NewReader(file)
+		if errors.Is(err, io.EOF) {
+			// the file was created but nothing was written to it
+			return nil
+		}
+		if err != nil {
+			return errorx.Decorate(err, "error reading %s", path)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case strings.HasSuffix(path, ".zst"):
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			return errorx.Decorate(err, "error reading %s", path)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxArchivedRecordSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		err = fn(line)
+		if err != nil {
+			return err
+		}
+	}
+	err = scanner.Err()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		logger.WithFields(logrus.Fields{"file": path}).Warn("archive file ends early, it wasn't closed")
+		return nil
+	}
+	if err != nil {
+		return errorx.Decorate(err, "error reading %s", path)
+	}
+	return nil
+}
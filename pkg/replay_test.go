@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// archivedRecord formats a record as salesforce returns it
+func archivedRecord(id string, lastModifiedDate time.Time) string {
+	return fmt.Sprintf(`{"Id":%q,"LastModifiedDate":%q}`, id, lastModifiedDate.UTC().Format("2006-01-02T15:04:05.000-0700"))
+}
+
+// replayedIDs replays the archive in dir and returns the ids in the order
+// they were replayed
+func replayedIDs(t *testing.T, config ReplayConfig) ([]string, ReplaySummary) {
+	t.Helper()
+	ids := []string{}
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Callback: func(result []byte, err error) bool {
+			for _, record := range gjson.ParseBytes(result).Array() {
+				ids = append(ids, record.Get("Id").String())
+			}
+			return true
+		},
+	}
+	summary, err := Replay(context.Background(), config, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids, summary
+}
+
+func TestReplayFiltersByLastModifiedDateAndSkipsDuplicates(t *testing.T) {
+	sink, err := NewFileSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	page := "[" + strings.Join([]string{
+		archivedRecord("001A", start),
+		archivedRecord("001B", start.Add(time.Hour)),
+		archivedRecord("001C", start.Add(2*time.Hour)),
+	}, ",") + "]"
+	// the poller delivered the page twice, then a new version of 001A
+	for _, result := range []string{page, page, "[" + archivedRecord("001A", start.Add(3*time.Hour)) + "]"} {
+		err = sink.Write("Accounts", []byte(result))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, summary := replayedIDs(t, ReplayConfig{Dir: sink.Dir})
+	if strings.Join(ids, ",") != "001A,001B,001C,001A" || summary.Duplicates != 3 {
+		t.Fatalf("expected each version once, got %v with %d duplicates", ids, summary.Duplicates)
+	}
+	ids, _ = replayedIDs(t, ReplayConfig{Dir: sink.Dir, From: start.Add(time.Hour), To: start.Add(3 * time.Hour)})
+	if strings.Join(ids, ",") != "001B,001C" {
+		t.Fatalf("expected From to be inclusive and To exclusive, got %v", ids)
+	}
+}
+
+func TestReplayReadsCompressedFilesThatWereNotClosed(t *testing.T) {
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			sink, err := NewFileSink(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink.Compression = compression
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, id := range []string{"001A", "001B"} {
+				err = sink.Write("Accounts", []byte("["+archivedRecord(id, start.Add(time.Duration(i)*time.Hour))+"]"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the sink isn't closed, like after a crash, so the file has no
+			// trailer
+			defer sink.Close()
+			ids, _ := replayedIDs(t, ReplayConfig{Dir: sink.Dir})
+			if strings.Join(ids, ",") != "001A,001B" {
+				t.Fatalf("expected the synced records, got %v", ids)
+			}
+		})
+	}
+}
+
+func TestReplayDedupeOnlyRemembersTheWindow(t *testing.T) {
+	dedupe := newReplayDedupe(time.Hour)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	largest := 0
+	for i := 0; i < 100000; i++ {
+		lastModifiedDate := start.Add(time.Duration(i) * time.Second)
+		if dedupe.duplicate(fmt.Sprintf("%06d", i), lastModifiedDate) {
+			t.Fatalf("expected record %d not to be a duplicate", i)
+		}
+		if len(dedupe.seen) > largest {
+			largest = len(dedupe.seen)
+		}
+	}
+	// an hour of records a second, and the versions remembered before pruning
+	if largest > 2*3600+minReplayDedupePrune {
+		t.Fatalf("expected the remembered versions to stay bounded, got %d", largest)
+	}
+	latest := start.Add(99999 * time.Second)
+	if !dedupe.duplicate("099999", latest) || !dedupe.duplicate("099000", start.Add(99000*time.Second)) {
+		t.Fatal("expected versions within the window to be duplicates")
+	}
+	if dedupe.duplicate("000000", start) {
+		t.Fatal("expected versions older than the window not to be checked")
+	}
+}
@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+// RunSummary describes the work done by RunOnce
+type RunSummary struct {
+	// Queries holds the stats for each persistence key
+	Queries  map[string]QueryStats `json:"queries"`
+	Duration time.Duration         `json:"duration"`
+}
+
+// RecordsDelivered returns the total number of records delivered across all
+// persistence keys
+func (s RunSummary) RecordsDelivered() (total int64) {
+	for _, stats := range s.Queries {
+		total += stats.RecordsDelivered
+	}
+	return
+}
+
+// Errors returns the total number of errors across all persistence keys
+func (s RunSummary) Errors() (total int64) {
+	for _, stats := range s.Queries {
+		total += stats.Errors
+	}
+	return
+}
+
+// RunOnce loads positions, drives every query until they're all caught up with
+// salesforce, persists positions, and returns a summary of the run. Unlike
+// Run() it does not poll on the ticker, so it's suitable for batch jobs such as
+// kubernetes cronjobs. Queries only run once their dependencies are caught up.
+// An error is returned if the context is cancelled, or if a round of polling
+// makes no progress because every query failed or is waiting on dependencies
+// that can never catch up.
+func (p *LightningPoller) RunOnce(ctx context.Context) (summary RunSummary, err error) {
+	start := p.clock.Now()
+	if p.config.PersistenceEnabled {
+		err = p.openPositionStore(p.config.PersistencePath)
+		if err != nil {
+			return
+		}
+	}
+	defer p.closePositionStore()
+	defer p.closeSnapshotStore()
+	stopLeases := p.startLeases(ctx)
+	defer stopLeases()
+	stopSharding := p.startSharding(ctx)
+	defer stopSharding()
+	err = p.loadPositions()
+	if err != nil {
+		err = errorx.Decorate(err, "error loading poller position")
+		return
+	}
+	p.resetQueryStats()
+	p.resetUpToDateQueries()
+	defer func() {
+		summary.Queries = p.copyQueryStats()
+		summary.Duration = p.clock.Now().Sub(start)
+		p.logger.WithFields(logrus.Fields{
+			"records_delivered": summary.RecordsDelivered(),
+			"errors":            summary.Errors(),
+			"duration":          summary.Duration,
+		}).Info("run once finished")
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+		pending := p.pendingQueries()
+		if len(pending) == 0 {
+			break
+		}
+		err = p.runOnceRound(ctx, pending)
+		if err != nil {
+			return
+		}
+	}
+
+	err = p.savePositions()
+	return
+}
+
+// runOnceRound runs every pending query whose dependencies are caught up
+// concurrently, and waits for them to finish. It returns an error if no query
+// could run, or if every query that ran failed.
+func (p *LightningPoller) runOnceRound(ctx context.Context, pending []QueryWithCallback) error {
+	ready := []QueryWithCallback{}
+	for _, query := range pending {
+		if p.config.SkipDependencyCheck || p.dependenciesUpToDate(query) {
+			ready = append(ready, query)
+		}
+	}
+	if len(ready) == 0 {
+		return errorx.IllegalState.New("queries are waiting on dependencies that are not up to date: %s", strings.Join(persistenceKeys(pending), ","))
+	}
+
+	wg := &sync.WaitGroup{}
+	errsMu := &sync.Mutex{}
+	errs := []error{}
+	for _, query := range ready {
+		wg.Add(1)
+		go func(query QueryWithCallback) {
+			defer wg.Done()
+			err := p.runQuery(ctx, query)
+			if err != nil {
+				p.queryLogger(query.PersistenceKey).WithError(err).Error("error polling")
+				errsMu.Lock()
+				errs = append(errs, errorx.Decorate(err, fmt.Sprintf("error polling %s", query.PersistenceKey)))
+				errsMu.Unlock()
+			}
+		}(query)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(errs) == len(ready) {
+		return errorx.DecorateMany("every query failed, giving up", errs...)
+	}
+	return nil
+}
+
+// pendingQueries returns the queries that are not caught up yet. paused
+// queries are never pending
+func (p *LightningPoller) pendingQueries() []QueryWithCallback {
+	// copied so that the other locks aren't taken while holding this one
+	p.upToDateQueriesMu.Lock()
+	upToDate := make(map[string]bool, len(p.upToDateQueries))
+	for key, value := range p.upToDateQueries {
+		upToDate[key] = value
+	}
+	p.upToDateQueriesMu.Unlock()
+	pending := []QueryWithCallback{}
+	for _, query := range p.queries() {
+		if !upToDate[query.PersistenceKey] && !p.isPaused(query.PersistenceKey) && p.assigned(query.PersistenceKey) {
+			pending = append(pending, query)
+		}
+	}
+	return pending
+}
+
+func (p *LightningPoller) resetUpToDateQueries() {
+	p.upToDateQueriesMu.Lock()
+	defer p.upToDateQueriesMu.Unlock()
+	for key := range p.upToDateQueries {
+		p.upToDateQueries[key] = false
+	}
+}
+
+// savePositions persists the in memory position of every query this replica
+// polls, so that startup overrides that were never advanced are kept for the
+// next run
+func (p *LightningPoller) savePositions() error {
+	if !p.config.PersistenceEnabled {
+		return nil
+	}
+	for key, position := range p.copyCurrentPositions() {
+		if !p.assigned(key) {
+			// another replica owns its saved position
+			continue
+		}
+		err := p.setPosition(key, *position)
+		if err != nil {
+			return errorx.Decorate(err, fmt.Sprintf("error saving position for %s", key))
+		}
+	}
+	return nil
+}
+
+func persistenceKeys(queries []QueryWithCallback) []string {
+	keys := make([]string, 0, len(queries))
+	for _, query := range queries {
+		keys = append(keys, query.PersistenceKey)
+	}
+	return keys
+}
@@ -0,0 +1,87 @@
+package pkg_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/tidwall/gjson"
+)
+
+func TestRunOnceCatchesUpAndReturns(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.SetPageSize(2)
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	for i := 0; i < 5; i++ {
+		server.Put("Account", pollertest.Record{"Id": fmt.Sprintf("001%d", i), "LastModifiedDate": lastModifiedDate.Add(time.Duration(i) * time.Minute)})
+	}
+	for i := 0; i < 3; i++ {
+		server.Put("Contact", pollertest.Record{"Id": fmt.Sprintf("003%d", i), "LastModifiedDate": lastModifiedDate.Add(time.Duration(i) * time.Minute)})
+	}
+	mu := &sync.Mutex{}
+	delivered := []string{}
+	callback := func(result []byte, err error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, record := range gjson.ParseBytes(result).Array() {
+			delivered = append(delivered, record.Get("Id").String())
+		}
+		return true
+	}
+	accounts := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM Account" },
+		Callback:       callback,
+	}
+	contacts := lp.QueryWithCallback{
+		PersistenceKey: "Contacts",
+		Query:          func() string { return "SELECT Id, LastModifiedDate FROM Contact" },
+		Callback:       callback,
+		DependsOn:      []string{"Accounts"},
+	}
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(accounts, contacts), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	summary, err := poller.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.RecordsDelivered() != 8 || len(delivered) != 8 {
+		t.Fatalf("expected every record to be delivered once, got %d in the summary and %v", summary.RecordsDelivered(), delivered)
+	}
+	for i, id := range delivered {
+		if (i < 5) != (id[:3] == "001") {
+			t.Fatalf("expected contacts to be polled after accounts caught up, got %v", delivered)
+		}
+	}
+	for key, expected := range map[string]time.Time{"Accounts": lastModifiedDate.Add(4 * time.Minute), "Contacts": lastModifiedDate.Add(2 * time.Minute)} {
+		position, err := store.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if position.LastModifiedDate == nil || !position.LastModifiedDate.Equal(expected) {
+			t.Fatalf("expected the position of %s at %s, got %v", key, expected, position.LastModifiedDate)
+		}
+	}
+	// a second run has nothing to catch up on
+	summary, err = poller.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.RecordsDelivered() != 0 {
+		t.Fatalf("expected a caught up run to deliver nothing, got %d", summary.RecordsDelivered())
+	}
+}
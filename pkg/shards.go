@@ -0,0 +1,332 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+)
+
+// MembershipStore tracks the live members of a fleet of pollers. It must be
+// shared by every member, and safe to use from several processes
+type MembershipStore interface {
+	// Heartbeat registers member in fleet, or keeps it registered, until ttl
+	// elapses
+	Heartbeat(ctx context.Context, fleet, member string, ttl time.Duration) error
+	// Members returns the members of fleet whose registration hasn't expired
+	Members(ctx context.Context, fleet string) ([]string, error)
+	// Leave removes member from fleet
+	Leave(ctx context.Context, fleet, member string) error
+}
+
+// ShardConfig configures sharding of queries across a fleet
+type ShardConfig struct {
+	Store MembershipStore
+	// Fleet is the name of the fleet, defaults to lightning-poller
+	Fleet string
+	// Member identifies this replica, defaults to the hostname and pid
+	Member string
+	// TTL is how long a member stays in the fleet without a heartbeat,
+	// defaults to 15s
+	TTL time.Duration
+	// HeartbeatInterval is how often this replica heartbeats and rebalances,
+	// defaults to a third of TTL
+	HeartbeatInterval time.Duration
+	// VirtualNodes is how many points each member has on the hash ring, more
+	// spread keys more evenly. Defaults to 64
+	VirtualNodes int
+}
+
+// ownedShard is a persistence key assigned to this replica, which it starts
+// polling once it's ready
+type ownedShard struct {
+	ready bool
+	// lost is closed when the key is assigned to another member, cancelling
+	// its poll
+	lost chan struct{}
+}
+
+// WithSharding spreads queries across the replicas in a fleet, assigning each
+// persistence key to one member with consistent hashing. Positions are handed
+// over through the position store, which must be shared by the fleet
+func WithSharding(config ShardConfig) Option {
+	return func(p *LightningPoller) error {
+		if config.Fleet == "" {
+			config.Fleet = "lightning-poller"
+		}
+		if config.Member == "" {
+			hostname, _ := os.Hostname()
+			config.Member = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		if config.TTL <= 0 {
+			config.TTL = 15 * time.Second
+		}
+		if config.HeartbeatInterval <= 0 {
+			config.HeartbeatInterval = config.TTL / 3
+		}
+		if config.VirtualNodes <= 0 {
+			config.VirtualNodes = 64
+		}
+		if config.Store == nil {
+			return errorx.IllegalArgument.New("invalid sharding configuration: a membership store is required")
+		}
+		if config.HeartbeatInterval >= config.TTL {
+			return errorx.IllegalArgument.New("invalid sharding configuration: the heartbeat interval must be shorter than the ttl")
+		}
+		p.shardConfig = &config
+		return nil
+	}
+}
+
+// shardingEnabled checks whether sharding is configured
+func (p *LightningPoller) shardingEnabled() bool {
+	return p.shardConfig != nil
+}
+
+// assigned checks whether this replica polls a persistence key, because it
+// holds the key's lease and owns its shard
+func (p *LightningPoller) assigned(key string) bool {
+	return p.holdsLease(key) && p.ownsShard(key)
+}
+
+// ownsShard checks whether a persistence key is assigned to this replica and
+// its handover has finished. It's always true when sharding isn't enabled
+func (p *LightningPoller) ownsShard(key string) bool {
+	if !p.shardingEnabled() {
+		return true
+	}
+	_, ok := p.currentShard(key)
+	return ok
+}
+
+func (p *LightningPoller) currentShard(key string) (*ownedShard, bool) {
+	p.shardsMu.Lock()
+	defer p.shardsMu.Unlock()
+	shard, ok := p.shards[key]
+	if !ok || !shard.ready {
+		return nil, false
+	}
+	return shard, true
+}
+
+// shardContext returns a context that's cancelled when a persistence key is
+// assigned to another member. ok is false if this replica doesn't own it
+func (p *LightningPoller) shardContext(ctx context.Context, key string) (shardCtx context.Context, cancel context.CancelFunc, ok bool) {
+	if !p.shardingEnabled() {
+		shardCtx, cancel = context.WithCancel(ctx)
+		return shardCtx, cancel, true
+	}
+	shard, ok := p.currentShard(key)
+	if !ok {
+		return ctx, func() {}, false
+	}
+	shardCtx, cancel = context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-shard.lost:
+			cancel()
+		case <-shardCtx.Done():
+		}
+	}()
+	return shardCtx, cancel, true
+}
+
+// startSharding joins the fleet and takes over its keys before returning,
+// then heartbeats and rebalances in the background. stop leaves the fleet and
+// waits for it to finish. It's a no-op when sharding isn't enabled
+func (p *LightningPoller) startSharding(ctx context.Context) (stop func()) {
+	if !p.shardingEnabled() {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	acquired, wait := p.rebalance(ctx)
+	if wait {
+		select {
+		case <-ctx.Done():
+		case <-time.After(p.shardConfig.TTL):
+		}
+	}
+	p.takeShards(acquired)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(p.shardConfig.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.leaveFleet()
+				return
+			case <-ticker.C:
+				acquired, wait := p.rebalance(ctx)
+				if wait {
+					time.AfterFunc(p.shardConfig.TTL, func() { p.takeShards(acquired) })
+				} else {
+					p.takeShards(acquired)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// rebalance heartbeats, then assigns keys using the current members. If the
+// fleet can't be reached, the current assignment is kept until this
+// replica's membership would expire before its next heartbeat, after which
+// it owns nothing. It returns the newly assigned keys, which are taken over
+// with takeShards after a ttl when wait is true. A previous owner that can't
+// reach the fleet keeps polling for up to a ttl after its last heartbeat, so
+// waiting any less could poll a key from two replicas
+func (p *LightningPoller) rebalance(ctx context.Context) (acquired map[string]*ownedShard, wait bool) {
+	config := p.shardConfig
+	logger := p.logger.WithFields(logrus.Fields{"fleet": config.Fleet, "member": config.Member})
+	now := p.clock.Now()
+	err := config.Store.Heartbeat(ctx, config.Fleet, config.Member, config.TTL)
+	var members []string
+	if err == nil {
+		members, err = config.Store.Members(ctx, config.Fleet)
+	}
+	if err != nil {
+		logger.WithError(err).Error("error updating fleet membership")
+		p.shardsMu.Lock()
+		expired := !now.Add(config.HeartbeatInterval).Before(p.shardHeartbeat.Add(config.TTL))
+		p.shardsMu.Unlock()
+		if expired {
+			p.assignShards(nil)
+		}
+		return nil, false
+	}
+	p.shardsMu.Lock()
+	p.shardHeartbeat = now
+	p.shardsMu.Unlock()
+	ring := newHashRing(append(members, config.Member), config.VirtualNodes)
+	return p.assignShards(ring), len(ring.members) > 1
+}
+
+// assignShards updates the keys this replica owns from ring, which is nil to
+// own nothing, cancelling polls of keys it lost. It returns the keys it
+// gained, which aren't polled until they're taken over
+func (p *LightningPoller) assignShards(ring *hashRing) map[string]*ownedShard {
+	owned := map[string]bool{}
+	if ring != nil {
+		for _, query := range p.queries() {
+			if ring.owner(query.PersistenceKey) == p.shardConfig.Member {
+				owned[query.PersistenceKey] = true
+			}
+		}
+	}
+	acquired, lost := map[string]*ownedShard{}, []string{}
+	p.shardsMu.Lock()
+	for key, shard := range p.shards {
+		if !owned[key] {
+			close(shard.lost)
+			delete(p.shards, key)
+			lost = append(lost, key)
+		}
+	}
+	for key := range owned {
+		if _, ok := p.shards[key]; !ok {
+			shard := &ownedShard{lost: make(chan struct{})}
+			p.shards[key] = shard
+			acquired[key] = shard
+		}
+	}
+	p.shardsMu.Unlock()
+	for _, key := range lost {
+		p.queryLogger(key).Info("query assigned to another member")
+	}
+	return acquired
+}
+
+// takeShards reloads the positions of newly assigned keys that are still
+// owned, which the previous owner may have advanced, then starts polling them
+func (p *LightningPoller) takeShards(acquired map[string]*ownedShard) {
+	for key, shard := range acquired {
+		p.shardsMu.Lock()
+		owned := p.shards[key] == shard
+		p.shardsMu.Unlock()
+		if !owned {
+			continue
+		}
+		if query, ok := p.getQuery(key); ok {
+			p.reloadPosition(query)
+		}
+		p.shardsMu.Lock()
+		shard.ready = true
+		p.shardsMu.Unlock()
+		p.queryLogger(key).Info("query assigned to this member")
+	}
+}
+
+// leaveFleet gives up every key and leaves the fleet, so the other members
+// take over without waiting for this replica's membership to expire
+func (p *LightningPoller) leaveFleet() {
+	p.assignShards(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), p.shardConfig.TTL)
+	defer cancel()
+	err := p.shardConfig.Store.Leave(ctx, p.shardConfig.Fleet, p.shardConfig.Member)
+	p.logOnErr("error leaving fleet", err)
+}
+
+// hashRing assigns keys to members with consistent hashing, so that a member
+// joining or leaving only moves the keys it gains or loses
+type hashRing struct {
+	members []string
+	points  []uint64
+	owners  map[uint64]string
+}
+
+func newHashRing(members []string, virtualNodes int) *hashRing {
+	ring := &hashRing{owners: map[uint64]string{}}
+	seen := map[string]bool{}
+	for _, member := range members {
+		if seen[member] {
+			continue
+		}
+		seen[member] = true
+		ring.members = append(ring.members, member)
+		for i := 0; i < virtualNodes; i++ {
+			point := hashKey(fmt.Sprintf("%s#%d", member, i))
+			ring.owners[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// owner returns the member that owns key, the first one clockwise from the
+// key's hash
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hashKey hashes with fnv, then mixes the bits so that similar keys, such as
+// the virtual nodes of a member, spread around the ring
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
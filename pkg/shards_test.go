@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+// fakeMembershipStore reports a fixed set of other members, or fails
+type fakeMembershipStore struct {
+	mu      sync.Mutex
+	others  []string
+	failing bool
+}
+
+func (s *fakeMembershipStore) Heartbeat(ctx context.Context, fleet, member string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("membership store is down")
+	}
+	return nil
+}
+
+func (s *fakeMembershipStore) Members(ctx context.Context, fleet string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.others, nil
+}
+
+func (s *fakeMembershipStore) Leave(ctx context.Context, fleet, member string) error {
+	return nil
+}
+
+func newShardedPoller(t *testing.T, store MembershipStore, config ShardConfig, options ...Option) *LightningPoller {
+	t.Helper()
+	server := pollertest.NewServer()
+	t.Cleanup(server.Close)
+	queries := []QueryWithCallback{}
+	for i := 0; i < 16; i++ {
+		queries = append(queries, QueryWithCallback{
+			PersistenceKey: fmt.Sprintf("Object%d", i),
+			Query:          func() string { return "SELECT Id, LastModifiedDate FROM Account" },
+			Callback:       func(result []byte, err error) bool { return true },
+		})
+	}
+	config.Store = store
+	config.Member = "self"
+	poller, err := New(append([]Option{WithSalesforceClient(server.Client()), WithQueries(queries...), WithSharding(config)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return poller
+}
+
+func ownedShardCount(p *LightningPoller) int {
+	count := 0
+	for _, query := range p.queries() {
+		if p.ownsShard(query.PersistenceKey) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestShardTakeoverWaitsForTheTTL(t *testing.T) {
+	ttl := 300 * time.Millisecond
+	poller := newShardedPoller(t, &fakeMembershipStore{others: []string{"other"}}, ShardConfig{TTL: ttl, HeartbeatInterval: 50 * time.Millisecond})
+	start := time.Now()
+	stop := poller.startSharding(context.Background())
+	defer stop()
+	if elapsed := time.Since(start); elapsed < ttl {
+		t.Fatalf("expected keys to be taken over after the ttl, took %s", elapsed)
+	}
+	if ownedShardCount(poller) == 0 {
+		t.Fatal("expected this member to own some keys")
+	}
+}
+
+func TestShardsAreDroppedBeforeTheMembershipExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	store := &fakeMembershipStore{}
+	poller := newShardedPoller(t, store, ShardConfig{TTL: 15 * time.Second, HeartbeatInterval: 5 * time.Second}, WithClock(clock))
+	acquired, wait := poller.rebalance(context.Background())
+	if wait {
+		t.Fatal("expected a fleet of one to take over immediately")
+	}
+	poller.takeShards(acquired)
+	if ownedShardCount(poller) != 16 {
+		t.Fatalf("expected every key to be owned, got %d", ownedShardCount(poller))
+	}
+	store.mu.Lock()
+	store.failing = true
+	store.mu.Unlock()
+	clock.advance(5 * time.Second)
+	poller.rebalance(context.Background())
+	if ownedShardCount(poller) != 16 {
+		t.Fatalf("expected keys to be kept while the membership is live, got %d", ownedShardCount(poller))
+	}
+	// the membership expires before the next heartbeat
+	clock.advance(5 * time.Second)
+	poller.rebalance(context.Background())
+	if ownedShardCount(poller) != 0 {
+		t.Fatalf("expected keys to be dropped before the membership expires, got %d", ownedShardCount(poller))
+	}
+}
+
+func TestPositionsCantBeChangedForKeysOwnedByAnotherMember(t *testing.T) {
+	poller := newShardedPoller(t, &fakeMembershipStore{others: []string{"other"}}, ShardConfig{TTL: time.Second, HeartbeatInterval: 100 * time.Millisecond})
+	err := poller.RewindPosition("Object0", time.Hour)
+	if !errors.Is(err, ErrQueryNotAssigned) {
+		t.Fatalf("expected the rewind to be rejected, got %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	poller.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/queries/Object0/rewind", strings.NewReader(`{"duration": "1h"}`)))
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("expected the admin api to respond with a conflict, got %d", recorder.Code)
+	}
+}
+
+func TestWithShardingRejectsAHeartbeatIntervalAsLongAsTheTTL(t *testing.T) {
+	poller := &LightningPoller{}
+	err := WithSharding(ShardConfig{Store: &fakeMembershipStore{}, TTL: time.Second, HeartbeatInterval: time.Second})(poller)
+	if err == nil {
+		t.Fatal("expected the heartbeat interval to be rejected")
+	}
+}
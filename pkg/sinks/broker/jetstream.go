@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"context"
+	"strings"
+
+	"github.com/joomcode/errorx"
+	"github.com/nats-io/nats.go"
+)
+
+// JetStream is the part of nats.JetStreamContext that JetStreamPublisher uses,
+// so it can be replaced in tests
+type JetStream interface {
+	PublishMsgAsync(m *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error)
+}
+
+// JetStreamPublisher is a Publisher that publishes to a NATS JetStream
+// stream. Each record is published to Subject followed by its Id, such as
+// salesforce.accounts.001..., so the stream must capture subjects like
+// salesforce.accounts.>, and consumers can filter by record. Messages have a
+// Nats-Msg-Id header, so the stream discards records that are delivered again
+// within its duplicate window
+type JetStreamPublisher struct {
+	JetStream JetStream
+	Subject   string
+}
+
+// NewJetStreamPublisher creates a JetStreamPublisher that publishes to
+// subjects starting with subject
+func NewJetStreamPublisher(jetStream JetStream, subject string) *JetStreamPublisher {
+	return &JetStreamPublisher{JetStream: jetStream, Subject: subject}
+}
+
+// Publish publishes every message asynchronously, in order, then waits for
+// each acknowledgement
+func (p *JetStreamPublisher) Publish(ctx context.Context, messages []Message) error {
+	futures := make([]nats.PubAckFuture, 0, len(messages))
+	for _, message := range messages {
+		msg := nats.NewMsg(p.subject(message.Key))
+		msg.Data = message.Value
+		for name, value := range message.Headers {
+			msg.Header.Set(name, value)
+		}
+		// the same header nats.MsgId sets
+		msg.Header.Set(nats.MsgIdHdr, message.IdempotencyKey)
+		future, err := p.JetStream.PublishMsgAsync(msg)
+		if err != nil {
+			return errorx.Decorate(err, "error publishing %s", message.Key)
+		}
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-future.Ok():
+		case err := <-future.Err():
+			return errorx.Decorate(err, "jetstream didn't acknowledge %s", future.Msg().Subject)
+		}
+	}
+	return nil
+}
+
+// subject appends a record's Id to Subject. Ids are alphanumeric, but other
+// keys have the characters that separate subject tokens replaced
+func (p *JetStreamPublisher) subject(key string) string {
+	if key == "" {
+		key = "_"
+	}
+	return p.Subject + "." + strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_").Replace(key)
+}
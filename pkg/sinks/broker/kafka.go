@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaWriter is the part of kafka.Writer that KafkaPublisher uses, so it can
+// be replaced in tests
+type KafkaWriter interface {
+	WriteMessages(ctx context.Context, messages ...kafka.Message) error
+}
+
+// KafkaPublisher is a Publisher that writes to a Kafka topic. The writer
+// must be synchronous, so WriteMessages returns once the messages are
+// acknowledged
+type KafkaPublisher struct {
+	Writer KafkaWriter
+}
+
+// NewKafkaPublisher creates a KafkaPublisher with a writer for topic that
+// waits for every in sync replica to acknowledge messages, and partitions by
+// key like the Java client, so each record's messages stay in order. Pages
+// are sent without waiting to fill batches. Close the writer when the poller
+// stops
+func NewKafkaPublisher(brokers []string, topic string) (*KafkaPublisher, *kafka.Writer) {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Murmur2Balancer{},
+		RequiredAcks: kafka.RequireAll,
+		BatchSize:    2000,
+		BatchTimeout: 10 * time.Millisecond,
+	}
+	return &KafkaPublisher{Writer: writer}, writer
+}
+
+// Publish writes messages in one batch
+func (p *KafkaPublisher) Publish(ctx context.Context, messages []Message) error {
+	kafkaMessages := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		kafkaMessages[i] = kafka.Message{Key: []byte(message.Key), Value: message.Value}
+		for _, name := range sortedHeaders(message.Headers) {
+			kafkaMessages[i].Headers = append(kafkaMessages[i].Headers, kafka.Header{Key: name, Value: []byte(message.Headers[name])})
+		}
+	}
+	err := p.Writer.WriteMessages(ctx, kafkaMessages...)
+	if err != nil {
+		return errorx.Decorate(err, "error writing to kafka")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Package broker publishes records to message brokers, NATS JetStream and
+// Kafka, keyed by their Id. It's a module of its own, so the poller doesn't
+// depend on the broker clients
+package broker
+
+import (
+	"context"
+	"sort"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// broker sink message headers
+const (
+	PersistenceKeyHeader   = "Lightning-Poller-Persistence-Key"
+	ObjectTypeHeader       = "Lightning-Poller-Object-Type"
+	LastModifiedDateHeader = "Lightning-Poller-Last-Modified-Date"
+)
+
+// Message is a record published by a Sink
+type Message struct {
+	// Key is the record's Id, brokers use it to keep each record's messages
+	// in order
+	Key   string
+	Value []byte
+	// Headers has the persistence key, the record's object type from its
+	// attributes and its LastModifiedDate
+	Headers map[string]string
+	// IdempotencyKey identifies the record at its LastModifiedDate, for
+	// brokers that discard duplicates
+	IdempotencyKey string
+}
+
+// Publisher publishes messages to a message broker, such as
+// JetStreamPublisher or KafkaPublisher
+type Publisher interface {
+	// Publish publishes messages in order, and only returns once the broker
+	// has acknowledged every message
+	Publish(ctx context.Context, messages []Message) error
+}
+
+// Sink is a ready made callback that publishes each record as a
+// message to a broker, keyed by its Id. The position only advances once the
+// broker has acknowledged every message of the page
+type Sink struct {
+	Publisher Publisher
+	// Logger defaults to the app-utils-go logrus logger
+	Logger lp.Logger
+}
+
+// NewSink creates a Sink that publishes with publisher
+func NewSink(publisher Publisher) *Sink {
+	return &Sink{Publisher: publisher}
+}
+
+// ContextCallback returns a callback for QueryWithCallback.ContextCallback that
+// publishes the records of the query with the given persistence key
+func (s *Sink) ContextCallback(persistenceKey string) func(ctx context.Context, result []byte, err error) bool {
+	return func(ctx context.Context, result []byte, err error) bool {
+		err = s.Publish(ctx, persistenceKey, result)
+		if err != nil {
+			s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey}).WithError(err).Error("error publishing records")
+			return false
+		}
+		return true
+	}
+}
+
+// Callback returns a callback for QueryWithCallback.Callback, see
+// ContextCallback
+func (s *Sink) Callback(persistenceKey string) func(result []byte, err error) bool {
+	callback := s.ContextCallback(persistenceKey)
+	return func(result []byte, err error) bool {
+		return callback(context.Background(), result, err)
+	}
+}
+
+// Publish publishes a page of records, one message per record
+func (s *Sink) Publish(ctx context.Context, persistenceKey string, result []byte) error {
+	records := gjson.ParseBytes(result).Array()
+	if len(records) == 0 {
+		return nil
+	}
+	messages := make([]Message, len(records))
+	for i, record := range records {
+		messages[i] = Message{
+			Key:   record.Get("Id").String(),
+			Value: []byte(record.Raw),
+			Headers: map[string]string{
+				PersistenceKeyHeader:   persistenceKey,
+				ObjectTypeHeader:       record.Get("attributes.type").String(),
+				LastModifiedDateHeader: record.Get("LastModifiedDate").String(),
+			},
+			IdempotencyKey: lp.IdempotencyKey(persistenceKey, record),
+		}
+	}
+	return s.Publisher.Publish(ctx, messages)
+}
+
+func (s *Sink) logger() lp.Logger {
+	if s.Logger == nil {
+		return lp.NewLogrusLogger(logging.Log)
+	}
+	return s.Logger
+}
+
+func sortedHeaders(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
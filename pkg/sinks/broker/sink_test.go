@@ -0,0 +1,150 @@
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/sinks/broker"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+const page = `[
+	{"attributes":{"type":"Account"},"Id":"001A","Name":"Acme","LastModifiedDate":"2024-01-01T10:00:00.000+0000"},
+	{"attributes":{"type":"Account"},"Id":"001B","Name":"Beta","LastModifiedDate":"2024-01-01T11:00:00.000+0000"}
+]`
+
+// ackFuture is a nats.PubAckFuture that's already acknowledged, or failed
+// with err
+type ackFuture struct {
+	msg *nats.Msg
+	ok  chan *nats.PubAck
+	err chan error
+}
+
+func newAckFuture(msg *nats.Msg, err error) *ackFuture {
+	future := &ackFuture{msg: msg, ok: make(chan *nats.PubAck, 1), err: make(chan error, 1)}
+	if err != nil {
+		future.err <- err
+	} else {
+		future.ok <- &nats.PubAck{Stream: "salesforce"}
+	}
+	return future
+}
+
+func (f *ackFuture) Ok() <-chan *nats.PubAck { return f.ok }
+func (f *ackFuture) Err() <-chan error       { return f.err }
+func (f *ackFuture) Msg() *nats.Msg          { return f.msg }
+
+// fakeJetStream records published messages, and fails the acknowledgement
+// of subjects in nack
+type fakeJetStream struct {
+	msgs    []*nats.Msg
+	nack    map[string]bool
+	publish error
+}
+
+func (f *fakeJetStream) PublishMsgAsync(m *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+	if f.publish != nil {
+		return nil, f.publish
+	}
+	f.msgs = append(f.msgs, m)
+	if f.nack[m.Subject] {
+		return newAckFuture(m, errors.New("nats: timeout")), nil
+	}
+	return newAckFuture(m, nil), nil
+}
+
+func TestJetStreamSinkPublishesRecordsKeyedByID(t *testing.T) {
+	jetStream := &fakeJetStream{}
+	sink := broker.NewSink(broker.NewJetStreamPublisher(jetStream, "salesforce.accounts"))
+	if !sink.Callback("Accounts")([]byte(page), nil) {
+		t.Fatal("expected the callback to accept the page")
+	}
+	if len(jetStream.msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(jetStream.msgs))
+	}
+	msg := jetStream.msgs[0]
+	if msg.Subject != "salesforce.accounts.001A" || jetStream.msgs[1].Subject != "salesforce.accounts.001B" {
+		t.Fatalf("expected subjects keyed by Id, got %s and %s", msg.Subject, jetStream.msgs[1].Subject)
+	}
+	headers := map[string]string{
+		broker.PersistenceKeyHeader:   "Accounts",
+		broker.ObjectTypeHeader:       "Account",
+		broker.LastModifiedDateHeader: "2024-01-01T10:00:00.000+0000",
+	}
+	for name, want := range headers {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("expected header %s to be %s, got %s", name, want, got)
+		}
+	}
+	first, second := msg.Header.Get(nats.MsgIdHdr), jetStream.msgs[1].Header.Get(nats.MsgIdHdr)
+	if first == "" || first == second {
+		t.Fatalf("expected a message id per record, got %s and %s", first, second)
+	}
+}
+
+func TestJetStreamSinkRefusesPagesThatArentAcknowledged(t *testing.T) {
+	jetStream := &fakeJetStream{nack: map[string]bool{"salesforce.accounts.001B": true}}
+	sink := broker.NewSink(broker.NewJetStreamPublisher(jetStream, "salesforce.accounts"))
+	if sink.Callback("Accounts")([]byte(page), nil) {
+		t.Fatal("expected the callback to refuse a page with a failed acknowledgement")
+	}
+	jetStream = &fakeJetStream{publish: nats.ErrNoResponders}
+	sink = broker.NewSink(broker.NewJetStreamPublisher(jetStream, "salesforce.accounts"))
+	if sink.Callback("Accounts")([]byte(page), nil) {
+		t.Fatal("expected the callback to refuse a page that can't be published")
+	}
+}
+
+// fakeKafkaWriter records written messages, or fails with err
+type fakeKafkaWriter struct {
+	messages []kafka.Message
+	err      error
+}
+
+func (f *fakeKafkaWriter) WriteMessages(ctx context.Context, messages ...kafka.Message) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.messages = append(f.messages, messages...)
+	return nil
+}
+
+func TestKafkaSinkWritesRecordsKeyedByID(t *testing.T) {
+	writer := &fakeKafkaWriter{}
+	sink := broker.NewSink(&broker.KafkaPublisher{Writer: writer})
+	if !sink.Callback("Accounts")([]byte(page), nil) {
+		t.Fatal("expected the callback to accept the page")
+	}
+	if len(writer.messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(writer.messages))
+	}
+	message := writer.messages[1]
+	if string(message.Key) != "001B" {
+		t.Fatalf("expected the message to be keyed by Id, got %s", message.Key)
+	}
+	// headers are sorted by name
+	want := []kafka.Header{
+		{Key: broker.LastModifiedDateHeader, Value: []byte("2024-01-01T11:00:00.000+0000")},
+		{Key: broker.ObjectTypeHeader, Value: []byte("Account")},
+		{Key: broker.PersistenceKeyHeader, Value: []byte("Accounts")},
+	}
+	if len(message.Headers) != len(want) {
+		t.Fatalf("expected headers %v, got %v", want, message.Headers)
+	}
+	for i, header := range want {
+		if message.Headers[i].Key != header.Key || string(message.Headers[i].Value) != string(header.Value) {
+			t.Fatalf("expected headers %v, got %v", want, message.Headers)
+		}
+	}
+}
+
+func TestKafkaSinkRefusesPagesThatArentWritten(t *testing.T) {
+	writer := &fakeKafkaWriter{err: kafka.NotEnoughReplicas}
+	sink := broker.NewSink(&broker.KafkaPublisher{Writer: writer})
+	if sink.Callback("Accounts")([]byte(page), nil) {
+		t.Fatal("expected the callback to refuse a page that kafka didn't acknowledge")
+	}
+}
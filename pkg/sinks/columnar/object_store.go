@@ -0,0 +1,233 @@
+package columnar
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// ErrObjectNotFound is returned by ObjectStore.Get for objects that don't
+// exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore stores the files a Sink finishes, such as in a local
+// directory with DirStore or an S3 compatible bucket with S3Store
+type ObjectStore interface {
+	// Put stores body as name, a slash separated path, replacing any object
+	// with the same name. It must not return until the object is durable
+	Put(ctx context.Context, name string, body []byte) error
+	// Get returns the object stored as name, or ErrObjectNotFound
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// DirStore is an ObjectStore that writes objects to files in a directory
+type DirStore struct {
+	Dir string
+}
+
+// NewDirStore creates a DirStore, creating dir if it doesn't exist
+func NewDirStore(dir string) (*DirStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error creating object directory")
+	}
+	return &DirStore{Dir: dir}, nil
+}
+
+// Put writes body to a temporary file, syncs it and renames it into place,
+// so readers never see a partial file
+func (s *DirStore) Put(ctx context.Context, name string, body []byte) error {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return errorx.Decorate(err, "error creating directory for %s", name)
+	}
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return errorx.Decorate(err, "error creating %s", name)
+	}
+	_, err = file.Write(body)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errorx.Decorate(err, "error writing %s", name)
+	}
+	return syncDir(dir)
+}
+
+// Get reads the file of an object
+func (s *DirStore) Get(ctx context.Context, name string) ([]byte, error) {
+	body, err := os.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "error reading %s", name)
+	}
+	return body, nil
+}
+
+// S3Store is an ObjectStore that uploads objects to a bucket of an S3
+// compatible store, such as AWS S3 or minio, with requests signed with AWS
+// signature version 4. Buckets are addressed by path, as in
+// https://endpoint/bucket/name
+type S3Store struct {
+	// Endpoint is the url of the store, such as https://s3.us-east-1.amazonaws.com
+	Endpoint string
+	// Region defaults to us-east-1
+	Region string
+	Bucket string
+	// Prefix is prepended to object names, such as salesforce/
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is required for temporary credentials
+	SessionToken string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// Put uploads body with a single PUT request
+func (s *S3Store) Put(ctx context.Context, name string, body []byte) error {
+	status, responseBody, err := s.do(ctx, http.MethodPut, name, body)
+	if err != nil {
+		return errorx.Decorate(err, "error uploading %s", name)
+	}
+	if status < 200 || status > 299 {
+		return errorx.ExternalError.New("error uploading %s, status %d: %s", name, status, responseBody)
+	}
+	return nil
+}
+
+// Get downloads an object with a GET request
+func (s *S3Store) Get(ctx context.Context, name string) ([]byte, error) {
+	status, responseBody, err := s.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, errorx.Decorate(err, "error downloading %s", name)
+	}
+	if status == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+	if status < 200 || status > 299 {
+		return nil, errorx.ExternalError.New("error downloading %s, status %d: %s", name, status, responseBody)
+	}
+	return responseBody, nil
+}
+
+// do sends a signed request for an object, returning the response's status
+// and body
+func (s *S3Store) do(ctx context.Context, method, name string, body []byte) (int, []byte, error) {
+	objectPath := "/" + s.Bucket + "/" + s.Prefix + name
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.Endpoint, "/")+s3EscapePath(objectPath), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	s.sign(request, body, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return response.StatusCode, responseBody, nil
+}
+
+// sign adds an AWS signature version 4 authorization header to request
+func (s *S3Store) sign(request *http.Request, body []byte, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	request.Header.Set("X-Amz-Date", amzDate)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": request.URL.Host, "x-amz-content-sha256": payloadHash, "x-amz-date": amzDate}
+	if s.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.SessionToken)
+		headers = append(headers, "x-amz-security-token")
+		values["x-amz-security-token"] = s.SessionToken
+	}
+	canonicalHeaders := strings.Builder{}
+	for _, header := range headers {
+		canonicalHeaders.WriteString(header + ":" + values[header] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{request.Method, request.URL.EscapedPath(), request.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes each segment of a path as S3 expects, leaving only
+// unreserved characters as is
+func s3EscapePath(path string) string {
+	builder := strings.Builder{}
+	for _, char := range []byte(path) {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9', strings.IndexByte("-_.~/", char) >= 0:
+			builder.WriteByte(char)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", char)
+		}
+	}
+	return builder.String()
+}
+
+// syncDir syncs a directory, so a file renamed into it survives a crash
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	return handle.Sync()
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
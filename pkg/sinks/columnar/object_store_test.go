@@ -0,0 +1,153 @@
+package columnar_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/sinks/columnar"
+)
+
+func TestDirStorePutsAndGetsObjects(t *testing.T) {
+	dir := t.TempDir()
+	store, err := columnar.NewDirStore(filepath.Join(dir, "lake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = store.Put(ctx, "Accounts/dt=2024-01-01/part-1.parquet", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(ctx, "Accounts/dt=2024-01-01/part-1.parquet", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := store.Get(ctx, "Accounts/dt=2024-01-01/part-1.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "second" {
+		t.Fatalf("expected the object to be replaced, got %s", body)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "lake", "Accounts", "dt=2024-01-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "part-1.parquet" {
+		t.Fatalf("expected only the renamed file, got %v", entries)
+	}
+	_, err = store.Get(ctx, "Accounts/_schema.json")
+	if !errors.Is(err, columnar.ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+// fakeS3 records the requests it gets and keeps objects by their escaped
+// path
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	requests []*http.Request
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.EscapedPath()] = body
+	case http.MethodGet:
+		body, ok := f.objects[r.URL.EscapedPath()]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestS3StoreSignsAndEscapesRequests(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store := &columnar.S3Store{
+		Endpoint:        server.URL + "/",
+		Region:          "eu-west-1",
+		Bucket:          "lake",
+		Prefix:          "salesforce/",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+	}
+	ctx := context.Background()
+	name := "Custom+Object%5F_c/dt=2024-01-01/part 1.parquet"
+	err := store.Put(ctx, name, []byte("parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := fake.requests[0]
+	if request.Method != http.MethodPut {
+		t.Fatalf("expected a PUT, got %s", request.Method)
+	}
+	if want := "/lake/salesforce/Custom%2BObject%255F_c/dt%3D2024-01-01/part%201.parquet"; request.URL.EscapedPath() != want {
+		t.Fatalf("expected path %s, got %s", want, request.URL.EscapedPath())
+	}
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(authorization, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature=") {
+		t.Fatalf("expected a signature version 4 authorization header, got %s", authorization)
+	}
+	if request.Header.Get("X-Amz-Date") == "" || request.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Fatalf("expected the date and session token headers, got %v", request.Header)
+	}
+	body, err := store.Get(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "parquet" {
+		t.Fatalf("expected the uploaded object, got %s", body)
+	}
+	if got := fake.requests[1].Header.Get("X-Amz-Content-Sha256"); got != sha256Hex(nil) {
+		t.Fatalf("expected the hash of an empty payload, got %s", got)
+	}
+	_, err = store.Get(ctx, "Accounts/_schema.json")
+	if !errors.Is(err, columnar.ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestS3StoreReturnsErrorStatuses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+	}))
+	defer server.Close()
+	store := &columnar.S3Store{Endpoint: server.URL, Bucket: "lake"}
+	err := store.Put(context.Background(), "Accounts/part.parquet", []byte("parquet"))
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Fatalf("expected a 403 error, got %v", err)
+	}
+	_, err = store.Get(context.Background(), "Accounts/part.parquet")
+	if err == nil || errors.Is(err, columnar.ErrObjectNotFound) {
+		t.Fatalf("expected a 403 error, got %v", err)
+	}
+}
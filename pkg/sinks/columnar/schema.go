@@ -0,0 +1,110 @@
+package columnar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+
+	"github.com/joomcode/errorx"
+	"github.com/tidwall/gjson"
+)
+
+// schemaObject is the name of the object a key's schema is stored as,
+// alongside its partitions. Query engines skip files starting with an
+// underscore
+const schemaObject = "_schema.json"
+
+// schema is the kind of each column of a persistence key's files. It only
+// widens, columns are never removed and a column whose values don't match
+// its kind becomes a string column, so files written later have the columns
+// of files written earlier, with the same types unless a column was widened.
+// Columns only join the schema once they have a value that isn't null
+type schema map[string]columnKind
+
+// loadSchema reads a key's schema from the store, an empty schema if it
+// has none yet
+func loadSchema(ctx context.Context, store ObjectStore, persistenceKey string) (schema, error) {
+	body, err := store.Get(ctx, schemaName(persistenceKey))
+	if errors.Is(err, ErrObjectNotFound) {
+		return schema{}, nil
+	}
+	if err != nil {
+		return nil, errorx.Decorate(err, "error loading schema for %s", persistenceKey)
+	}
+	loaded := schema{}
+	err = json.Unmarshal(body, &loaded)
+	if err != nil {
+		return nil, errorx.Decorate(err, "invalid schema for %s", persistenceKey)
+	}
+	return loaded, nil
+}
+
+// save stores the schema, before any file that uses it
+func (s schema) save(ctx context.Context, store ObjectStore, persistenceKey string) error {
+	body, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, schemaName(persistenceKey), body)
+}
+
+// widen returns a copy of the schema with the columns of rows added and
+// widened, and whether it changed
+func (s schema) widen(rows []map[string]gjson.Result) (schema, bool) {
+	widened := schema{}
+	for column, kind := range s {
+		widened[column] = kind
+	}
+	changed := false
+	for _, row := range rows {
+		for column, value := range row {
+			kind := mergeColumnKind(widened[column], valueColumnKind(value))
+			if kind != columnNull && kind != widened[column] {
+				widened[column] = kind
+				changed = true
+			}
+		}
+	}
+	return widened, changed
+}
+
+// columns returns the schema's columns sorted by name
+func (s schema) columns() []string {
+	columns := []string{}
+	for column := range s {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func schemaName(persistenceKey string) string {
+	return url.QueryEscape(persistenceKey) + "/" + schemaObject
+}
+
+var columnKindNames = map[columnKind]string{
+	columnBoolean:   "boolean",
+	columnNumber:    "number",
+	columnTimestamp: "timestamp",
+	columnString:    "string",
+}
+
+func (k columnKind) MarshalText() ([]byte, error) {
+	name, ok := columnKindNames[k]
+	if !ok {
+		return nil, errorx.IllegalArgument.New("column kind %d has no name", k)
+	}
+	return []byte(name), nil
+}
+
+func (k *columnKind) UnmarshalText(text []byte) error {
+	for kind, name := range columnKindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return errorx.IllegalArgument.New("unknown column kind %s", text)
+}
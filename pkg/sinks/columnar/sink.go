@@ -0,0 +1,352 @@
+// Package columnar exports records to date partitioned parquet and csv files
+// for loading into a lakehouse, in a local directory or an S3 compatible
+// bucket. It's a module of its own, so the poller doesn't depend on parquet
+package columnar
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/joomcode/errorx"
+	"github.com/parquet-go/parquet-go"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// Format is a file format a Sink writes
+type Format string
+
+const (
+	Parquet Format = "parquet"
+	CSV     Format = "csv"
+)
+
+// salesforceTimeLayout is the layout of salesforce datetimes, as the poller
+// parses them
+const salesforceTimeLayout = "2006-01-02T15:04:05.000+0000"
+
+// defaultPartition is the partition of records without a partition date, as
+// hive names it
+const defaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// Sink is a ready made callback that exports records to parquet or csv
+// files for analytics, partitioned by date as in
+// Accounts/dt=2024-01-01/part-<hash>.parquet. Each page is finished into
+// files before the callback returns, so a saved position always means its
+// files are finished, and records that are finished again replace their
+// files. Use a larger page size for fewer, larger files. Each key keeps a
+// widen-only schema in the store, see schema
+type Sink struct {
+	Store ObjectStore
+	// Formats are the formats each file is written in, defaults to parquet
+	Formats []Format
+	// PartitionField is the datetime field records are partitioned by, in
+	// UTC. Defaults to LastModifiedDate
+	PartitionField string
+	// Logger defaults to the app-utils-go logrus logger
+	Logger lp.Logger
+
+	mu   sync.Mutex
+	keys map[string]*keyState
+}
+
+// keyState is a persistence key's schema
+type keyState struct {
+	mu     sync.Mutex
+	schema schema
+}
+
+// NewSink creates a Sink that writes parquet files to store
+func NewSink(store ObjectStore) *Sink {
+	return &Sink{Store: store}
+}
+
+// ParseFormat parses parquet or csv
+func ParseFormat(format string) (Format, error) {
+	switch Format(format) {
+	case Parquet, CSV:
+		return Format(format), nil
+	}
+	return "", errorx.IllegalArgument.New("unknown format %s, supported formats are parquet and csv", format)
+}
+
+// ContextCallback returns a callback for QueryWithCallback.ContextCallback that
+// exports the records of the query with the given persistence key
+func (s *Sink) ContextCallback(persistenceKey string) func(ctx context.Context, result []byte, err error) bool {
+	return func(ctx context.Context, result []byte, err error) bool {
+		err = s.Write(ctx, persistenceKey, result)
+		if err != nil {
+			s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey}).WithError(err).Error("error exporting records")
+			return false
+		}
+		return true
+	}
+}
+
+// Callback returns a callback for QueryWithCallback.Callback, see
+// ContextCallback
+func (s *Sink) Callback(persistenceKey string) func(result []byte, err error) bool {
+	callback := s.ContextCallback(persistenceKey)
+	return func(result []byte, err error) bool {
+		return callback(context.Background(), result, err)
+	}
+}
+
+// Write exports a page of records into a file per partition and format,
+// named after a hash of the Id and LastModifiedDate of its records. It
+// returns once every file is finished
+func (s *Sink) Write(ctx context.Context, persistenceKey string, result []byte) error {
+	records := gjson.ParseBytes(result).Array()
+	state := s.state(persistenceKey)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return s.finish(ctx, persistenceKey, state, records)
+}
+
+// finish writes records to a file per partition and format, widening and
+// saving the key's schema first if they have new columns
+func (s *Sink) finish(ctx context.Context, persistenceKey string, state *keyState, records []gjson.Result) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if state.schema == nil {
+		loaded, err := loadSchema(ctx, s.Store, persistenceKey)
+		if err != nil {
+			return err
+		}
+		state.schema = loaded
+	}
+	partitions := map[string][]map[string]gjson.Result{}
+	hashes := map[string][]gjson.Result{}
+	rows := []map[string]gjson.Result{}
+	for _, record := range records {
+		partition := s.partition(record)
+		row := lp.FlattenRecord(record)
+		partitions[partition] = append(partitions[partition], row)
+		hashes[partition] = append(hashes[partition], record)
+		rows = append(rows, row)
+	}
+	widened, changed := state.schema.widen(rows)
+	if changed {
+		err := widened.save(ctx, s.Store, persistenceKey)
+		if err != nil {
+			return errorx.Decorate(err, "error saving schema for %s", persistenceKey)
+		}
+		state.schema = widened
+	}
+	formats := s.Formats
+	if len(formats) == 0 {
+		formats = []Format{Parquet}
+	}
+	for _, partition := range sortedPartitions(partitions) {
+		table := &columnarTable{columns: state.schema.columns(), kinds: state.schema, rows: partitions[partition]}
+		name := fmt.Sprintf("%s/dt=%s/part-%s", url.QueryEscape(persistenceKey), partition, lp.IdempotencyKey(persistenceKey, hashes[partition]...)[:16])
+		for _, format := range formats {
+			var body []byte
+			var err error
+			switch format {
+			case Parquet:
+				body, err = table.parquet()
+			case CSV:
+				body, err = table.csv()
+			default:
+				err = errorx.IllegalArgument.New("unknown format %s", format)
+			}
+			if err != nil {
+				return errorx.Decorate(err, "error encoding %s", name)
+			}
+			err = s.Store.Put(ctx, name+"."+string(format), body)
+			if err != nil {
+				return err
+			}
+		}
+		s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey, "file": name, "records": len(table.rows)}).Debug("exported records")
+	}
+	return nil
+}
+
+func (s *Sink) state(persistenceKey string) *keyState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = map[string]*keyState{}
+	}
+	state, ok := s.keys[persistenceKey]
+	if !ok {
+		state = &keyState{}
+		s.keys[persistenceKey] = state
+	}
+	return state
+}
+
+// partition returns the date a record is partitioned by
+func (s *Sink) partition(record gjson.Result) string {
+	field := s.PartitionField
+	if field == "" {
+		field = "LastModifiedDate"
+	}
+	date, err := time.Parse(salesforceTimeLayout, record.Get(field).String())
+	if err != nil {
+		return defaultPartition
+	}
+	return date.UTC().Format("2006-01-02")
+}
+
+func (s *Sink) logger() lp.Logger {
+	if s.Logger == nil {
+		return lp.NewLogrusLogger(logging.Log)
+	}
+	return s.Logger
+}
+
+func sortedPartitions(partitions map[string][]map[string]gjson.Result) []string {
+	names := []string{}
+	for name := range partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// columnKind is the type inferred for a column from its values
+type columnKind int
+
+const (
+	columnNull columnKind = iota
+	columnBoolean
+	columnNumber
+	columnTimestamp
+	columnString
+)
+
+// columnarTable is records flattened into the columns of their key's
+// schema
+type columnarTable struct {
+	columns []string
+	kinds   schema
+	rows    []map[string]gjson.Result
+}
+
+func valueColumnKind(value gjson.Result) columnKind {
+	switch value.Type {
+	case gjson.Null:
+		return columnNull
+	case gjson.True, gjson.False:
+		return columnBoolean
+	case gjson.Number:
+		return columnNumber
+	case gjson.String:
+		if _, err := time.Parse(salesforceTimeLayout, value.String()); err == nil {
+			return columnTimestamp
+		}
+	}
+	return columnString
+}
+
+func mergeColumnKind(kind, valueKind columnKind) columnKind {
+	if kind == columnNull || kind == valueKind {
+		return valueKind
+	}
+	if valueKind == columnNull {
+		return kind
+	}
+	return columnString
+}
+
+// parquet encodes the table as a parquet file with optional columns, in the
+// order of the schema's columns, which are sorted by name
+func (t *columnarTable) parquet() ([]byte, error) {
+	group := parquet.Group{}
+	for _, column := range t.columns {
+		switch t.kinds[column] {
+		case columnBoolean:
+			group[column] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		case columnNumber:
+			group[column] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		case columnTimestamp:
+			group[column] = parquet.Optional(parquet.Timestamp(parquet.Millisecond))
+		default:
+			group[column] = parquet.Optional(parquet.String())
+		}
+	}
+	buffer := &bytes.Buffer{}
+	writer := parquet.NewWriter(buffer, parquet.NewSchema("record", group), parquet.Compression(&parquet.Zstd))
+	rows := make([]parquet.Row, len(t.rows))
+	for i, record := range t.rows {
+		row := make(parquet.Row, len(t.columns))
+		for j, column := range t.columns {
+			if record[column].Type == gjson.Null {
+				row[j] = parquet.Value{}.Level(0, 0, j)
+				continue
+			}
+			row[j] = t.parquetValue(column, record[column]).Level(0, 1, j)
+		}
+		rows[i] = row
+	}
+	_, err := writer.WriteRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (t *columnarTable) parquetValue(column string, value gjson.Result) parquet.Value {
+	switch t.kinds[column] {
+	case columnBoolean:
+		return parquet.BooleanValue(value.Bool())
+	case columnNumber:
+		return parquet.DoubleValue(value.Float())
+	case columnTimestamp:
+		timestamp, _ := time.Parse(salesforceTimeLayout, value.String())
+		return parquet.Int64Value(timestamp.UnixMilli())
+	}
+	return parquet.ByteArrayValue([]byte(csvValue(value)))
+}
+
+// csv encodes the table as a csv file with a header row. Nulls are empty
+func (t *columnarTable) csv() ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	err := writer.Write(t.columns)
+	for _, record := range t.rows {
+		if err != nil {
+			break
+		}
+		values := make([]string, len(t.columns))
+		for i, column := range t.columns {
+			values[i] = csvValue(record[column])
+		}
+		err = writer.Write(values)
+	}
+	if err != nil {
+		return nil, err
+	}
+	writer.Flush()
+	return buffer.Bytes(), writer.Error()
+}
+
+// csvValue formats a value as text, strings as is and other values as json
+func csvValue(value gjson.Result) string {
+	switch value.Type {
+	case gjson.Null:
+		return ""
+	case gjson.String:
+		return value.String()
+	case gjson.Number:
+		return strconv.FormatFloat(value.Float(), 'f', -1, 64)
+	}
+	return value.Raw
+}
@@ -0,0 +1,270 @@
+package columnar_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/sinks/columnar"
+	"github.com/parquet-go/parquet-go"
+)
+
+// memoryStore is an ObjectStore that keeps objects in memory, and fails
+// every Put while failing is set
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	failing bool
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}}
+}
+
+func (s *memoryStore) Put(ctx context.Context, name string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return errors.New("store is down")
+	}
+	s.objects[name] = append([]byte{}, body...)
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, ok := s.objects[name]
+	if !ok {
+		return nil, columnar.ErrObjectNotFound
+	}
+	return body, nil
+}
+
+func (s *memoryStore) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+// files returns the names of the objects with the given extension
+func (s *memoryStore) files(extension string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.objects {
+		if strings.HasSuffix(name, extension) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parquetFile is a parquet file read back into its columns, their types and
+// rows of values
+type parquetFile struct {
+	columns []string
+	types   map[string]string
+	rows    []map[string]parquet.Value
+}
+
+func readParquet(t *testing.T, body []byte) parquetFile {
+	t.Helper()
+	file, err := parquet.OpenFile(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := parquetFile{types: map[string]string{}}
+	for _, field := range file.Schema().Fields() {
+		read.columns = append(read.columns, field.Name())
+		read.types[field.Name()] = field.Type().String()
+	}
+	for _, group := range file.RowGroups() {
+		rows := group.Rows()
+		buffer := make([]parquet.Row, group.NumRows())
+		n, err := rows.ReadRows(buffer)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		rows.Close()
+		for _, row := range buffer[:n] {
+			values := map[string]parquet.Value{}
+			for _, value := range row {
+				values[read.columns[value.Column()]] = value
+			}
+			read.rows = append(read.rows, values)
+		}
+	}
+	return read
+}
+
+func write(t *testing.T, sink *columnar.Sink, persistenceKey, result string) {
+	t.Helper()
+	err := sink.Write(context.Background(), persistenceKey, []byte(result))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkKeepsAWidenOnlySchema(t *testing.T) {
+	store := newMemoryStore()
+	sink := columnar.NewSink(store)
+	write(t, sink, "Accounts", `[{"Id":"001A","Name":"Acme","Employees":12,"LastModifiedDate":"2024-01-01T10:00:00.000+0000"}]`)
+	write(t, sink, "Accounts", `[{"Id":"001B","Employees":"unknown","Fax":null,"LastModifiedDate":"2024-01-01T11:00:00.000+0000"}]`)
+	schema := map[string]string{}
+	err := json.Unmarshal(store.objects["Accounts/_schema.json"], &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"id": "string", "name": "string", "employees": "string", "lastmodifieddate": "timestamp"}
+	if len(schema) != len(want) {
+		t.Fatalf("expected schema %v, got %v", want, schema)
+	}
+	for column, kind := range want {
+		if schema[column] != kind {
+			t.Fatalf("expected schema %v, got %v", want, schema)
+		}
+	}
+	files := store.files(".parquet")
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %v", files)
+	}
+	// the second file keeps the name column the first one had, and has the
+	// widened employees column
+	for _, name := range files {
+		file := readParquet(t, store.objects[name])
+		if strings.Join(file.columns, ",") != "employees,id,lastmodifieddate,name" {
+			t.Fatalf("expected the schema's columns in %s, got %v", name, file.columns)
+		}
+	}
+	// a sink that starts later picks up the stored schema
+	restarted := columnar.NewSink(store)
+	write(t, restarted, "Accounts", `[{"Id":"001C","Employees":40,"LastModifiedDate":"2024-01-02T10:00:00.000+0000"}]`)
+	file := readParquet(t, store.objects[store.files(".parquet")[2]])
+	if file.types["employees"] != "STRING" || file.rows[0]["employees"].String() != "40" {
+		t.Fatalf("expected employees to stay a string column, got %s %v", file.types["employees"], file.rows)
+	}
+}
+
+func TestSinkFinishesEachPageBeforeAcknowledgingIt(t *testing.T) {
+	store := newMemoryStore()
+	sink := columnar.NewSink(store)
+	callback := sink.Callback("Accounts")
+	if !callback([]byte(`[{"Id":"001A","LastModifiedDate":"2024-01-01T10:00:00.000+0000"},{"Id":"001B","LastModifiedDate":"2024-01-02T10:00:00.000+0000"}]`), nil) {
+		t.Fatal("expected the page to be acknowledged")
+	}
+	files := store.files(".parquet")
+	if len(files) != 2 {
+		t.Fatalf("expected a finished file per partition once the page was acknowledged, got %v", files)
+	}
+	if !callback([]byte(`[{"Id":"001C","LastModifiedDate":"2024-01-02T11:00:00.000+0000"}]`), nil) {
+		t.Fatal("expected the page to be acknowledged")
+	}
+	if files := store.files(".parquet"); len(files) != 3 {
+		t.Fatalf("expected a file for the next page, got %v", files)
+	}
+}
+
+func TestSinkRefusesPagesWhileTheStoreFails(t *testing.T) {
+	store := newMemoryStore()
+	sink := columnar.NewSink(store)
+	callback := sink.Callback("Accounts")
+	page := []byte(`[{"Id":"001A","LastModifiedDate":"2024-01-01T10:00:00.000+0000"}]`)
+	store.setFailing(true)
+	if callback(page, nil) {
+		t.Fatal("expected the callback to refuse a page whose file can't be finished")
+	}
+	store.setFailing(false)
+	// the refused page is delivered again
+	if !callback(page, nil) {
+		t.Fatal("expected the page to be acknowledged once the store recovers")
+	}
+	files := store.files(".parquet")
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+	if rows := readParquet(t, store.objects[files[0]]).rows; len(rows) != 1 {
+		t.Fatalf("expected the record once, got %d rows", len(rows))
+	}
+}
+
+func TestSinkRoundTripsParquet(t *testing.T) {
+	store := newMemoryStore()
+	sink := columnar.NewSink(store)
+	write(t, sink, "Accounts", `[
+		{"attributes":{"type":"Account"},"Id":"001A","Name":"Acme","IsActive":true,"AnnualRevenue":1250.5,"Owner":{"Name":"Ann"},"LastModifiedDate":"2024-01-01T10:00:00.000+0000"},
+		{"attributes":{"type":"Account"},"Id":"001B","Name":null,"IsActive":false,"AnnualRevenue":7,"Owner":null,"LastModifiedDate":"2024-01-01T11:30:00.000+0000"}
+	]`)
+	files := store.files(".parquet")
+	if len(files) != 1 || !strings.HasPrefix(files[0], "Accounts/dt=2024-01-01/part-") {
+		t.Fatalf("expected a file in the 2024-01-01 partition, got %v", files)
+	}
+	file := readParquet(t, store.objects[files[0]])
+	wantTypes := map[string]string{"id": "STRING", "name": "STRING", "isactive": "BOOLEAN", "annualrevenue": "DOUBLE", "owner_name": "STRING", "lastmodifieddate": "TIMESTAMP(isAdjustedToUTC=true,unit=MILLIS)"}
+	for column, want := range wantTypes {
+		if file.types[column] != want {
+			t.Errorf("expected %s to be %s, got %s", column, want, file.types[column])
+		}
+	}
+	if len(file.rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(file.rows))
+	}
+	first, second := file.rows[0], file.rows[1]
+	if first["id"].String() != "001A" || first["name"].String() != "Acme" || first["owner_name"].String() != "Ann" {
+		t.Errorf("expected the first record's strings, got %v", first)
+	}
+	if !first["isactive"].Boolean() || first["annualrevenue"].Double() != 1250.5 {
+		t.Errorf("expected the first record's boolean and number, got %v", first)
+	}
+	if want := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC).UnixMilli(); first["lastmodifieddate"].Int64() != want {
+		t.Errorf("expected the first record's timestamp %d, got %d", want, first["lastmodifieddate"].Int64())
+	}
+	if !second["name"].IsNull() || !second["owner_name"].IsNull() || second["isactive"].Boolean() || second["annualrevenue"].Double() != 7 {
+		t.Errorf("expected the second record's nulls and values, got %v", second)
+	}
+}
+
+func TestSinkRoundTripsCSV(t *testing.T) {
+	store := newMemoryStore()
+	sink := columnar.NewSink(store)
+	sink.Formats = []columnar.Format{columnar.CSV}
+	write(t, sink, "Accounts", `[
+		{"Id":"001A","Name":"Acme, Inc","Employees":12,"IsActive":true,"Tags":["a","b"],"LastModifiedDate":"2024-01-01T10:00:00.000+0000"},
+		{"Id":"001B","Name":null,"Employees":1e3,"IsActive":false,"Tags":null,"LastModifiedDate":null}
+	]`)
+	files := store.files(".csv")
+	if len(files) != 2 {
+		t.Fatalf("expected a file per partition, got %v", files)
+	}
+	if !strings.HasPrefix(files[1], "Accounts/dt=__HIVE_DEFAULT_PARTITION__/") {
+		t.Fatalf("expected a record without a date in the default partition, got %v", files)
+	}
+	want := [][]string{
+		{"employees", "id", "isactive", "lastmodifieddate", "name", "tags"},
+		{"12", "001A", "true", "2024-01-01T10:00:00.000+0000", "Acme, Inc", `["a","b"]`},
+	}
+	got, err := csv.NewReader(bytes.NewReader(store.objects[files[0]])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	got, err = csv.NewReader(bytes.NewReader(store.objects[files[1]])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1000", "001B", "false", "", "", ""}; fmt.Sprint(got[1]) != fmt.Sprint(want) {
+		t.Fatalf("expected %q, got %q", want, got[1])
+	}
+}
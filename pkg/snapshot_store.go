@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/joomcode/errorx"
+)
+
+// Snapshot is the last delivered state of a record's watched fields
+type Snapshot struct {
+	// Hash is of the watched fields and their values, and whether the record
+	// is deleted. Records whose hash matches their snapshot's are suppressed
+	Hash string `json:"hash"`
+	// Fields has the json value of each watched field, used as the before
+	// values of the next change
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+// SnapshotStore persists the snapshots of records with watched fields, by
+// persistence key and record Id
+type SnapshotStore interface {
+	// Get returns the snapshots of the records with ids. Records without a
+	// snapshot are left out
+	Get(key string, ids []string) (map[string]Snapshot, error)
+	// Set saves snapshots by record Id
+	Set(key string, snapshots map[string]Snapshot) error
+	// Delete removes every snapshot of a persistence key
+	Delete(key string) error
+	Close() error
+}
+
+// BadgerSnapshotStore is the default SnapshotStore, persisting snapshots to a
+// badger database on disk. It must be a different directory from the
+// position store's
+type BadgerSnapshotStore struct {
+	db *badger.DB
+}
+
+// OpenBadgerSnapshotStore opens the badger database at path, creating it if it
+// doesn't exist
+func OpenBadgerSnapshotStore(path string) (*BadgerSnapshotStore, error) {
+	db, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error opening snapshot store")
+	}
+	return &BadgerSnapshotStore{db: db}, nil
+}
+
+func (s *BadgerSnapshotStore) Get(key string, ids []string) (map[string]Snapshot, error) {
+	snapshots := map[string]Snapshot{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			item, err := txn.Get(snapshotKey(key, id))
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			snapshot := Snapshot{}
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &snapshot)
+			})
+			if err != nil {
+				return err
+			}
+			snapshots[id] = snapshot
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errorx.Decorate(err, "error reading snapshots")
+	}
+	return snapshots, nil
+}
+
+func (s *BadgerSnapshotStore) Set(key string, snapshots map[string]Snapshot) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+	for id, snapshot := range snapshots {
+		snapshotBytes, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		err = batch.Set(snapshotKey(key, id), snapshotBytes)
+		if err != nil {
+			return errorx.Decorate(err, "error saving snapshots")
+		}
+	}
+	err := batch.Flush()
+	if err != nil {
+		return errorx.Decorate(err, "error saving snapshots")
+	}
+	return nil
+}
+
+func (s *BadgerSnapshotStore) Delete(key string) error {
+	err := s.db.DropPrefix(snapshotPrefix(key))
+	if err != nil {
+		return errorx.Decorate(err, "error deleting snapshots")
+	}
+	return nil
+}
+
+func (s *BadgerSnapshotStore) Close() error {
+	return s.db.Close()
+}
+
+func snapshotPrefix(key string) []byte {
+	return []byte(url.QueryEscape(key) + "/")
+}
+
+func snapshotKey(key, id string) []byte {
+	return append(snapshotPrefix(key), id...)
+}
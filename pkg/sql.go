@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// sqlStatement adds the table name to a statement and converts its
+// placeholders to $1, $2... if the database needs numbered ones
+func sqlStatement(statement, table string, numbered bool) string {
+	statement = fmt.Sprintf(statement, table)
+	if !numbered {
+		return statement
+	}
+	builder := strings.Builder{}
+	n := 0
+	for _, char := range statement {
+		if char == '?' {
+			n++
+			builder.WriteString(fmt.Sprintf("$%d", n))
+			continue
+		}
+		builder.WriteRune(char)
+	}
+	return builder.String()
+}
+
+// quoteIdentifier quotes a table or column name, so reserved words like order
+// and group can be used as names. Each part of a schema qualified name is
+// quoted on its own. Names are quoted with double quotes, or backticks for
+// mysql
+func quoteIdentifier(name string, backticks bool) string {
+	quote := `"`
+	if backticks {
+		quote = "`"
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = quote + strings.ReplaceAll(part, quote, quote+quote) + quote
+	}
+	return strings.Join(parts, ".")
+}
+
+// sqlExecer is a *sql.DB or *sql.Tx
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// sqlQueryer is a *sql.DB or *sql.Tx that can also be read from
+type sqlQueryer interface {
+	sqlExecer
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// upsertSavepoint is the savepoint an insert is rolled back to in a
+// transaction when the row already exists
+const upsertSavepoint = "lightning_poller_upsert"
+
+// sqlUpsert runs update, then insert if update didn't change a row. Some
+// databases don't count rows that already have the new values, so update is
+// retried if insert fails because the row exists. In a transaction the insert
+// runs in a savepoint, since a failed statement aborts the whole transaction
+// on postgres until it's rolled back
+func sqlUpsert(ctx context.Context, db sqlExecer, update string, updateArgs []any, insert string, insertArgs []any) error {
+	result, err := db.ExecContext(ctx, update, updateArgs...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+	_, inTx := db.(*sql.Tx)
+	if inTx {
+		_, err = db.ExecContext(ctx, "SAVEPOINT "+upsertSavepoint)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, insert, insertArgs...)
+	if err == nil {
+		if inTx {
+			_, err = db.ExecContext(ctx, "RELEASE SAVEPOINT "+upsertSavepoint)
+		}
+		return err
+	}
+	if inTx {
+		_, rollbackErr := db.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+upsertSavepoint)
+		if rollbackErr != nil {
+			return err
+		}
+	}
+	_, retryErr := db.ExecContext(ctx, update, updateArgs...)
+	if retryErr != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// SQLLeaser is a Leaser that keeps each lease in a row of a table, for
+// replicas that share a database. Rows are only changed with conditional
+// updates, so it works with any database that has row level atomicity
+type SQLLeaser struct {
+	DB *sql.DB
+	// Table defaults to lightning_poller_leases
+	Table string
+	// NumberedPlaceholders uses $1, $2... placeholders, for postgres, instead
+	// of ?
+	NumberedPlaceholders bool
+}
+
+// NewSQLLeaser creates a SQLLeaser using the default table
+func NewSQLLeaser(db *sql.DB) *SQLLeaser {
+	return &SQLLeaser{DB: db}
+}
+
+// CreateTable creates the lease table if it doesn't exist
+func (l *SQLLeaser) CreateTable(ctx context.Context) error {
+	_, err := l.DB.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	name VARCHAR(255) NOT NULL PRIMARY KEY,
+	holder VARCHAR(255) NOT NULL,
+	token BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL
+)`, l.table()))
+	if err != nil {
+		return errorx.Decorate(err, "error creating lease table")
+	}
+	return nil
+}
+
+func (l *SQLLeaser) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (Lease, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl).UnixNano()
+	// take over the lease if this holder has it or it has expired, bumping the
+	// token when the holder changes
+	result, err := l.DB.ExecContext(ctx, l.query(`UPDATE %s SET token = CASE WHEN holder = ? THEN token ELSE token + 1 END, holder = ?, expires_at = ? WHERE name = ? AND (holder = ? OR expires_at < ?)`),
+		holder, holder, expiresAt, name, holder, now.UnixNano())
+	if err != nil {
+		return Lease{}, errorx.Decorate(err, "error acquiring lease %s", name)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return Lease{}, errorx.Decorate(err, "error acquiring lease %s", name)
+	}
+	if updated == 0 {
+		_, insertErr := l.DB.ExecContext(ctx, l.query(`INSERT INTO %s (name, holder, token, expires_at) VALUES (?, ?, 1, ?)`), name, holder, expiresAt)
+		if insertErr != nil {
+			// another holder has the row, either from before or from an
+			// insert that raced with this one
+			lease, err := l.get(ctx, name)
+			if errors.Is(err, sql.ErrNoRows) {
+				return Lease{}, errorx.Decorate(insertErr, "error acquiring lease %s", name)
+			}
+			if err != nil {
+				return Lease{}, err
+			}
+			return lease, ErrLeaseHeld
+		}
+	}
+	return l.get(ctx, name)
+}
+
+func (l *SQLLeaser) Release(ctx context.Context, name, holder string) error {
+	// keep the token, so the next holder's is higher
+	_, err := l.DB.ExecContext(ctx, l.query(`UPDATE %s SET expires_at = 0 WHERE name = ? AND holder = ?`), name, holder)
+	if err != nil {
+		return errorx.Decorate(err, "error releasing lease %s", name)
+	}
+	return nil
+}
+
+func (l *SQLLeaser) get(ctx context.Context, name string) (Lease, error) {
+	lease := Lease{Name: name}
+	var token, expiresAt int64
+	err := l.DB.QueryRowContext(ctx, l.query(`SELECT holder, token, expires_at FROM %s WHERE name = ?`), name).Scan(&lease.Holder, &token, &expiresAt)
+	if err != nil {
+		return lease, errorx.Decorate(err, "error reading lease %s", name)
+	}
+	lease.Token = uint64(token)
+	lease.ExpiresAt = time.Unix(0, expiresAt)
+	return lease, nil
+}
+
+func (l *SQLLeaser) table() string {
+	if l.Table == "" {
+		return "lightning_poller_leases"
+	}
+	return l.Table
+}
+
+func (l *SQLLeaser) query(statement string) string {
+	return sqlStatement(statement, l.table(), l.NumberedPlaceholders)
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// SQLMembershipStore is a MembershipStore that keeps members in a table of a
+// database shared by the fleet
+type SQLMembershipStore struct {
+	DB *sql.DB
+	// Table defaults to lightning_poller_members
+	Table string
+	// NumberedPlaceholders uses $1, $2... placeholders, for postgres, instead
+	// of ?
+	NumberedPlaceholders bool
+}
+
+// NewSQLMembershipStore creates a SQLMembershipStore using the default table
+func NewSQLMembershipStore(db *sql.DB) *SQLMembershipStore {
+	return &SQLMembershipStore{DB: db}
+}
+
+// CreateTable creates the members table if it doesn't exist
+func (s *SQLMembershipStore) CreateTable(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	fleet VARCHAR(255) NOT NULL,
+	member VARCHAR(255) NOT NULL,
+	expires_at BIGINT NOT NULL,
+	PRIMARY KEY (fleet, member)
+)`, s.table()))
+	if err != nil {
+		return errorx.Decorate(err, "error creating members table")
+	}
+	return nil
+}
+
+func (s *SQLMembershipStore) Heartbeat(ctx context.Context, fleet, member string, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl).UnixNano()
+	err := sqlUpsert(ctx, s.DB,
+		s.query(`UPDATE %s SET expires_at = ? WHERE fleet = ? AND member = ?`), []any{expiresAt, fleet, member},
+		s.query(`INSERT INTO %s (fleet, member, expires_at) VALUES (?, ?, ?)`), []any{fleet, member, expiresAt})
+	if err != nil {
+		return errorx.Decorate(err, "error heartbeating")
+	}
+	return nil
+}
+
+func (s *SQLMembershipStore) Members(ctx context.Context, fleet string) ([]string, error) {
+	rows, err := s.DB.QueryContext(ctx, s.query(`SELECT member FROM %s WHERE fleet = ? AND expires_at > ?`), fleet, time.Now().UnixNano())
+	if err != nil {
+		return nil, errorx.Decorate(err, "error listing members")
+	}
+	defer rows.Close()
+	members := []string{}
+	for rows.Next() {
+		var member string
+		err = rows.Scan(&member)
+		if err != nil {
+			return nil, errorx.Decorate(err, "error listing members")
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (s *SQLMembershipStore) Leave(ctx context.Context, fleet, member string) error {
+	_, err := s.DB.ExecContext(ctx, s.query(`DELETE FROM %s WHERE fleet = ? AND member = ?`), fleet, member)
+	if err != nil {
+		return errorx.Decorate(err, "error leaving fleet")
+	}
+	return nil
+}
+
+func (s *SQLMembershipStore) table() string {
+	if s.Table == "" {
+		return "lightning_poller_members"
+	}
+	return s.Table
+}
+
+func (s *SQLMembershipStore) query(statement string) string {
+	return sqlStatement(statement, s.table(), s.NumberedPlaceholders)
+}
@@ -0,0 +1,329 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// SQLMirrorSink is a ready made TxCallback that keeps a copy of each query's
+// records in a table, upserted by Id. Fields are flattened into columns, so
+// Owner.Name is stored in owner_name, and columns are added as new fields are
+// seen. Use it with a SQLPositionStore in the same database, so records and
+// positions are committed together
+type SQLMirrorSink struct {
+	DB *sql.DB
+	// Tables maps persistence keys to table names, which can be schema
+	// qualified. By default a persistence key's table is the key in lower
+	// case, with characters other than letters, digits and underscores
+	// replaced with underscores. Names are quoted, so they're case sensitive
+	Tables map[string]string
+	// HardDelete deletes the rows of records with IsDeleted set, instead of
+	// keeping them with isdeleted set. Either way, the query must select
+	// IsDeleted for deletes to be mirrored
+	HardDelete bool
+	// NumberedPlaceholders uses $1, $2... placeholders, for postgres, instead
+	// of ?
+	NumberedPlaceholders bool
+	// BacktickIdentifiers quotes table and column names with backticks, for
+	// mysql, instead of double quotes
+	BacktickIdentifiers bool
+	// Describe optionally returns the fields of a persistence key's object,
+	// such as with OAuthClient.Describe, to create their columns with the
+	// types salesforce reports when the table is first used. Otherwise
+	// columns are typed from the first value seen
+	Describe func(ctx context.Context, persistenceKey string) ([]SObjectField, error)
+	// Logger defaults to the app-utils-go logrus logger
+	Logger Logger
+
+	mu sync.Mutex
+	// columns caches the columns of each table, except id
+	columns map[string]map[string]bool
+}
+
+// NewSQLMirrorSink creates a SQLMirrorSink with the default settings
+func NewSQLMirrorSink(db *sql.DB) *SQLMirrorSink {
+	return &SQLMirrorSink{DB: db}
+}
+
+// TxCallback returns a callback for QueryWithCallback.TxCallback that mirrors
+// the records of the query with the given persistence key
+func (s *SQLMirrorSink) TxCallback(persistenceKey string) func(ctx context.Context, tx *sql.Tx, result []byte) error {
+	return func(ctx context.Context, tx *sql.Tx, result []byte) error {
+		return s.Write(ctx, tx, persistenceKey, result)
+	}
+}
+
+// Write upserts or deletes a page of records in the persistence key's table,
+// creating the table and adding columns as needed
+func (s *SQLMirrorSink) Write(ctx context.Context, tx *sql.Tx, persistenceKey string, result []byte) (err error) {
+	table := s.table(persistenceKey)
+	defer func() {
+		if err != nil {
+			// schema changes are rolled back with the transaction on most
+			// databases, so read the table's columns again next time
+			s.forgetColumns(table)
+		}
+	}()
+	columns, err := s.tableColumns(ctx, tx, persistenceKey, table)
+	if err != nil {
+		return err
+	}
+	for _, record := range gjson.ParseBytes(result).Array() {
+		id := record.Get("Id").String()
+		if id == "" {
+			return errorx.IllegalArgument.New("can't mirror a record without an Id in %s", table)
+		}
+		if s.HardDelete && record.Get("IsDeleted").Bool() {
+			_, err = tx.ExecContext(ctx, s.query(`DELETE FROM %s WHERE id = ?`, table), id)
+			if err != nil {
+				return errorx.Decorate(err, "error deleting %s from %s", id, table)
+			}
+			continue
+		}
+		fields := FlattenRecord(record)
+		delete(fields, "id")
+		for _, column := range sortedColumns(fields) {
+			if columns[column] || fields[column].Type == gjson.Null {
+				continue
+			}
+			err = s.addColumn(ctx, tx, table, column, valueColumnType(fields[column]))
+			if err != nil {
+				return err
+			}
+			columns[column] = true
+		}
+		err = s.upsert(ctx, tx, table, id, columns, fields)
+		if err != nil {
+			return errorx.Decorate(err, "error upserting %s into %s", id, table)
+		}
+	}
+	s.mu.Lock()
+	s.columns[table] = columns
+	s.mu.Unlock()
+	return nil
+}
+
+// upsert sets every column of the record's row, columns the record doesn't
+// have are set to null
+func (s *SQLMirrorSink) upsert(ctx context.Context, tx *sql.Tx, table, id string, columns map[string]bool, fields map[string]gjson.Result) error {
+	// a table without other columns updates id to itself
+	assignments, insertColumns := []string{"id = ?"}, []string{"id"}
+	updateArgs, insertArgs := []any{id}, []any{id}
+	if len(columns) > 0 {
+		assignments, updateArgs = nil, nil
+	}
+	for _, column := range sortedColumns(columns) {
+		value := columnValue(fields[column])
+		assignments = append(assignments, s.quote(column)+" = ?")
+		insertColumns = append(insertColumns, s.quote(column))
+		updateArgs = append(updateArgs, value)
+		insertArgs = append(insertArgs, value)
+	}
+	update := fmt.Sprintf(`UPDATE %%s SET %s WHERE id = ?`, strings.Join(assignments, ", "))
+	insert := fmt.Sprintf(`INSERT INTO %%s (%s) VALUES (?%s)`, strings.Join(insertColumns, ", "), strings.Repeat(", ?", len(insertColumns)-1))
+	return sqlUpsert(ctx, tx, s.query(update, table), append(updateArgs, id), s.query(insert, table), insertArgs)
+}
+
+// tableColumns returns the table's columns, creating it and the columns of
+// the described fields if it's the first time it's used
+func (s *SQLMirrorSink) tableColumns(ctx context.Context, tx *sql.Tx, persistenceKey, table string) (map[string]bool, error) {
+	s.mu.Lock()
+	cached, ok := s.columns[table]
+	if s.columns == nil {
+		s.columns = map[string]map[string]bool{}
+	}
+	s.mu.Unlock()
+	columns := map[string]bool{}
+	if ok {
+		for column := range cached {
+			columns[column] = true
+		}
+		return columns, nil
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id VARCHAR(18) NOT NULL PRIMARY KEY)`, s.quote(table)))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error creating table %s", table)
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM %s WHERE 1 = 0`, s.quote(table)))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error reading columns of %s", table)
+	}
+	names, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, errorx.Decorate(err, "error reading columns of %s", table)
+	}
+	for _, name := range names {
+		if name = strings.ToLower(name); name != "id" {
+			columns[name] = true
+		}
+	}
+	if s.Describe == nil {
+		return columns, nil
+	}
+	fields, err := s.Describe(ctx, persistenceKey)
+	if err != nil {
+		// columns are still added as fields are seen
+		s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey}).WithError(err).Warn("error describing fields, typing columns from their values")
+		return columns, nil
+	}
+	for _, field := range fields {
+		column, columnType := columnName(field.Name), describedColumnType(field.Type)
+		if column == "id" || columns[column] || columnType == "" {
+			continue
+		}
+		err = s.addColumn(ctx, tx, table, column, columnType)
+		if err != nil {
+			return nil, err
+		}
+		columns[column] = true
+	}
+	return columns, nil
+}
+
+func (s *SQLMirrorSink) addColumn(ctx context.Context, tx *sql.Tx, table, column, columnType string) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, s.quote(table), s.quote(column), columnType))
+	if err != nil {
+		return errorx.Decorate(err, "error adding column %s to %s", column, table)
+	}
+	s.logger().WithFields(logrus.Fields{"table": table, "column": column, "type": columnType}).Info("added mirror column")
+	return nil
+}
+
+func (s *SQLMirrorSink) forgetColumns(table string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.columns, table)
+}
+
+func (s *SQLMirrorSink) table(persistenceKey string) string {
+	if table, ok := s.Tables[persistenceKey]; ok {
+		return table
+	}
+	return columnName(persistenceKey)
+}
+
+func (s *SQLMirrorSink) query(statement, table string) string {
+	return sqlStatement(statement, s.quote(table), s.NumberedPlaceholders)
+}
+
+func (s *SQLMirrorSink) quote(name string) string {
+	return quoteIdentifier(name, s.BacktickIdentifiers)
+}
+
+func (s *SQLMirrorSink) logger() Logger {
+	if s.Logger == nil {
+		return defaultLogger()
+	}
+	return s.Logger
+}
+
+// FlattenRecord returns the fields of a record by column name, with the fields
+// of related records and compound fields prefixed by the field they're in, so
+// Owner.Name is owner_name. Salesforce's attributes are skipped
+func FlattenRecord(record gjson.Result) map[string]gjson.Result {
+	fields := map[string]gjson.Result{}
+	flattenRecord("", record, fields)
+	return fields
+}
+
+func flattenRecord(prefix string, record gjson.Result, fields map[string]gjson.Result) {
+	record.ForEach(func(name, value gjson.Result) bool {
+		if name.String() == "attributes" {
+			return true
+		}
+		column := columnName(prefix + name.String())
+		if value.IsObject() {
+			flattenRecord(column+"_", value, fields)
+			return true
+		}
+		fields[column] = value
+		return true
+	})
+}
+
+// columnName converts a field name into a lower case column name, which
+// databases that fold unquoted names to lower case return as is
+func columnName(name string) string {
+	return strings.Map(func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z', char >= '0' && char <= '9', char == '_':
+			return char
+		case char >= 'A' && char <= 'Z':
+			return char + 'a' - 'A'
+		}
+		return '_'
+	}, name)
+}
+
+func valueColumnType(value gjson.Result) string {
+	switch value.Type {
+	case gjson.True, gjson.False:
+		return "BOOLEAN"
+	case gjson.Number:
+		return "DOUBLE PRECISION"
+	}
+	return "TEXT"
+}
+
+// describedColumnType returns the column type for a salesforce field type, or
+// an empty string for compound fields, whose parts are columns of their own
+func describedColumnType(fieldType string) string {
+	switch fieldType {
+	case "address", "location":
+		return ""
+	case "boolean":
+		return "BOOLEAN"
+	case "int":
+		return "BIGINT"
+	case "double", "currency", "percent":
+		return "DOUBLE PRECISION"
+	}
+	return "TEXT"
+}
+
+// columnValue converts a json value into a value for a column, arrays are
+// stored as json
+func columnValue(value gjson.Result) any {
+	switch value.Type {
+	case gjson.Null:
+		return nil
+	case gjson.True, gjson.False:
+		return value.Bool()
+	case gjson.Number:
+		if value.Num == math.Trunc(value.Num) && math.Abs(value.Num) < 1<<53 {
+			return int64(value.Num)
+		}
+		return value.Num
+	case gjson.String:
+		return value.String()
+	}
+	return value.Raw
+}
+
+// sortedColumns returns the keys of a map of columns in order, so statements
+// are the same for the same columns
+func sortedColumns(columns interface{}) []string {
+	names := []string{}
+	switch columns := columns.(type) {
+	case map[string]bool:
+		for column := range columns {
+			names = append(names, column)
+		}
+	case map[string]gjson.Result:
+		for column := range columns {
+			names = append(names, column)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,253 @@
+package pkg_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+	"github.com/joomcode/errorx"
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "mirror.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// writeMirror writes a page of records in its own transaction
+func writeMirror(t *testing.T, db *sql.DB, mirror *lp.SQLMirrorSink, persistenceKey, result string) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mirror.Write(context.Background(), tx, persistenceKey, []byte(result))
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func columns(t *testing.T, db *sql.DB, table string) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT * FROM "` + table + `" WHERE 1 = 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	names, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func count(t *testing.T, db *sql.DB, query string, args ...any) int {
+	t.Helper()
+	var n int
+	err := db.QueryRow(query, args...).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLMirrorSinkCreatesTableAndAddsColumns(t *testing.T) {
+	db := openSQLite(t)
+	mirror := lp.NewSQLMirrorSink(db)
+	writeMirror(t, db, mirror, "Accounts", `[{"attributes":{"type":"Account"},"Id":"001A","Name":"Acme","Owner":{"Name":"Ann"}}]`)
+	got := columns(t, db, "accounts")
+	want := []string{"id", "name", "owner_name"}
+	if len(got) != len(want) {
+		t.Fatalf("expected columns %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected columns %v, got %v", want, got)
+		}
+	}
+	// a field seen for the first time gets a column of its own
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001B","Name":"Beta","Employees":12}]`)
+	if got = columns(t, db, "accounts"); len(got) != 4 || got[3] != "employees" {
+		t.Fatalf("expected an employees column, got %v", got)
+	}
+	var employees int
+	err := db.QueryRow(`SELECT employees FROM accounts WHERE id = ?`, "001B").Scan(&employees)
+	if err != nil || employees != 12 {
+		t.Fatalf("expected 12 employees, got %d, %v", employees, err)
+	}
+}
+
+func TestSQLMirrorSinkUpsertsByID(t *testing.T) {
+	db := openSQLite(t)
+	mirror := lp.NewSQLMirrorSink(db)
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001A","Name":"Acme","Industry":"Retail"}]`)
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001A","Name":"Acme Corp"}]`)
+	if n := count(t, db, `SELECT count(*) FROM accounts`); n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+	var name string
+	var industry sql.NullString
+	err := db.QueryRow(`SELECT name, industry FROM accounts WHERE id = ?`, "001A").Scan(&name, &industry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Acme Corp" {
+		t.Errorf("expected the name to be updated, got %s", name)
+	}
+	// columns the record doesn't have are set to null
+	if industry.Valid {
+		t.Errorf("expected industry to be null, got %s", industry.String)
+	}
+}
+
+func TestSQLMirrorSinkQuotesReservedNames(t *testing.T) {
+	db := openSQLite(t)
+	mirror := lp.NewSQLMirrorSink(db)
+	writeMirror(t, db, mirror, "Order", `[{"Id":"801A","Group":"a","Order":1,"Select":true}]`)
+	writeMirror(t, db, mirror, "Order", `[{"Id":"801A","Group":"b","Order":2,"Select":false}]`)
+	var group string
+	err := db.QueryRow(`SELECT "group" FROM "order" WHERE id = ?`, "801A").Scan(&group)
+	if err != nil || group != "b" {
+		t.Fatalf("expected group b, got %s, %v", group, err)
+	}
+}
+
+func TestSQLMirrorSinkSoftDeletes(t *testing.T) {
+	db := openSQLite(t)
+	mirror := lp.NewSQLMirrorSink(db)
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001A","Name":"Acme","IsDeleted":false}]`)
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001A","Name":"Acme","IsDeleted":true}]`)
+	if n := count(t, db, `SELECT count(*) FROM accounts WHERE isdeleted`); n != 1 {
+		t.Fatalf("expected the deleted record to be kept with isdeleted set, got %d rows", n)
+	}
+}
+
+func TestSQLMirrorSinkHardDeletes(t *testing.T) {
+	db := openSQLite(t)
+	mirror := lp.NewSQLMirrorSink(db)
+	mirror.HardDelete = true
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001A","Name":"Acme","IsDeleted":false},{"Id":"001B","Name":"Beta","IsDeleted":false}]`)
+	writeMirror(t, db, mirror, "Accounts", `[{"Id":"001A","Name":"Acme","IsDeleted":true}]`)
+	if n := count(t, db, `SELECT count(*) FROM accounts`); n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+	if n := count(t, db, `SELECT count(*) FROM accounts WHERE id = ?`, "001A"); n != 0 {
+		t.Fatal("expected the deleted record's row to be deleted")
+	}
+}
+
+func TestSQLMirrorSinkCommitsPositionWithRows(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account",
+		pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate.Add(-time.Minute), "Name": "Acme"},
+		pollertest.Record{"Id": "001B", "LastModifiedDate": lastModifiedDate, "Name": "Beta"})
+	db := openSQLite(t)
+	store := lp.NewSQLPositionStore(db)
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := lp.NewSQLMirrorSink(db)
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		TxCallback:     mirror.TxCallback("Accounts"),
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, `SELECT count(*) FROM accounts`); n != 2 {
+		t.Fatalf("expected 2 rows, got %d", n)
+	}
+	position, err := store.Get("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !position.LastModifiedDate.Equal(lastModifiedDate) {
+		t.Fatalf("expected the position at %s, got %s", lastModifiedDate, position.LastModifiedDate)
+	}
+}
+
+func TestSQLMirrorSinkRollsBackPositionWithRows(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now().Add(-time.Hour), "Name": "Acme"})
+	db := openSQLite(t)
+	store := lp.NewSQLPositionStore(db)
+	err := store.CreateTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := lp.NewSQLMirrorSink(db)
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		TxCallback: func(ctx context.Context, tx *sql.Tx, result []byte) error {
+			err := mirror.Write(ctx, tx, "Accounts", result)
+			if err != nil {
+				return err
+			}
+			return errors.New("downstream failed")
+		},
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	positions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 0 {
+		t.Fatalf("expected no position to be saved, got %v", positions)
+	}
+	if n := count(t, db, `SELECT count(*) FROM sqlite_master WHERE name = 'accounts'`); n != 0 {
+		t.Fatal("expected the mirror table to be rolled back")
+	}
+}
+
+func TestTxCallbackRequiresPersistence(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("LP_PERSISTENCE_ENABLED", "false")
+	db := openSQLite(t)
+	mirror := lp.NewSQLMirrorSink(db)
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		TxCallback:     mirror.TxCallback("Accounts"),
+	}
+	server := pollertest.NewServer()
+	defer server.Close()
+	// the environment turns persistence back off after the position store
+	_, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(lp.NewSQLPositionStore(db)), lp.WithEnvConfig())
+	if !errorx.IsOfType(err, errorx.IllegalArgument) || !strings.Contains(err.Error(), "requires persistence") {
+		t.Fatalf("expected the TxCallback to be rejected without persistence, got %v", err)
+	}
+}
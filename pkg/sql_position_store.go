@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+// SQLPositionStore is a PositionStore that keeps positions in a table, so
+// they can be shared by replicas, such as a sharded fleet. It's also a
+// TxPositionStore, for queries with a TxCallback, and a FencedPositionStore
+// that keeps the lease each position was saved with. The poller doesn't close
+// the database
+type SQLPositionStore struct {
+	DB *sql.DB
+	// Table defaults to lightning_poller_positions. It can be schema
+	// qualified, and it's quoted, so it's case sensitive
+	Table string
+	// NumberedPlaceholders uses $1, $2... placeholders, for postgres, instead
+	// of ?
+	NumberedPlaceholders bool
+	// BacktickIdentifiers quotes the table name with backticks, for mysql,
+	// instead of double quotes
+	BacktickIdentifiers bool
+}
+
+// NewSQLPositionStore creates a SQLPositionStore using the default table
+func NewSQLPositionStore(db *sql.DB) *SQLPositionStore {
+	return &SQLPositionStore{DB: db}
+}
+
+// CreateTable creates the positions table if it doesn't exist, and adds the
+// lease columns to tables created before positions were fenced
+func (s *SQLPositionStore) CreateTable(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	persistence_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	position TEXT NOT NULL,
+	lease_name VARCHAR(255),
+	lease_token BIGINT
+)`, s.table()))
+	if err != nil {
+		return errorx.Decorate(err, "error creating positions table")
+	}
+	rows, err := s.DB.QueryContext(ctx, s.query(`SELECT lease_name, lease_token FROM %s WHERE 1 = 0`))
+	if err == nil {
+		return rows.Close()
+	}
+	for _, column := range []string{"lease_name VARCHAR(255)", "lease_token BIGINT"} {
+		_, err = s.DB.ExecContext(ctx, s.query(`ALTER TABLE %s ADD COLUMN `+column))
+		if err != nil {
+			return errorx.Decorate(err, "error adding lease columns to positions table")
+		}
+	}
+	return nil
+}
+
+func (s *SQLPositionStore) Get(key string) (*Position, error) {
+	var positionJSON string
+	err := s.DB.QueryRow(s.query(`SELECT position FROM %s WHERE persistence_key = ?`), key).Scan(&positionJSON)
+	// if the key is not found, then return a new position with zero state
+	if errors.Is(err, sql.ErrNoRows) {
+		return &Position{LastModifiedDate: &time.Time{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var position *Position
+	err = json.Unmarshal([]byte(positionJSON), &position)
+	return position, err
+}
+
+func (s *SQLPositionStore) Set(key string, position Position) error {
+	return s.set(context.Background(), s.DB, key, position)
+}
+
+func (s *SQLPositionStore) set(ctx context.Context, db sqlExecer, key string, position Position) error {
+	positionBytes, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	return sqlUpsert(ctx, db,
+		s.query(`UPDATE %s SET position = ? WHERE persistence_key = ?`), []any{string(positionBytes), key},
+		s.query(`INSERT INTO %s (persistence_key, position) VALUES (?, ?)`), []any{key, string(positionBytes)})
+}
+
+// SetFenced saves a position unless it was last saved with a newer token of
+// the same lease, in which case it returns ErrLeaseLost
+func (s *SQLPositionStore) SetFenced(ctx context.Context, key string, position Position, lease Lease) error {
+	return s.setFenced(ctx, s.DB, key, position, lease)
+}
+
+// setFenced updates the position only if its lease token isn't newer. When
+// no row is updated, the row is read to tell a missing position, which is
+// inserted, from a newer token or an unchanged row
+func (s *SQLPositionStore) setFenced(ctx context.Context, db sqlQueryer, key string, position Position, lease Lease) error {
+	positionBytes, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	token := int64(lease.Token)
+	result, err := db.ExecContext(ctx, s.query(`UPDATE %s SET position = ?, lease_name = ?, lease_token = ? WHERE persistence_key = ? AND (lease_token IS NULL OR lease_name <> ? OR lease_token <= ?)`),
+		string(positionBytes), lease.Name, token, key, lease.Name, token)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+	var savedName sql.NullString
+	var savedToken sql.NullInt64
+	err = db.QueryRowContext(ctx, s.query(`SELECT lease_name, lease_token FROM %s WHERE persistence_key = ?`), key).Scan(&savedName, &savedToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = db.ExecContext(ctx, s.query(`INSERT INTO %s (persistence_key, position, lease_name, lease_token) VALUES (?, ?, ?, ?)`),
+			key, string(positionBytes), lease.Name, token)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if savedName.String == lease.Name && savedToken.Int64 > token {
+		return ErrLeaseLost
+	}
+	// some databases don't count rows that already have the new values
+	return nil
+}
+
+func (s *SQLPositionStore) Delete(key string) error {
+	_, err := s.DB.Exec(s.query(`DELETE FROM %s WHERE persistence_key = ?`), key)
+	return err
+}
+
+func (s *SQLPositionStore) List() (map[string]*Position, error) {
+	rows, err := s.DB.Query(s.query(`SELECT persistence_key, position FROM %s`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	positions := map[string]*Position{}
+	for rows.Next() {
+		var key, positionJSON string
+		err = rows.Scan(&key, &positionJSON)
+		if err != nil {
+			return nil, err
+		}
+		var position *Position
+		err = json.Unmarshal([]byte(positionJSON), &position)
+		if err != nil {
+			return nil, err
+		}
+		positions[key] = position
+	}
+	return positions, rows.Err()
+}
+
+// Close does nothing, the database belongs to the caller
+func (s *SQLPositionStore) Close() error {
+	return nil
+}
+
+// Ping returns an error if the database can't be reached
+func (s *SQLPositionStore) Ping() error {
+	return s.DB.Ping()
+}
+
+// table returns the quoted table name
+func (s *SQLPositionStore) table() string {
+	table := s.Table
+	if table == "" {
+		table = "lightning_poller_positions"
+	}
+	return quoteIdentifier(table, s.BacktickIdentifiers)
+}
+
+func (s *SQLPositionStore) query(statement string) string {
+	return sqlStatement(statement, s.table(), s.NumberedPlaceholders)
+}
+
+func (s *SQLPositionStore) BeginTx(ctx context.Context) (*sql.Tx, error) {
+	return s.DB.BeginTx(ctx, nil)
+}
+
+func (s *SQLPositionStore) SetTx(ctx context.Context, tx *sql.Tx, key string, position Position) error {
+	return s.set(ctx, tx, key, position)
+}
+
+// SetTxFenced is SetFenced in tx
+func (s *SQLPositionStore) SetTxFenced(ctx context.Context, tx *sql.Tx, key string, position Position, lease Lease) error {
+	return s.setFenced(ctx, tx, key, position, lease)
+}
@@ -0,0 +1,196 @@
+package pkg_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+func TestSQLPositionStoreRejectsStaleLeaseTokens(t *testing.T) {
+	ctx := context.Background()
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := lp.NewPositionAt(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	older := lp.NewPositionAt(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	err = store.SetFenced(ctx, "Accounts", newer, lp.Lease{Name: "lightning-poller", Token: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetFenced(ctx, "Accounts", older, lp.Lease{Name: "lightning-poller", Token: 1})
+	if !errors.Is(err, lp.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+	position, err := store.Get("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !position.LastModifiedDate.Equal(*newer.LastModifiedDate) {
+		t.Fatalf("expected the newer position to be kept, got %v", position.LastModifiedDate)
+	}
+	// the same token saves again, as does another lease's token, such as
+	// after the lease scope changes
+	for _, lease := range []lp.Lease{{Name: "lightning-poller", Token: 2}, {Name: "lightning-poller/Accounts", Token: 1}} {
+		err = store.SetFenced(ctx, "Accounts", newer, lease)
+		if err != nil {
+			t.Fatalf("expected %+v to save, got %v", lease, err)
+		}
+	}
+	// unfenced saves, such as the positions subcommands, keep the lease
+	err = store.Set("Accounts", older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetFenced(ctx, "Accounts", older, lp.Lease{Name: "lightning-poller/Accounts", Token: 0})
+	if !errors.Is(err, lp.ErrLeaseLost) {
+		t.Fatalf("expected ErrLeaseLost after an unfenced save, got %v", err)
+	}
+}
+
+func TestSQLPositionStoreAddsLeaseColumnsToExistingTables(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	_, err := db.Exec(`CREATE TABLE lightning_poller_positions (persistence_key VARCHAR(255) NOT NULL PRIMARY KEY, position TEXT NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := lp.NewSQLPositionStore(db)
+	for i := 0; i < 2; i++ {
+		err = store.CreateTable(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.SetFenced(ctx, "Accounts", lp.NewPositionAt(time.Now()), lp.Lease{Name: "lightning-poller", Token: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollsDontOverwriteAPositionSavedWithANewerLease(t *testing.T) {
+	ctx := context.Background()
+	server := pollertest.NewServer()
+	defer server.Close()
+	lastModifiedDate := time.Now().Add(-time.Hour).UTC().Truncate(time.Millisecond)
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": lastModifiedDate, "Name": "Acme"})
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	err := store.CreateTable(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// another replica has since held the lease, and saved an older position
+	saved := lp.NewPositionAt(lastModifiedDate.Add(-24 * time.Hour))
+	err = store.SetFenced(ctx, "Accounts", saved, lp.Lease{Name: "lightning-poller", Token: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaser, err := lp.NewFileLeaser(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := lp.QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return true },
+	}
+	poller, err := lp.New(lp.WithSalesforceClient(server.Client()), lp.WithQueries(query), lp.WithPositionStore(store), lp.WithLastModifiedDateCorrection(0),
+		lp.WithLeases(lp.LeaseConfig{Leaser: leaser}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the poll is handed over, like when the leaser reports the lease lost
+	_, err = poller.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position, err := store.Get("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !position.LastModifiedDate.Equal(*saved.LastModifiedDate) {
+		t.Fatalf("expected the position saved with the newer lease to be kept, got %v", position.LastModifiedDate)
+	}
+}
+
+func TestSQLPositionStoreQuotesItsTable(t *testing.T) {
+	ctx := context.Background()
+	store := lp.NewSQLPositionStore(openSQLite(t))
+	store.Table = "Order"
+	err := store.CreateTable(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position := lp.NewPositionAt(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	err = store.SetFenced(ctx, "Accounts", position, lp.Lease{Name: "lightning-poller", Token: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Set("Contacts", position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 2 || !positions["Accounts"].LastModifiedDate.Equal(*position.LastModifiedDate) {
+		t.Fatalf("expected both positions in the quoted table, got %v", positions)
+	}
+	err = store.Delete("Contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLPositionStoreUpsertsAnUncountedRowInATransaction(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	store := lp.NewSQLPositionStore(db)
+	err := store.CreateTable(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := lp.NewPositionAt(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	err = store.Set("Accounts", older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// updates of the row aren't counted, like mysql with unchanged rows, so
+	// the insert fails on the existing row
+	_, err = db.Exec(`CREATE TRIGGER uncounted BEFORE UPDATE ON lightning_poller_positions WHEN OLD.persistence_key = 'Accounts' BEGIN SELECT RAISE(IGNORE); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := store.BeginTx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	newer := lp.NewPositionAt(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	err = store.SetTx(ctx, tx, "Accounts", newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the transaction is still usable after the failed insert
+	err = store.SetTx(ctx, tx, "Contacts", newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	position, err := store.Get("Contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !position.LastModifiedDate.Equal(*newer.LastModifiedDate) {
+		t.Fatalf("expected the position saved after the failed insert to commit, got %v", position.LastModifiedDate)
+	}
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import "time"
+
+// QueryStats counts the work done for a single persistence key
+type QueryStats struct {
+	// RecordsDelivered is the number of records passed to the callback that
+	// the callback acknowledged by returning true
+	RecordsDelivered int64 `json:"records_delivered"`
+	// Pages is the number of responses received from salesforce
+	Pages int64 `json:"pages"`
+	// Errors is the number of polls that ended with an error
+	Errors int64 `json:"errors"`
+}
+
+// recordPage records a response from salesforce with the number of records
+// fetched, before already queried records are removed
+func (p *LightningPoller) recordPage(key string, fetched int) {
+	p.metrics.recordsFetched.WithLabelValues(key, p.orgOf(key)).Add(float64(fetched))
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	p.getQueryStats(key).Pages++
+}
+
+func (p *LightningPoller) recordDelivered(key string, count int) {
+	p.metrics.recordsDelivered.WithLabelValues(key, p.orgOf(key)).Add(float64(count))
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	p.getQueryStats(key).RecordsDelivered += int64(count)
+}
+
+func (p *LightningPoller) recordError(key string, err error) {
+	p.metrics.pollsFailed.WithLabelValues(key, p.orgOf(key)).Inc()
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	p.getQueryStats(key).Errors++
+	status := p.getQueryStatus(key)
+	status.lastError = err
+	status.lastErrorTime = p.clock.Now()
+	status.consecutiveFailures++
+}
+
+// recordSuccess records a poll that caught up without any errors
+func (p *LightningPoller) recordSuccess(key string) {
+	p.metrics.pollsSucceeded.WithLabelValues(key, p.orgOf(key)).Inc()
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	status := p.getQueryStatus(key)
+	status.lastSuccessTime = p.clock.Now()
+	status.consecutiveFailures = 0
+}
+
+// recordProgress records that a query's position advanced, or that it caught
+// up with salesforce
+func (p *LightningPoller) recordProgress(key string) {
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	p.getQueryStatus(key).lastProgressTime = p.clock.Now()
+}
+
+// queryStatus tracks the outcome of recent polls for a persistence key
+type queryStatus struct {
+	lastError           error
+	lastErrorTime       time.Time
+	lastSuccessTime     time.Time
+	consecutiveFailures int
+	// lastProgressTime is when the query's position last advanced, or when
+	// it was last caught up
+	lastProgressTime time.Time
+}
+
+// getQueryStatus returns the status for a key, creating it if it doesn't
+// exist. callers must hold queryStatsMu
+func (p *LightningPoller) getQueryStatus(key string) *queryStatus {
+	status, ok := p.queryStatuses[key]
+	if !ok {
+		status = &queryStatus{}
+		p.queryStatuses[key] = status
+	}
+	return status
+}
+
+// copyQueryStatus returns a snapshot of the stats and status for a key
+func (p *LightningPoller) copyQueryStatus(key string) (QueryStats, queryStatus) {
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	return *p.getQueryStats(key), *p.getQueryStatus(key)
+}
+
+// getQueryStats returns the stats for a key, creating them if they don't
+// exist. callers must hold queryStatsMu
+func (p *LightningPoller) getQueryStats(key string) *QueryStats {
+	stats, ok := p.queryStats[key]
+	if !ok {
+		stats = &QueryStats{}
+		p.queryStats[key] = stats
+	}
+	return stats
+}
+
+// resetQueryStats zeroes the stats for every key
+func (p *LightningPoller) resetQueryStats() {
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	for key := range p.queryStats {
+		p.queryStats[key] = &QueryStats{}
+	}
+}
+
+// copyQueryStats returns a snapshot of the stats for every key
+func (p *LightningPoller) copyQueryStats() map[string]QueryStats {
+	p.queryStatsMu.Lock()
+	defer p.queryStatsMu.Unlock()
+	stats := make(map[string]QueryStats, len(p.queryStats))
+	for key, value := range p.queryStats {
+		stats[key] = *value
+	}
+	return stats
+}
@@ -0,0 +1,359 @@
+// Package stream retains records in a local change log, and streams them to
+// remote consumers over server-sent events and gRPC, so many consumers can
+// share one poller. It's a module of its own, so the poller doesn't depend on
+// gRPC
+package stream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// changeLogGCInterval is how often the change log reclaims space from
+// expired records
+const changeLogGCInterval = 5 * time.Minute
+
+// ErrOffsetExpired is returned when reading after an offset whose next change
+// has expired, so the reader would miss changes. Readers have to start again
+// from a later offset, such as 0 for the oldest retained change's
+var ErrOffsetExpired = errors.New("offset is older than the oldest retained change")
+
+// Change is a record in a ChangeLog
+type Change struct {
+	// Offset is the record's position in its persistence key's log, starting
+	// at 1
+	Offset           int64  `json:"offset"`
+	PersistenceKey   string `json:"persistence_key"`
+	ID               string `json:"id"`
+	LastModifiedDate string `json:"last_modified_date"`
+	// Record is the record's json
+	Record []byte `json:"-"`
+}
+
+// ChangeLog is a ready made callback that retains records in a local log per
+// persistence key, in a badger database, for a Server to stream to
+// consumers. Each record gets the next offset in its key's log, and is
+// synced to disk before the callback returns. Consumers can commit the
+// offset they've processed up to as their cursor, and resume from it
+type ChangeLog struct {
+	db        *badger.DB
+	retention time.Duration
+	logger    lp.Logger
+
+	// appendMu orders appends, so offsets are assigned in order
+	appendMu sync.Mutex
+	mu       sync.Mutex
+	// waiters are closed when records are appended to a key's log, waking
+	// the consumers following it
+	waiters map[string]chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// OpenChangeLog opens the change log at path, creating it if it doesn't
+// exist. Records are removed once they're older than retention, or kept until
+// they're removed some other way if it's zero
+func OpenChangeLog(path string, retention time.Duration) (*ChangeLog, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithSyncWrites(true))
+	if err != nil {
+		return nil, errorx.Decorate(err, "error opening change log")
+	}
+	log := &ChangeLog{
+		db:        db,
+		retention: retention,
+		logger:    lp.NewLogrusLogger(logging.Log).WithFields(logrus.Fields{"path": path}),
+		waiters:   map[string]chan struct{}{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go log.collectGarbage()
+	return log, nil
+}
+
+// ContextCallback returns a callback for QueryWithCallback.ContextCallback that
+// appends the records of the query with the given persistence key
+func (l *ChangeLog) ContextCallback(persistenceKey string) func(ctx context.Context, result []byte, err error) bool {
+	return func(ctx context.Context, result []byte, err error) bool {
+		err = l.Append(persistenceKey, result)
+		if err != nil {
+			l.logger.WithFields(logrus.Fields{"persistence_key": persistenceKey}).WithError(err).Error("error appending records to change log")
+			return false
+		}
+		return true
+	}
+}
+
+// Callback returns a callback for QueryWithCallback.Callback, see
+// ContextCallback
+func (l *ChangeLog) Callback(persistenceKey string) func(result []byte, err error) bool {
+	callback := l.ContextCallback(persistenceKey)
+	return func(result []byte, err error) bool {
+		return callback(context.Background(), result, err)
+	}
+}
+
+// Append adds a page of records to the persistence key's log. A page too big
+// for one transaction is committed in parts, so a failed append may have
+// added some of its records, which are appended again when it's retried
+func (l *ChangeLog) Append(persistenceKey string, result []byte) error {
+	records := gjson.ParseBytes(result).Array()
+	if len(records) == 0 {
+		return nil
+	}
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+	txn := l.db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	offset, err := lastOffset(txn, persistenceKey)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		offset++
+		entry := badger.NewEntry(changeKey(persistenceKey, offset), []byte(record.Raw))
+		if l.retention > 0 {
+			entry = entry.WithTTL(l.retention)
+		}
+		err = txn.SetEntry(entry)
+		if errors.Is(err, badger.ErrTxnTooBig) {
+			// commit the records that fit, and continue in a new transaction
+			err = commitOffset(txn, persistenceKey, offset-1)
+			if err != nil {
+				return err
+			}
+			txn = l.db.NewTransaction(true)
+			err = txn.SetEntry(entry)
+		}
+		if err != nil {
+			return errorx.Decorate(err, "error appending to change log")
+		}
+	}
+	err = commitOffset(txn, persistenceKey, offset)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if waiter, ok := l.waiters[persistenceKey]; ok {
+		close(waiter)
+		delete(l.waiters, persistenceKey)
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// Read returns up to limit changes of the persistence key's log after offset.
+// It returns ErrOffsetExpired if the change after offset has expired. Reading
+// after 0 starts from the oldest retained change
+func (l *ChangeLog) Read(persistenceKey string, after int64, limit int) ([]Change, error) {
+	changes := []Change{}
+	if after < 0 {
+		after = 0
+	}
+	prefix := changePrefix(persistenceKey)
+	var expired error
+	err := l.db.View(func(txn *badger.Txn) error {
+		options := badger.DefaultIteratorOptions
+		options.Prefix = prefix
+		iterator := txn.NewIterator(options)
+		defer iterator.Close()
+		for iterator.Seek(changeKey(persistenceKey, after+1)); iterator.Valid() && len(changes) < limit; iterator.Next() {
+			item := iterator.Item()
+			record, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, Change{
+				Offset:           int64(binary.BigEndian.Uint64(item.Key()[len(prefix):])),
+				PersistenceKey:   persistenceKey,
+				ID:               gjson.GetBytes(record, "Id").String(),
+				LastModifiedDate: gjson.GetBytes(record, "LastModifiedDate").String(),
+				Record:           record,
+			})
+		}
+		// offsets have no gaps, so a missing next offset has expired
+		next := int64(0)
+		if len(changes) > 0 {
+			next = changes[0].Offset
+		} else {
+			last, err := lastOffset(txn, persistenceKey)
+			if err != nil || last <= after {
+				return err
+			}
+			next = last + 1
+		}
+		if after > 0 && next > after+1 {
+			expired = fmt.Errorf("%w: reading %s after %d, changes before %d have expired", ErrOffsetExpired, persistenceKey, after, next)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errorx.Decorate(err, "error reading change log")
+	}
+	if expired != nil {
+		return nil, expired
+	}
+	return changes, nil
+}
+
+// Follow calls send with each change of the persistence key's log after
+// offset, then with changes as they're appended, until ctx is done or send
+// returns an error
+func (l *ChangeLog) Follow(ctx context.Context, persistenceKey string, after int64, send func(change Change) error) error {
+	const batchSize = 500
+	for {
+		// wait on the waiter from before reading, so an append while reading
+		// isn't missed
+		appended := l.waiter(persistenceKey)
+		changes, err := l.Read(persistenceKey, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			err = send(change)
+			if err != nil {
+				return err
+			}
+			after = change.Offset
+		}
+		if len(changes) == batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// Cursor returns the offset a consumer of the persistence key's log has
+// committed, or zero if it hasn't
+func (l *ChangeLog) Cursor(persistenceKey, consumer string) (int64, error) {
+	var offset int64
+	err := l.db.View(func(txn *badger.Txn) error {
+		var err error
+		offset, err = readOffset(txn, cursorKey(persistenceKey, consumer))
+		return err
+	})
+	if err != nil {
+		return 0, errorx.Decorate(err, "error reading cursor")
+	}
+	return offset, nil
+}
+
+// Commit saves offset as a consumer's cursor for the persistence key's log
+func (l *ChangeLog) Commit(persistenceKey, consumer string, offset int64) error {
+	err := l.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(cursorKey(persistenceKey, consumer), offsetBytes(offset))
+	})
+	if err != nil {
+		return errorx.Decorate(err, "error committing cursor")
+	}
+	return nil
+}
+
+// Close stops reclaiming space and closes the database
+func (l *ChangeLog) Close() error {
+	close(l.stop)
+	<-l.done
+	return l.db.Close()
+}
+
+func (l *ChangeLog) waiter(persistenceKey string) <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	waiter, ok := l.waiters[persistenceKey]
+	if !ok {
+		waiter = make(chan struct{})
+		l.waiters[persistenceKey] = waiter
+	}
+	return waiter
+}
+
+// collectGarbage reclaims space in badger's value log, from records that have
+// expired, until the log is closed
+func (l *ChangeLog) collectGarbage() {
+	defer close(l.done)
+	ticker := time.NewTicker(changeLogGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			// each run rewrites at most one file, so run until there's nothing
+			// left to rewrite
+			for l.db.RunValueLogGC(0.5) == nil {
+			}
+		}
+	}
+}
+
+// lastOffset returns the offset of the last record appended to the
+// persistence key's log, which is kept after the record expires
+func lastOffset(txn *badger.Txn, persistenceKey string) (int64, error) {
+	offset, err := readOffset(txn, []byte("offset/"+url.QueryEscape(persistenceKey)))
+	if err != nil {
+		return 0, errorx.Decorate(err, "error reading change log offset")
+	}
+	return offset, nil
+}
+
+func commitOffset(txn *badger.Txn, persistenceKey string, offset int64) error {
+	err := txn.Set([]byte("offset/"+url.QueryEscape(persistenceKey)), offsetBytes(offset))
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		return errorx.Decorate(err, "error appending to change log")
+	}
+	return nil
+}
+
+func readOffset(txn *badger.Txn, key []byte) (int64, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var offset int64
+	err = item.Value(func(value []byte) error {
+		offset = int64(binary.BigEndian.Uint64(value))
+		return nil
+	})
+	return offset, err
+}
+
+// changePrefix is the prefix of the keys of a persistence key's records,
+// which are followed by their offset in big endian, so they sort in order
+func changePrefix(persistenceKey string) []byte {
+	return []byte(fmt.Sprintf("change/%s/", url.QueryEscape(persistenceKey)))
+}
+
+func changeKey(persistenceKey string, offset int64) []byte {
+	return append(changePrefix(persistenceKey), offsetBytes(offset)...)
+}
+
+func cursorKey(persistenceKey, consumer string) []byte {
+	return []byte(fmt.Sprintf("cursor/%s/%s", url.QueryEscape(persistenceKey), url.QueryEscape(consumer)))
+}
+
+func offsetBytes(offset int64) []byte {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(offset))
+	return bytes
+}
@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	lightningpollerv1 "github.com/catalystsquad/salesforce-lightning-poller/proto/lightningpoller/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// openExpiredLog opens a change log whose first two changes of Accounts have
+// expired, and whose third is retained
+func openExpiredLog(t *testing.T) *ChangeLog {
+	t.Helper()
+	log, err := OpenChangeLog(t.TempDir(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+	err = log.Append("Accounts", []byte(`[{"Id":"001A"},{"Id":"001B"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// badger expires entries by the second
+	time.Sleep(2100 * time.Millisecond)
+	log.retention = time.Hour
+	err = log.Append("Accounts", []byte(`[{"Id":"001C"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func TestChangeLogReadFailsAfterAnExpiredOffset(t *testing.T) {
+	log := openExpiredLog(t)
+	_, err := log.Read("Accounts", 1, 10)
+	if !errors.Is(err, ErrOffsetExpired) {
+		t.Fatalf("expected ErrOffsetExpired, got %v", err)
+	}
+	// the next change is retained
+	changes, err := log.Read("Accounts", 2, 10)
+	if err != nil || len(changes) != 1 || changes[0].Offset != 3 {
+		t.Fatalf("expected offset 3, got %+v, %v", changes, err)
+	}
+	// reading from the start skips to the oldest retained change
+	changes, err = log.Read("Accounts", 0, 10)
+	if err != nil || len(changes) != 1 || changes[0].Offset != 3 {
+		t.Fatalf("expected offset 3, got %+v, %v", changes, err)
+	}
+	// reading after the last offset waits for new changes
+	changes, err = log.Read("Accounts", 3, 10)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes, got %+v, %v", changes, err)
+	}
+	err = log.Follow(context.Background(), "Accounts", 1, func(change Change) error { return nil })
+	if !errors.Is(err, ErrOffsetExpired) {
+		t.Fatalf("expected following to fail with ErrOffsetExpired, got %v", err)
+	}
+}
+
+func TestServerRejectsExpiredOffsets(t *testing.T) {
+	log := openExpiredLog(t)
+	server := NewServer(log)
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	response, err := http.Get(httpServer.URL + "/streams/Accounts?after=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusGone {
+		t.Fatalf("expected 410, got %d", response.StatusCode)
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	server.RegisterGRPC(grpcServer)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := lightningpollerv1.NewChangeStreamClient(conn).Subscribe(context.Background(), &lightningpollerv1.SubscribeRequest{PersistenceKey: "Accounts", AfterOffset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stream.Recv()
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FAILED_PRECONDITION, got %v", err)
+	}
+}
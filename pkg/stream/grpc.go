@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"context"
+	"errors"
+
+	lightningpollerv1 "github.com/catalystsquad/salesforce-lightning-poller/proto/lightningpoller/v1"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// changeStreamServer implements the lightningpoller.v1.ChangeStream service
+// generated from proto/lightningpoller/v1/stream.proto. Subscribing after an
+// offset whose next change has expired fails with FAILED_PRECONDITION
+type changeStreamServer struct {
+	lightningpollerv1.UnimplementedChangeStreamServer
+	server *Server
+}
+
+func (c *changeStreamServer) Subscribe(request *lightningpollerv1.SubscribeRequest, stream lightningpollerv1.ChangeStream_SubscribeServer) error {
+	s := c.server
+	persistenceKey, consumer := request.GetPersistenceKey(), request.GetConsumer()
+	if persistenceKey == "" {
+		return status.Error(codes.InvalidArgument, "persistence_key is required")
+	}
+	after, err := s.resumeOffset(persistenceKey, consumer, request.GetAfterOffset())
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	logger := s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey, "consumer": consumer})
+	logger.Debug("grpc consumer subscribed")
+	defer logger.Debug("grpc consumer unsubscribed")
+	err = s.Log.Follow(stream.Context(), persistenceKey, after, func(change Change) error {
+		return stream.Send(&lightningpollerv1.Change{
+			Offset:           change.Offset,
+			PersistenceKey:   change.PersistenceKey,
+			Id:               change.ID,
+			LastModifiedDate: change.LastModifiedDate,
+			Record:           change.Record,
+		})
+	})
+	if errors.Is(err, ErrOffsetExpired) {
+		logger.WithError(err).Warn("consumer subscribed after expired changes")
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil && stream.Context().Err() == nil {
+		logger.WithError(err).Error("error streaming changes")
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func (c *changeStreamServer) Commit(ctx context.Context, request *lightningpollerv1.CommitRequest) (*lightningpollerv1.CommitResponse, error) {
+	persistenceKey, consumer := request.GetPersistenceKey(), request.GetConsumer()
+	if persistenceKey == "" || consumer == "" {
+		return nil, status.Error(codes.InvalidArgument, "persistence_key and consumer are required")
+	}
+	err := c.server.Log.Commit(persistenceKey, consumer, request.GetOffset())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &lightningpollerv1.CommitResponse{}, nil
+}
@@ -0,0 +1,241 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/catalystsquad/app-utils-go/logging"
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+	lightningpollerv1 "github.com/catalystsquad/salesforce-lightning-poller/proto/lightningpoller/v1"
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// Server streams the records retained in a ChangeLog to remote
+// consumers over server-sent events and gRPC, so many consumers can share one
+// poller. Each consumer can commit the offset it has processed up to, and
+// resume from it when it reconnects
+type Server struct {
+	Log *ChangeLog
+	// HeartbeatInterval is how often an idle server-sent event stream sends a
+	// comment, so proxies don't close it. Defaults to 15s
+	HeartbeatInterval time.Duration
+	// Logger defaults to the app-utils-go logrus logger
+	Logger lp.Logger
+}
+
+// NewServer creates a Server for log
+func NewServer(log *ChangeLog) *Server {
+	return &Server{Log: log}
+}
+
+// cursorRequest is the body of a commit request, and the response to reading
+// a cursor
+type cursorRequest struct {
+	Offset int64 `json:"offset"`
+}
+
+// Handler returns an http handler that serves:
+//
+//	GET  /streams/{key}                       server-sent events of the key's changes
+//	GET  /streams/{key}/consumers/{consumer}  a consumer's cursor, as {"offset": 10}
+//	POST /streams/{key}/consumers/{consumer}  commit a consumer's cursor, with a body of {"offset": 10}
+//
+// Each change is an event with its offset as the event id, and its record as
+// the data. A stream starts after the offset in the Last-Event-ID header, so
+// reconnecting clients resume where they left off, otherwise after the after
+// query parameter, otherwise after the cursor of the consumer query
+// parameter, otherwise from the start of the log. Starting after an offset
+// whose next change has expired responds with 410 Gone, and a stream whose
+// next change expires while it's behind ends with an error event
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+// RegisterGRPC registers the lightningpoller.v1.ChangeStream service, from
+// proto/lightningpoller/v1/stream.proto, on server
+func (s *Server) RegisterGRPC(server *grpc.Server) {
+	lightningpollerv1.RegisterChangeStreamServer(server, &changeStreamServer{server: s})
+}
+
+// ListenAndServe serves the http handler on address, if it isn't empty, and
+// the gRPC service on grpcAddress, if it isn't empty, until one of them stops
+func (s *Server) ListenAndServe(address, grpcAddress string) error {
+	if address == "" && grpcAddress == "" {
+		return errorx.IllegalArgument.New("stream server requires an address")
+	}
+	errs := make(chan error, 2)
+	if address != "" {
+		s.logger().WithFields(logrus.Fields{"address": address}).Info("serving change streams")
+		go func() { errs <- http.ListenAndServe(address, s.Handler()) }()
+	}
+	if grpcAddress != "" {
+		listener, err := net.Listen("tcp", grpcAddress)
+		if err != nil {
+			return errorx.Decorate(err, "error listening on %s", grpcAddress)
+		}
+		server := grpc.NewServer()
+		s.RegisterGRPC(server)
+		s.logger().WithFields(logrus.Fields{"address": grpcAddress}).Info("serving grpc change streams")
+		go func() { errs <- server.Serve(listener) }()
+	}
+	return <-errs
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "streams" && r.Method == http.MethodGet:
+		s.serveEvents(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "streams" && parts[2] == "consumers" && r.Method == http.MethodGet:
+		offset, err := s.Log.Cursor(parts[1], parts[3])
+		if err != nil {
+			writeStreamError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeStreamJSON(w, http.StatusOK, cursorRequest{Offset: offset})
+	case len(parts) == 4 && parts[0] == "streams" && parts[2] == "consumers" && r.Method == http.MethodPost:
+		request := cursorRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeStreamError(w, http.StatusBadRequest, errorx.Decorate(err, "invalid cursor"))
+			return
+		}
+		err = s.Log.Commit(parts[1], parts[3], request.Offset)
+		if err != nil {
+			writeStreamError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeStreamJSON(w, http.StatusOK, request)
+	default:
+		writeStreamError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// serveEvents streams a key's changes as server-sent events until the client
+// disconnects
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request, key string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStreamError(w, http.StatusInternalServerError, errors.New("streaming isn't supported"))
+		return
+	}
+	after, err := s.eventsStart(r, key)
+	if err != nil {
+		writeStreamError(w, http.StatusBadRequest, err)
+		return
+	}
+	// check the start before the response is committed to a stream
+	_, err = s.Log.Read(key, after, 1)
+	if errors.Is(err, ErrOffsetExpired) {
+		writeStreamError(w, http.StatusGone, err)
+		return
+	}
+	if err != nil {
+		writeStreamError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	logger := s.logger().WithFields(logrus.Fields{"persistence_key": key, "consumer": r.URL.Query().Get("consumer")})
+	logger.Debug("consumer subscribed")
+	// heartbeats and events are written from different goroutines
+	mu := sync.Mutex{}
+	write := func(format string, args ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := fmt.Fprintf(w, format, args...)
+		if err == nil {
+			flusher.Flush()
+		}
+		return err
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(s.heartbeatInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if write(": heartbeat\n\n") != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	err = s.Log.Follow(ctx, key, after, func(change Change) error {
+		return write("id: %d\nevent: change\ndata: %s\n\n", change.Offset, change.Record)
+	})
+	if errors.Is(err, ErrOffsetExpired) {
+		data, _ := json.Marshal(streamError{Error: err.Error()})
+		write("event: error\ndata: %s\n\n", data)
+	}
+	if err != nil && ctx.Err() == nil {
+		logger.WithError(err).Error("error streaming changes")
+	}
+	logger.Debug("consumer unsubscribed")
+}
+
+// eventsStart returns the offset a server-sent event stream starts after
+func (s *Server) eventsStart(r *http.Request, key string) (int64, error) {
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		return strconv.ParseInt(lastEventID, 10, 64)
+	}
+	if after := r.URL.Query().Get("after"); after != "" {
+		return strconv.ParseInt(after, 10, 64)
+	}
+	return s.resumeOffset(key, r.URL.Query().Get("consumer"), 0)
+}
+
+// resumeOffset returns after if it's set, otherwise the consumer's cursor.
+// gRPC can't tell an after_offset of 0 from none, so 0 means the cursor
+func (s *Server) resumeOffset(key, consumer string, after int64) (int64, error) {
+	if after > 0 || consumer == "" {
+		return after, nil
+	}
+	return s.Log.Cursor(key, consumer)
+}
+
+func (s *Server) heartbeatInterval() time.Duration {
+	if s.HeartbeatInterval <= 0 {
+		return 15 * time.Second
+	}
+	return s.HeartbeatInterval
+}
+
+func (s *Server) logger() lp.Logger {
+	if s.Logger == nil {
+		return lp.NewLogrusLogger(logging.Log)
+	}
+	return s.Logger
+}
+
+// streamError is the body of an error response, as the admin api returns them
+type streamError struct {
+	Error string `json:"error"`
+}
+
+func writeStreamError(w http.ResponseWriter, status int, err error) {
+	writeStreamJSON(w, status, streamError{Error: err.Error()})
+}
+
+func writeStreamJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lightningpollerv1 "github.com/catalystsquad/salesforce-lightning-poller/proto/lightningpoller/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// openLog opens a change log with offsets 1 to 3 of Accounts
+func openLog(t *testing.T) *ChangeLog {
+	t.Helper()
+	log, err := OpenChangeLog(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+	err = log.Append("Accounts", []byte(`[{"Id":"001A"},{"Id":"001B"},{"Id":"001C"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+// firstEventID streams url, with the Last-Event-ID header if it isn't empty,
+// and returns the id of the first event
+func firstEventID(t *testing.T, url, lastEventID string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		if id := strings.TrimPrefix(scanner.Text(), "id: "); id != scanner.Text() {
+			return id
+		}
+	}
+	t.Fatalf("expected an event, got %v", scanner.Err())
+	return ""
+}
+
+func TestServerResumesAConsumerFromItsCommittedCursor(t *testing.T) {
+	server := NewServer(openLog(t))
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+	response, err := http.Post(httpServer.URL+"/streams/Accounts/consumers/indexer", "application/json", strings.NewReader(`{"offset": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected the cursor to be committed, got %d", response.StatusCode)
+	}
+	if id := firstEventID(t, httpServer.URL+"/streams/Accounts?consumer=indexer", ""); id != "3" {
+		t.Fatalf("expected the consumer to resume after its cursor, got offset %s", id)
+	}
+	// a reconnecting client resumes after its last event, whatever its cursor
+	if id := firstEventID(t, httpServer.URL+"/streams/Accounts?consumer=indexer", "1"); id != "2" {
+		t.Fatalf("expected the stream to resume after the last event id, got offset %s", id)
+	}
+	if id := firstEventID(t, httpServer.URL+"/streams/Accounts?consumer=indexer&after=0", ""); id != "1" {
+		t.Fatalf("expected after=0 to replay from the start, got offset %s", id)
+	}
+}
+
+func TestGRPCResumesAConsumerFromItsCommittedCursor(t *testing.T) {
+	server := NewServer(openLog(t))
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	server.RegisterGRPC(grpcServer)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := lightningpollerv1.NewChangeStreamClient(conn)
+	firstOffset := func(request *lightningpollerv1.SubscribeRequest) int64 {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stream, err := client.Subscribe(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return change.Offset
+	}
+	commit := func(offset int64) {
+		t.Helper()
+		_, err := client.Commit(context.Background(), &lightningpollerv1.CommitRequest{PersistenceKey: "Accounts", Consumer: "indexer", Offset: offset})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit(2)
+	if offset := firstOffset(&lightningpollerv1.SubscribeRequest{PersistenceKey: "Accounts", Consumer: "indexer"}); offset != 3 {
+		t.Fatalf("expected the consumer to resume after its cursor, got offset %d", offset)
+	}
+	if offset := firstOffset(&lightningpollerv1.SubscribeRequest{PersistenceKey: "Accounts", Consumer: "indexer", AfterOffset: 1}); offset != 2 {
+		t.Fatalf("expected after_offset to take precedence over the cursor, got offset %d", offset)
+	}
+	// a zero after_offset means the cursor, so replaying from the start takes
+	// a subscription without the consumer, or its cursor committed back to 0
+	if offset := firstOffset(&lightningpollerv1.SubscribeRequest{PersistenceKey: "Accounts"}); offset != 1 {
+		t.Fatalf("expected a subscription without a consumer to start from the start, got offset %d", offset)
+	}
+	commit(0)
+	if offset := firstOffset(&lightningpollerv1.SubscribeRequest{PersistenceKey: "Accounts", Consumer: "indexer"}); offset != 1 {
+		t.Fatalf("expected a cursor committed back to 0 to replay from the start, got offset %d", offset)
+	}
+}
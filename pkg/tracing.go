@@ -0,0 +1,98 @@
+package pkg
+
+import (
+	"context"
+
+	"github.com/catalystsquad/salesforce-utils/pkg"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses the global tracer provider, so spans are only exported once
+// the application configures one with otel.SetTracerProvider
+var tracer = otel.Tracer("github.com/catalystsquad/salesforce-lightning-poller")
+
+// span attribute keys
+const (
+	persistenceKeyAttribute = attribute.Key("lightning_poller.persistence_key")
+	pageSizeAttribute       = attribute.Key("lightning_poller.page_size")
+	cursorAttribute         = attribute.Key("lightning_poller.cursor")
+	nextURLUsedAttribute    = attribute.Key("lightning_poller.next_url_used")
+	recordCountAttribute    = attribute.Key("lightning_poller.record_count")
+)
+
+// salesforce request types, used as the request label and span names
+const (
+	requestQuery       = "query"
+	requestNextRecords = "next_records"
+)
+
+func startSpan(ctx context.Context, name string, key string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	attributes = append(attributes, persistenceKeyAttribute.String(key))
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan records err on the span if it's not nil, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// executeSoqlQueryAll runs a soql query with a span and latency metric
+func (p *LightningPoller) executeSoqlQueryAll(ctx context.Context, key, query string) (response pkg.SoqlResponse, err error) {
+	_, span := startSpan(ctx, "salesforce "+requestQuery, key, attribute.String("db.statement", query))
+	defer func() { endSpan(span, err) }()
+	defer p.observeSalesforceRequest(key, requestQuery, p.clock.Now())
+	client := p.clientFor(key)
+	pageSize := p.getQueryOverride(key).PageSize
+	pageSizeClient, ok := client.(PageSizeClient)
+	if pageSize > 0 && !ok {
+		// overrides are validated against the clients when they're set, but a
+		// query added later can be bound to an org whose client doesn't
+		// support page sizes
+		p.queryLogger(key).WithFields(logrus.Fields{"page_size": pageSize}).Warn("ignoring page size override, the salesforce client doesn't support page sizes")
+	}
+	if pageSize > 0 && ok {
+		response, err = pageSizeClient.ExecuteSoqlQueryAllWithPageSize(query, pageSize)
+	} else {
+		response, err = client.ExecuteSoqlQueryAll(query)
+	}
+	span.SetAttributes(pageSizeAttribute.Int(len(response.Records)))
+	return
+}
+
+// getNextRecords fetches a next records url with a span and latency metric
+func (p *LightningPoller) getNextRecords(ctx context.Context, key, url string) (response pkg.SoqlResponse, err error) {
+	_, span := startSpan(ctx, "salesforce "+requestNextRecords, key, cursorAttribute.String(url))
+	defer func() { endSpan(span, err) }()
+	defer p.observeSalesforceRequest(key, requestNextRecords, p.clock.Now())
+	response, err = p.clientFor(key).GetNextRecords(url)
+	span.SetAttributes(pageSizeAttribute.Int(len(response.Records)))
+	return
+}
+
+// invokeCallback passes records to the query's callback with a span and
+// duration metric. ContextCallback is given the span's context, so that the
+// handler's own spans join the same trace
+func (p *LightningPoller) invokeCallback(ctx context.Context, queryWithCallback QueryWithCallback, recordsJSON []byte, recordCount int) bool {
+	key := queryWithCallback.PersistenceKey
+	ctx, span := startSpan(ctx, "callback", key, recordCountAttribute.Int(recordCount))
+	defer span.End()
+	start := p.clock.Now()
+	var callbackErr error
+	var savePosition bool
+	if queryWithCallback.ContextCallback != nil {
+		savePosition = queryWithCallback.ContextCallback(ctx, recordsJSON, callbackErr)
+	} else {
+		savePosition = queryWithCallback.Callback(recordsJSON, callbackErr)
+	}
+	p.metrics.callbackDuration.WithLabelValues(key, queryWithCallback.Org).Observe(p.clock.Now().Sub(start).Seconds())
+	span.SetAttributes(attribute.Bool("lightning_poller.save_position", savePosition))
+	return savePosition
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// alertTimeout bounds how long a single alert handler call can take
+const alertTimeout = 30 * time.Second
+
+// SetAlertHandler replaces the handler that the watchdog notifies when a
+// query stalls or lags. It must be called before Run
+func (p *LightningPoller) SetAlertHandler(handler AlertHandler) {
+	p.alertHandler = handler
+}
+
+// defaultAlertHandler logs alerts, and posts them to LP_ALERT_WEBHOOK_URL if
+// it's set
+func defaultAlertHandler(config *RunConfig, logger Logger) AlertHandler {
+	logHandler := LogAlertHandler{Logger: logger}
+	if config.AlertWebhookURL == "" {
+		return logHandler
+	}
+	return MultiAlertHandler{logHandler, &WebhookAlertHandler{URL: config.AlertWebhookURL}}
+}
+
+// watchdogEnabled checks whether any query has a stall or lag threshold
+func (p *LightningPoller) watchdogEnabled() bool {
+	for _, query := range p.queries() {
+		if p.stallThreshold(query) > 0 || p.lagAlertThreshold(query) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *LightningPoller) stallThreshold(query QueryWithCallback) time.Duration {
+	if query.StallThreshold > 0 {
+		return query.StallThreshold
+	}
+	return p.config.StallThreshold
+}
+
+func (p *LightningPoller) lagAlertThreshold(query QueryWithCallback) time.Duration {
+	if query.LagAlertThreshold > 0 {
+		return query.LagAlertThreshold
+	}
+	return p.config.LagAlertThreshold
+}
+
+// watchdog tracks which alerts are currently firing for each persistence key,
+// so that handlers are only notified when a threshold is crossed or recovers
+type watchdog struct {
+	poller *LightningPoller
+	firing map[string]map[AlertKind]bool
+}
+
+// runWatchdog checks every query on the watchdog interval, forever. It waits
+// and reads the time with the poller's clock, which progress is recorded with
+func (p *LightningPoller) runWatchdog() {
+	w := &watchdog{poller: p, firing: map[string]map[AlertKind]bool{}}
+	for {
+		<-p.after(p.config.WatchdogInterval)
+		w.check(p.clock.Now())
+	}
+}
+
+func (w *watchdog) check(now time.Time) {
+	queries := w.poller.queries()
+	// forget alerts for queries that were removed, so that they alert again
+	// if they're added back
+	for key := range w.firing {
+		if _, ok := w.poller.getQuery(key); !ok {
+			delete(w.firing, key)
+		}
+	}
+	for _, query := range queries {
+		key := query.PersistenceKey
+		if w.poller.isPaused(key) || !w.poller.assigned(key) {
+			// paused queries, and queries polled by another replica, aren't
+			// expected to advance here
+			continue
+		}
+		_, status := w.poller.copyQueryStatus(key)
+		alert := Alert{
+			PersistenceKey: key,
+			SinceProgress:  now.Sub(status.lastProgressTime),
+			Lag:            w.poller.lag(key, now),
+			Time:           now,
+		}
+		if position := w.poller.getCurrentPosition(key); position != nil {
+			alert.LastModifiedDate = position.LastModifiedDate
+		}
+		if status.lastError != nil {
+			alert.LastError = status.lastError.Error()
+		}
+		if threshold := w.poller.stallThreshold(query); threshold > 0 && !status.lastProgressTime.IsZero() {
+			alert.Kind = AlertKindStalled
+			alert.Threshold = threshold
+			w.update(alert, alert.SinceProgress > threshold)
+		}
+		if threshold := w.poller.lagAlertThreshold(query); threshold > 0 {
+			alert.Kind = AlertKindLagging
+			alert.Threshold = threshold
+			w.update(alert, alert.Lag > threshold)
+		}
+	}
+}
+
+// update notifies the alert handler if the alert started or stopped firing
+func (w *watchdog) update(alert Alert, firing bool) {
+	if w.firing[alert.PersistenceKey] == nil {
+		w.firing[alert.PersistenceKey] = map[AlertKind]bool{}
+	}
+	if w.firing[alert.PersistenceKey][alert.Kind] == firing {
+		return
+	}
+	w.firing[alert.PersistenceKey][alert.Kind] = firing
+	alert.Recovered = !firing
+	alert.Message = alertMessage(alert)
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	err := w.poller.alertHandler.HandleAlert(ctx, alert)
+	if err != nil {
+		w.poller.queryLogger(alert.PersistenceKey).WithFields(logrus.Fields{"kind": alert.Kind}).WithError(err).Error("error handling alert")
+	}
+}
+
+func alertMessage(alert Alert) string {
+	switch {
+	case alert.Kind == AlertKindStalled && alert.Recovered:
+		return fmt.Sprintf("%s is advancing again", alert.PersistenceKey)
+	case alert.Kind == AlertKindStalled:
+		return fmt.Sprintf("%s has not advanced or caught up for %s", alert.PersistenceKey, alert.SinceProgress.Round(time.Second))
+	case alert.Recovered:
+		return fmt.Sprintf("%s lag has recovered to %s", alert.PersistenceKey, alert.Lag.Round(time.Second))
+	default:
+		return fmt.Sprintf("%s is lagging %s behind salesforce", alert.PersistenceKey, alert.Lag.Round(time.Second))
+	}
+}
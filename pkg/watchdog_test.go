@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalystsquad/salesforce-lightning-poller/pkg/pollertest"
+)
+
+// fakeClock is a Clock that only moves when it's advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// tickingClock is a fakeClock whose waits end when the test sends on ticks
+type tickingClock struct {
+	fakeClock
+	ticks chan time.Time
+}
+
+func (c *tickingClock) After(d time.Duration) <-chan time.Time {
+	return c.ticks
+}
+
+func (c *tickingClock) tick(t *testing.T) {
+	t.Helper()
+	select {
+	case c.ticks <- c.Now():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watchdog to wait on the clock")
+	}
+}
+
+func TestWatchdogChecksByThePollersClock(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now().Add(-time.Hour), "Name": "Acme"})
+	clock := &tickingClock{fakeClock: fakeClock{now: time.Now()}, ticks: make(chan time.Time)}
+	alerts := make(chan Alert, 10)
+	handler := AlertHandlerFunc(func(ctx context.Context, alert Alert) error {
+		alerts <- alert
+		return nil
+	})
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback:       func(result []byte, err error) bool { return false },
+	}
+	poller, err := New(WithSalesforceClient(server.Client()), WithQueries(query), WithLastModifiedDateCorrection(0), WithClock(clock), WithWatchdog(time.Minute, 0, time.Hour), WithAlertHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.RunOnce(context.Background())
+	go poller.runWatchdog()
+	// the watchdog interval is an hour of the system clock
+	clock.tick(t)
+	select {
+	case alert := <-alerts:
+		t.Fatalf("expected no alert before the threshold on the poller's clock, got %+v", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.advance(2 * time.Minute)
+	clock.tick(t)
+	select {
+	case alert := <-alerts:
+		if alert.Kind != AlertKindStalled || alert.SinceProgress != 2*time.Minute {
+			t.Fatalf("expected a stalled alert two minutes after progress on the poller's clock, got %+v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the watchdog to alert on its tick")
+	}
+}
+
+func TestWatchdogAlertsWhenTheCallbackKeepsRejectingRecords(t *testing.T) {
+	server := pollertest.NewServer()
+	defer server.Close()
+	server.Put("Account", pollertest.Record{"Id": "001A", "LastModifiedDate": time.Now().Add(-time.Hour), "Name": "Acme"})
+	clock := &fakeClock{now: time.Now()}
+	alerts := []Alert{}
+	handler := AlertHandlerFunc(func(ctx context.Context, alert Alert) error {
+		alerts = append(alerts, alert)
+		return nil
+	})
+	calls := 0
+	query := QueryWithCallback{
+		PersistenceKey: "Accounts",
+		Query:          func() string { return "SELECT Id, Name, LastModifiedDate FROM Account" },
+		Callback: func(result []byte, err error) bool {
+			calls++
+			return false
+		},
+	}
+	poller, err := New(WithSalesforceClient(server.Client()), WithQueries(query), WithLastModifiedDateCorrection(0), WithClock(clock), WithWatchdog(time.Minute, 0, time.Minute), WithAlertHandler(handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = poller.RunOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), ErrCallbackRejected.Error()) {
+		t.Fatalf("expected the run to fail with the rejected page, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the poll to stop at the rejected page, got %d calls", calls)
+	}
+	state, err := poller.QueryState("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.UpToDate {
+		t.Fatal("expected a query whose page was rejected not to be up to date")
+	}
+	if state.LastModifiedDate != nil && !state.LastModifiedDate.IsZero() {
+		t.Fatalf("expected the position not to advance, got %s", state.LastModifiedDate)
+	}
+	w := &watchdog{poller: poller, firing: map[string]map[AlertKind]bool{}}
+	clock.advance(2 * time.Minute)
+	w.check(clock.Now())
+	if len(alerts) != 1 || alerts[0].Kind != AlertKindStalled || alerts[0].Recovered {
+		t.Fatalf("expected a stalled alert, got %+v", alerts)
+	}
+	if !strings.Contains(alerts[0].LastError, ErrCallbackRejected.Error()) {
+		t.Fatalf("expected the alert to have the rejection as its last error, got %s", alerts[0].LastError)
+	}
+}
@@ -0,0 +1,220 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/joomcode/errorx"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// webhook sink request headers
+const (
+	WebhookSignatureHeader      = "X-Lightning-Poller-Signature"
+	WebhookIdempotencyKeyHeader = "Idempotency-Key"
+	WebhookPersistenceKeyHeader = "X-Lightning-Poller-Persistence-Key"
+)
+
+// WebhookSink is a ready made callback that posts records as json to a url.
+// Failed requests are retried with a doubling backoff on 5xx and 429
+// responses and network errors, and the position only advances once every
+// request gets a 2xx response
+type WebhookSink struct {
+	URL string
+	// Headers are added to every request, for example for authorization
+	Headers map[string]string
+	// Secret signs each request body with HMAC-SHA256, sent as
+	// sha256=<hex digest> in the X-Lightning-Poller-Signature header
+	Secret string
+	// PerRecord posts each record on its own, instead of a json array of the
+	// page of records
+	PerRecord bool
+	// Timeout of each request, defaults to 10s
+	Timeout time.Duration
+	// MaxAttempts is how many times a request is tried, defaults to 5
+	MaxAttempts int
+	// Backoff before the first retry, doubling up to MaxBackoff. Defaults to
+	// 1s and 1m. A Retry-After header on a 429 response takes precedence, up
+	// to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Logger defaults to the app-utils-go logrus logger
+	Logger Logger
+}
+
+// NewWebhookSink creates a WebhookSink with the default settings
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url}
+}
+
+// ContextCallback returns a callback for QueryWithCallback.ContextCallback that
+// posts the records of the query with the given persistence key
+func (s *WebhookSink) ContextCallback(persistenceKey string) func(ctx context.Context, result []byte, err error) bool {
+	return func(ctx context.Context, result []byte, err error) bool {
+		err = s.Deliver(ctx, persistenceKey, result)
+		if err != nil {
+			s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey, "url": s.URL}).WithError(err).Error("error delivering records to webhook")
+			return false
+		}
+		return true
+	}
+}
+
+// Callback returns a callback for QueryWithCallback.Callback, see
+// ContextCallback
+func (s *WebhookSink) Callback(persistenceKey string) func(result []byte, err error) bool {
+	callback := s.ContextCallback(persistenceKey)
+	return func(result []byte, err error) bool {
+		return callback(context.Background(), result, err)
+	}
+}
+
+// Deliver posts a page of records, either as one batch or one request per
+// record. Each request has an idempotency key derived from the persistence key
+// and the Id and LastModifiedDate of its records, so the receiver can discard
+// requests that are retried or redelivered
+func (s *WebhookSink) Deliver(ctx context.Context, persistenceKey string, result []byte) error {
+	records := gjson.ParseBytes(result)
+	if !s.PerRecord {
+		return s.post(ctx, persistenceKey, result, IdempotencyKey(persistenceKey, records.Array()...))
+	}
+	for _, record := range records.Array() {
+		err := s.post(ctx, persistenceKey, []byte(record.Raw), IdempotencyKey(persistenceKey, record))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends body, retrying until it gets a 2xx response, a response that
+// can't succeed on retry, or runs out of attempts
+func (s *WebhookSink) post(ctx context.Context, persistenceKey string, body []byte, key string) error {
+	maxAttempts := s.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	backoff := s.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := s.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := s.send(ctx, persistenceKey, body, key)
+		if err == nil {
+			return nil
+		}
+		if retryAfter < 0 || attempt >= maxAttempts {
+			return errorx.Decorate(err, "webhook failed after %d attempts", attempt)
+		}
+		wait := backoff
+		if retryAfter > 0 {
+			// the receiver can't hold up the query for longer than the sink
+			// would back off on its own
+			wait = retryAfter
+			if wait > maxBackoff {
+				wait = maxBackoff
+			}
+		}
+		s.logger().WithFields(logrus.Fields{"persistence_key": persistenceKey, "attempt": attempt, "backoff": wait}).WithError(err).Warn("retrying webhook")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// send makes one request. retryAfter is negative if the request shouldn't be
+// retried, and positive if the response asked for a delay
+func (s *WebhookSink) send(ctx context.Context, persistenceKey string, body []byte, key string) (retryAfter time.Duration, err error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookIdempotencyKeyHeader, key)
+	request.Header.Set(WebhookPersistenceKeyHeader, persistenceKey)
+	if s.Secret != "" {
+		request.Header.Set(WebhookSignatureHeader, SignWebhook(s.Secret, body))
+	}
+	for name, value := range s.Headers {
+		request.Header.Set(name, value)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		// network errors and timeouts are retried
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode <= 299:
+		return 0, nil
+	case response.StatusCode == http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, errorx.ExternalError.New("webhook responded with status %d", response.StatusCode)
+	case response.StatusCode >= 500:
+		return 0, errorx.ExternalError.New("webhook responded with status %d", response.StatusCode)
+	default:
+		return -1, errorx.ExternalError.New("webhook responded with status %d", response.StatusCode)
+	}
+}
+
+func (s *WebhookSink) logger() Logger {
+	if s.Logger == nil {
+		return defaultLogger()
+	}
+	return s.Logger
+}
+
+// SignWebhook returns the signature header value for body, for receivers to
+// compare with hmac.Equal
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IdempotencyKey hashes the persistence key with the Id and LastModifiedDate
+// of each record, so the same records at the same versions get the same key.
+// Sinks use it to name what they write, so redelivered records replace
+// instead of duplicating it
+func IdempotencyKey(persistenceKey string, records ...gjson.Result) string {
+	hash := sha256.New()
+	hash.Write([]byte(persistenceKey))
+	for _, record := range records {
+		hash.Write([]byte{0})
+		hash.Write([]byte(record.Get("Id").String()))
+		hash.Write([]byte{0})
+		hash.Write([]byte(record.Get("LastModifiedDate").String()))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,166 @@
+package pkg_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	lp "github.com/catalystsquad/salesforce-lightning-poller/pkg"
+)
+
+// webhookRequest is a request received by a webhookServer
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer records requests and answers them with statuses in order,
+// then with 200
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	headers  []http.Header
+	requests []webhookRequest
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, webhookRequest{header: r.Header.Clone(), body: body})
+		if len(s.statuses) == 0 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		if len(s.headers) > 0 {
+			for name, values := range s.headers[0] {
+				w.Header()[name] = values
+			}
+			s.headers = s.headers[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *webhookServer) received() []webhookRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]webhookRequest{}, s.requests...)
+}
+
+const webhookPage = `[{"Id":"001A","LastModifiedDate":"2024-01-01T00:00:00.000+0000"},{"Id":"001B","LastModifiedDate":"2024-01-01T00:00:01.000+0000"}]`
+
+func TestWebhookSinkSignsRequests(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	sink := lp.NewWebhookSink(server.URL)
+	sink.Secret = "secret"
+	err := sink.Deliver(context.Background(), "Accounts", []byte(webhookPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(requests[0].body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := requests[0].header.Get(lp.WebhookSignatureHeader); !hmac.Equal([]byte(signature), []byte(expected)) {
+		t.Fatalf("expected signature %s, got %s", expected, signature)
+	}
+	if key := requests[0].header.Get(lp.WebhookPersistenceKeyHeader); key != "Accounts" {
+		t.Fatalf("expected the persistence key header, got %q", key)
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		fails    bool
+	}{
+		{name: "server errors are retried", statuses: []int{500, 503}, requests: 3},
+		{name: "too many requests is retried", statuses: []int{429}, requests: 2},
+		{name: "client errors aren't retried", statuses: []int{400}, requests: 1, fails: true},
+		{name: "attempts run out", statuses: []int{500, 500, 500}, requests: 3, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newWebhookServer(test.statuses...)
+			defer server.Close()
+			sink := lp.NewWebhookSink(server.URL)
+			sink.MaxAttempts = 3
+			sink.Backoff = time.Millisecond
+			err := sink.Deliver(context.Background(), "Accounts", []byte(webhookPage))
+			if test.fails != (err != nil) {
+				t.Fatalf("expected failure %v, got %v", test.fails, err)
+			}
+			if n := len(server.received()); n != test.requests {
+				t.Fatalf("expected %d requests, got %d", test.requests, n)
+			}
+		})
+	}
+}
+
+func TestWebhookSinkCapsRetryAfterAtTheMaxBackoff(t *testing.T) {
+	server := newWebhookServer(http.StatusTooManyRequests)
+	server.headers = []http.Header{{"Retry-After": {"3600"}}}
+	defer server.Close()
+	sink := lp.NewWebhookSink(server.URL)
+	sink.MaxBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := sink.Deliver(ctx, "Accounts", []byte(webhookPage))
+	if err != nil {
+		t.Fatalf("expected the retry to wait the max backoff rather than an hour, got %v", err)
+	}
+	if n := len(server.received()); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestWebhookSinkIdempotencyKeysAreStable(t *testing.T) {
+	server := newWebhookServer()
+	defer server.Close()
+	sink := lp.NewWebhookSink(server.URL)
+	sink.PerRecord = true
+	for i := 0; i < 2; i++ {
+		err := sink.Deliver(context.Background(), "Accounts", []byte(webhookPage))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a new version of the first record
+	err := sink.Deliver(context.Background(), "Accounts", []byte(`[{"Id":"001A","LastModifiedDate":"2024-01-02T00:00:00.000+0000"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, request := range server.received() {
+		keys = append(keys, request.header.Get(lp.WebhookIdempotencyKeyHeader))
+	}
+	if len(keys) != 5 {
+		t.Fatalf("expected 5 requests, got %d", len(keys))
+	}
+	if keys[0] != keys[2] || keys[1] != keys[3] {
+		t.Fatalf("expected redelivered records to keep their keys, got %v", keys)
+	}
+	if keys[0] == keys[1] || keys[0] == keys[4] {
+		t.Fatalf("expected different records and versions to get different keys, got %v", keys)
+	}
+}